@@ -0,0 +1,27 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/malwarebo/gopay/providers"
+)
+
+type AdminHandler struct {
+	healthMonitor *providers.HealthMonitor
+}
+
+func NewAdminHandler(healthMonitor *providers.HealthMonitor) *AdminHandler {
+	return &AdminHandler{
+		healthMonitor: healthMonitor,
+	}
+}
+
+// HandleProviderHealth reports the circuit breaker state of every provider
+func (h *AdminHandler) HandleProviderHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.healthMonitor.Snapshot())
+}
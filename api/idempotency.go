@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/malwarebo/gopay/providers"
+	"github.com/malwarebo/gopay/services"
+)
+
+// IdempotencyHeader is the request header clients use to make POSTs safe to retry
+const IdempotencyHeader = "Idempotency-Key"
+
+// idempotencyFinishTimeout bounds storing the response of a request
+const idempotencyFinishTimeout = 5 * time.Second
+
+type IdempotencyMiddleware struct {
+	idempotencyService *services.IdempotencyService
+}
+
+func NewIdempotencyMiddleware(idempotencyService *services.IdempotencyService) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{
+		idempotencyService: idempotencyService,
+	}
+}
+
+// Wrap honors the Idempotency-Key header on POST requests. The first response
+// for a key is stored and replayed for retries of the same request.
+func (m *IdempotencyMiddleware) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		endpoint := r.Method + " " + r.URL.Path
+		record, replay, err := m.idempotencyService.Begin(r.Context(), key, endpoint, body)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrIdempotencyKeyInUse):
+				writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+			case errors.Is(err, services.ErrIdempotencyKeyMismatch):
+				writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+			default:
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			}
+			return
+		}
+
+		if replay {
+			w.Header().Set("Content-Type", record.ResponseContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.ResponseCode)
+			w.Write(record.ResponseBody)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(providers.WithIdempotencyKey(r.Context(), providers.ScopeIdempotencyKey(endpoint, key))))
+
+		// The request context is canceled if the client has gone away, but the
+		// handler may already have charged, so the record is finished on a
+		// context of its own. A key left in progress would be reclaimed and
+		// the request run a second time.
+		ctx, cancel := context.WithTimeout(context.Background(), idempotencyFinishTimeout)
+		defer cancel()
+
+		// Server errors and conflicts, such as a subscription being renewed,
+		// are not stored so that the client can retry them
+		if recorder.status >= http.StatusInternalServerError || recorder.status == http.StatusConflict {
+			err = m.idempotencyService.Release(ctx, record)
+		} else {
+			err = m.idempotencyService.Complete(ctx, record, recorder.status, recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("Idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
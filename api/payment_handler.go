@@ -2,9 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/malwarebo/gopay/models"
+	"github.com/malwarebo/gopay/providers"
 	"github.com/malwarebo/gopay/services"
 )
 
@@ -40,6 +48,15 @@ func (h *PaymentHandler) HandleCharge(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: "No payment provider available"})
 			return
 		}
+		if errors.Is(err, services.ErrInvalidCaptureMethod) || errors.Is(err, services.ErrInvalidAmount) ||
+			errors.Is(err, services.ErrInvalidCurrency) || errors.Is(err, models.ErrPrecisionLoss) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if providers.ClassifyError(err) == providers.ErrorClassDeclined {
+			writeJSON(w, http.StatusPaymentRequired, ErrorResponse{Error: err.Error()})
+			return
+		}
 		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
 		return
 	}
@@ -65,13 +82,226 @@ func (h *PaymentHandler) HandleRefund(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: "No payment provider available"})
 			return
 		}
+		writePaymentError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// HandlePayments serves GET /payments, GET /payments/{id}, GET /payments/{id}/refunds
+// and POST /payments/{id}/confirm, /capture and /void
+func (h *PaymentHandler) HandlePayments(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/payments"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.handleListPayments(w, r)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.handleGetPayment(w, r, parts[0])
+		return
+	}
+	if len(parts) != 2 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if parts[1] == "refunds" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.handleListRefunds(w, r, parts[0])
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch parts[1] {
+	case "confirm":
+		h.handleConfirm(w, r, parts[0])
+	case "capture":
+		h.handleCapture(w, r, parts[0])
+	case "void":
+		h.handleVoid(w, r, parts[0])
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (h *PaymentHandler) handleGetPayment(w http.ResponseWriter, r *http.Request, id string) {
+	payment, err := h.paymentService.GetPayment(r.Context(), id)
+	if err != nil {
+		writePaymentError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, payment)
+}
+
+func (h *PaymentHandler) handleListRefunds(w http.ResponseWriter, r *http.Request, id string) {
+	refunds, err := h.paymentService.ListRefunds(r.Context(), id)
+	if err != nil {
+		writePaymentError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, refunds)
+}
+
+func (h *PaymentHandler) handleListPayments(w http.ResponseWriter, r *http.Request) {
+	filter, err := parsePaymentFilter(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	page, err := h.paymentService.SearchPayments(r.Context(), filter)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidPaymentFilter) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
 		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
 		return
 	}
 
+	writeJSON(w, http.StatusOK, page)
+}
+
+// parsePaymentFilter reads the listing filters. Amounts are in the smallest
+// currency unit and times are RFC 3339.
+func parsePaymentFilter(query url.Values) (*models.PaymentFilter, error) {
+	filter := &models.PaymentFilter{
+		CustomerID:   query.Get("customer_id"),
+		Status:       models.PaymentStatus(query.Get("status")),
+		ProviderName: query.Get("provider"),
+		Currency:     strings.ToUpper(query.Get("currency")),
+		SortBy:       query.Get("sort"),
+		Cursor:       query.Get("cursor"),
+	}
+
+	for name, dst := range map[string]**int64{"min_amount": &filter.MinAmount, "max_amount": &filter.MaxAmount} {
+		if value := query.Get(name); value != "" {
+			amount, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", name)
+			}
+			*dst = &amount
+		}
+	}
+
+	for name, dst := range map[string]**time.Time{"created_from": &filter.CreatedFrom, "created_to": &filter.CreatedTo} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: expected RFC 3339 time", name)
+			}
+			*dst = &t
+		}
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		return nil, fmt.Errorf("invalid order %q", order)
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit")
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+func (h *PaymentHandler) handleConfirm(w http.ResponseWriter, r *http.Request, id string) {
+	// The body is optional
+	var req models.ConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	resp, err := h.paymentService.ConfirmPayment(r.Context(), id, &req)
+	if err != nil {
+		writePaymentError(w, err)
+		return
+	}
+
 	writeJSON(w, http.StatusOK, resp)
 }
 
+func (h *PaymentHandler) handleCapture(w http.ResponseWriter, r *http.Request, id string) {
+	// The body is optional
+	var req models.CaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	resp, err := h.paymentService.CapturePayment(r.Context(), id, &req)
+	if err != nil {
+		writePaymentError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *PaymentHandler) handleVoid(w http.ResponseWriter, r *http.Request, id string) {
+	// The body is optional
+	var req models.VoidRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	resp, err := h.paymentService.VoidPayment(r.Context(), id, &req)
+	if err != nil {
+		writePaymentError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// writePaymentError maps errors from follow-up operations on a stored payment
+func writePaymentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrPaymentNotFound):
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "Payment not found"})
+	case errors.Is(err, services.ErrInvalidAmount), errors.Is(err, services.ErrInvalidCurrency), errors.Is(err, services.ErrPaymentIDRequired),
+		errors.Is(err, services.ErrRefundCurrencyMismatch), errors.Is(err, models.ErrPrecisionLoss):
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrPaymentNotAuthorized), errors.Is(err, services.ErrCaptureAmountExceeded),
+		errors.Is(err, services.ErrPaymentNotAwaitingAction), errors.Is(err, services.ErrPaymentNotRefundable),
+		errors.Is(err, services.ErrRefundExceedsBalance):
+		writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, providers.ErrOperationNotSupported):
+		writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, providers.ErrProviderUnavailable):
+		writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	}
+}
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -2,10 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/malwarebo/gopay/models"
+	"github.com/malwarebo/gopay/providers"
 	"github.com/malwarebo/gopay/services"
 )
 
@@ -22,6 +25,14 @@ func NewSubscriptionHandler(subscriptionService *services.SubscriptionService) *
 func (h *SubscriptionHandler) HandlePlans(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
+		if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/plans"), "/"); id != "" {
+			if planID, ok := strings.CutSuffix(id, "/quote"); ok {
+				h.handleQuotePlan(w, r, planID)
+			} else {
+				http.Error(w, "Not found", http.StatusNotFound)
+			}
+			return
+		}
 		h.handleCreatePlan(w, r)
 	case http.MethodGet:
 		if id := strings.TrimPrefix(r.URL.Path, "/plans/"); id != "" {
@@ -49,9 +60,31 @@ func (h *SubscriptionHandler) HandlePlans(w http.ResponseWriter, r *http.Request
 func (h *SubscriptionHandler) HandleSubscriptions(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
+		if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/subscriptions"), "/"); id != "" {
+			if subscriptionID, ok := strings.CutSuffix(id, "/usage"); ok {
+				h.handleRecordUsage(w, r, subscriptionID)
+			} else if subscriptionID, ok := strings.CutSuffix(id, "/preview"); ok {
+				h.handlePreviewUpdate(w, r, subscriptionID)
+			} else if subscriptionID, ok := strings.CutSuffix(id, "/pause"); ok {
+				h.handlePauseSubscription(w, r, subscriptionID)
+			} else if subscriptionID, ok := strings.CutSuffix(id, "/resume"); ok {
+				h.handleResumeSubscription(w, r, subscriptionID)
+			} else {
+				http.Error(w, "Not found", http.StatusNotFound)
+			}
+			return
+		}
 		h.handleCreateSubscription(w, r)
 	case http.MethodGet:
 		if id := strings.TrimPrefix(r.URL.Path, "/subscriptions/"); id != "" {
+			if subscriptionID, ok := strings.CutSuffix(id, "/events"); ok {
+				h.handleListEvents(w, r, subscriptionID)
+				return
+			}
+			if subscriptionID, ok := strings.CutSuffix(id, "/usage"); ok {
+				h.handleGetUsage(w, r, subscriptionID)
+				return
+			}
 			h.handleGetSubscription(w, r, id)
 		} else {
 			h.handleListSubscriptions(w, r)
@@ -83,7 +116,7 @@ func (h *SubscriptionHandler) handleCreatePlan(w http.ResponseWriter, r *http.Re
 
 	createdPlan, err := h.subscriptionService.CreatePlan(r.Context(), &plan)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		writeSubscriptionError(w, err)
 		return
 	}
 
@@ -99,7 +132,7 @@ func (h *SubscriptionHandler) handleUpdatePlan(w http.ResponseWriter, r *http.Re
 
 	updatedPlan, err := h.subscriptionService.UpdatePlan(r.Context(), planID, &plan)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		writeSubscriptionError(w, err)
 		return
 	}
 
@@ -108,7 +141,7 @@ func (h *SubscriptionHandler) handleUpdatePlan(w http.ResponseWriter, r *http.Re
 
 func (h *SubscriptionHandler) handleDeletePlan(w http.ResponseWriter, r *http.Request, planID string) {
 	if err := h.subscriptionService.DeletePlan(r.Context(), planID); err != nil {
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		writeSubscriptionError(w, err)
 		return
 	}
 
@@ -118,7 +151,7 @@ func (h *SubscriptionHandler) handleDeletePlan(w http.ResponseWriter, r *http.Re
 func (h *SubscriptionHandler) handleGetPlan(w http.ResponseWriter, r *http.Request, planID string) {
 	plan, err := h.subscriptionService.GetPlan(r.Context(), planID)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		writeSubscriptionError(w, err)
 		return
 	}
 
@@ -135,6 +168,22 @@ func (h *SubscriptionHandler) handleListPlans(w http.ResponseWriter, r *http.Req
 	writeJSON(w, http.StatusOK, plans)
 }
 
+func (h *SubscriptionHandler) handleQuotePlan(w http.ResponseWriter, r *http.Request, planID string) {
+	var req models.QuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	quote, err := h.subscriptionService.QuotePlan(r.Context(), planID, req.Quantity)
+	if err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, quote)
+}
+
 // Subscription handlers
 func (h *SubscriptionHandler) handleCreateSubscription(w http.ResponseWriter, r *http.Request) {
 	var req models.CreateSubscriptionRequest
@@ -145,7 +194,7 @@ func (h *SubscriptionHandler) handleCreateSubscription(w http.ResponseWriter, r
 
 	subscription, err := h.subscriptionService.CreateSubscription(r.Context(), &req)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		writeSubscriptionError(w, err)
 		return
 	}
 
@@ -161,13 +210,29 @@ func (h *SubscriptionHandler) handleUpdateSubscription(w http.ResponseWriter, r
 
 	subscription, err := h.subscriptionService.UpdateSubscription(r.Context(), subscriptionID, &req)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		writeSubscriptionError(w, err)
 		return
 	}
 
 	writeJSON(w, http.StatusOK, subscription)
 }
 
+func (h *SubscriptionHandler) handlePreviewUpdate(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	var req models.UpdateSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	proration, err := h.subscriptionService.PreviewUpdate(r.Context(), subscriptionID, &req)
+	if err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, proration)
+}
+
 func (h *SubscriptionHandler) handleCancelSubscription(w http.ResponseWriter, r *http.Request, subscriptionID string) {
 	var req models.CancelSubscriptionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -177,7 +242,33 @@ func (h *SubscriptionHandler) handleCancelSubscription(w http.ResponseWriter, r
 
 	subscription, err := h.subscriptionService.CancelSubscription(r.Context(), subscriptionID, &req)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, subscription)
+}
+
+func (h *SubscriptionHandler) handlePauseSubscription(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	var req models.PauseSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	subscription, err := h.subscriptionService.PauseSubscription(r.Context(), subscriptionID, &req)
+	if err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, subscription)
+}
+
+func (h *SubscriptionHandler) handleResumeSubscription(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	subscription, err := h.subscriptionService.ResumeSubscription(r.Context(), subscriptionID)
+	if err != nil {
+		writeSubscriptionError(w, err)
 		return
 	}
 
@@ -187,7 +278,7 @@ func (h *SubscriptionHandler) handleCancelSubscription(w http.ResponseWriter, r
 func (h *SubscriptionHandler) handleGetSubscription(w http.ResponseWriter, r *http.Request, subscriptionID string) {
 	subscription, err := h.subscriptionService.GetSubscription(r.Context(), subscriptionID)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		writeSubscriptionError(w, err)
 		return
 	}
 
@@ -209,3 +300,75 @@ func (h *SubscriptionHandler) handleListSubscriptions(w http.ResponseWriter, r *
 
 	writeJSON(w, http.StatusOK, subscriptions)
 }
+
+func (h *SubscriptionHandler) handleListEvents(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	events, err := h.subscriptionService.ListEvents(r.Context(), subscriptionID)
+	if err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (h *SubscriptionHandler) handleRecordUsage(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	var req models.RecordUsageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	record, err := h.subscriptionService.RecordUsage(r.Context(), subscriptionID, &req)
+	if err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, record)
+}
+
+func (h *SubscriptionHandler) handleGetUsage(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	var periodStart *time.Time
+	if value := r.URL.Query().Get("period_start"); value != "" {
+		start, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "period_start must be an RFC 3339 time"})
+			return
+		}
+		periodStart = &start
+	}
+
+	summary, err := h.subscriptionService.GetUsage(r.Context(), subscriptionID, periodStart)
+	if err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, summary)
+}
+
+func writeSubscriptionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrPlanNotFound), errors.Is(err, services.ErrSubscriptionNotFound):
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrInvalidPlan), errors.Is(err, services.ErrInvalidAmount), errors.Is(err, services.ErrInvalidCurrency),
+		errors.Is(err, services.ErrInvalidPaymentMethod), errors.Is(err, services.ErrInvalidQuantity), errors.Is(err, services.ErrInvalidUsage), errors.Is(err, services.ErrInvalidTrial),
+		errors.Is(err, services.ErrInvalidPause),
+		errors.Is(err, models.ErrInvalidBillingPeriod), errors.Is(err, models.ErrInvalidDunningAction), errors.Is(err, models.ErrInvalidProrationBehavior), errors.Is(err, models.ErrPrecisionLoss),
+		errors.Is(err, models.ErrAmountOverflow):
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrPlanInactive), errors.Is(err, services.ErrPlanBillingMismatch), errors.Is(err, services.ErrSubscriptionCanceled),
+		errors.Is(err, services.ErrPlanNotMetered), errors.Is(err, services.ErrCannotPause), errors.Is(err, services.ErrSubscriptionNotPaused),
+		errors.Is(err, services.ErrSubscriptionChanged):
+		writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrFirstPaymentIncomplete), errors.Is(err, services.ErrProrationPaymentIncomplete),
+		providers.ClassifyError(err) == providers.ErrorClassDeclined:
+		writeJSON(w, http.StatusPaymentRequired, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, providers.ErrOperationNotSupported):
+		writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, services.ErrNoAvailableProvider), errors.Is(err, providers.ErrProviderUnavailable):
+		writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/malwarebo/gopay/providers"
+	"github.com/malwarebo/gopay/services"
+)
+
+// maxWebhookBodyBytes caps the size of webhook payloads we are willing to read
+const maxWebhookBodyBytes = 1 << 20
+
+type WebhookHandler struct {
+	webhookService *services.WebhookService
+}
+
+func NewWebhookHandler(webhookService *services.WebhookService) *WebhookHandler {
+	return &WebhookHandler{
+		webhookService: webhookService,
+	}
+}
+
+func (h *WebhookHandler) HandleStripe(w http.ResponseWriter, r *http.Request) {
+	h.handleWebhook(w, r, "stripe")
+}
+
+func (h *WebhookHandler) HandleXendit(w http.ResponseWriter, r *http.Request) {
+	h.handleWebhook(w, r, "xendit")
+}
+
+func (h *WebhookHandler) handleWebhook(w http.ResponseWriter, r *http.Request, provider string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	if err := h.webhookService.HandleWebhook(r.Context(), provider, payload, r.Header); err != nil {
+		if errors.Is(err, providers.ErrInvalidWebhookSignature) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		// Any other failure is returned as a 5xx so the provider redelivers the event
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"received": true})
+}
@@ -12,6 +12,9 @@ type Config struct {
 	Stripe   StripeConfig  `json:"stripe"`
 	Xendit   XenditConfig  `json:"xendit"`
 	Server   ServerConfig  `json:"server"`
+	Routing  RoutingConfig `json:"routing"`
+	Health   HealthConfig  `json:"health"`
+	Billing  BillingConfig `json:"billing"`
 }
 
 type DatabaseConfig struct {
@@ -24,19 +27,109 @@ type DatabaseConfig struct {
 }
 
 type StripeConfig struct {
-	Secret string `json:"secret"`
-	Public string `json:"public"`
+	Secret        string `json:"secret"`
+	Public        string `json:"public"`
+	WebhookSecret string `json:"webhook_secret"`
 }
 
 type XenditConfig struct {
 	Secret string `json:"secret"`
 	Public string `json:"public"`
+	// WebhookSecret is the callback verification token sent as x-callback-token
+	WebhookSecret string `json:"webhook_secret"`
 }
 
 type ServerConfig struct {
 	Port string `json:"port"`
 }
 
+// HealthConfig controls the per-provider circuit breakers. A provider's circuit
+// opens when the error rate over the rolling window reaches ErrorRateThreshold.
+// Calls slower than LatencyThresholdMs count as errors.
+type HealthConfig struct {
+	WindowSeconds        int     `json:"window_seconds"`
+	MinRequests          int     `json:"min_requests"`
+	ErrorRateThreshold   float64 `json:"error_rate_threshold"`
+	LatencyThresholdMs   int64   `json:"latency_threshold_ms"`
+	OpenSeconds          int     `json:"open_seconds"`
+	HalfOpenProbes       int     `json:"half_open_probes"`
+	ProbeIntervalSeconds int     `json:"probe_interval_seconds"`
+}
+
+// NativeBilling is the plan provider for plans billed by gopay itself
+const NativeBilling = "native"
+
+// BillingConfig controls the subscription renewal scheduler. Every
+// IntervalSeconds each replica leases up to BatchSize due subscriptions for
+// LeaseSeconds, which must comfortably exceed the time a renewal charge takes.
+//
+// PlanProvider decides who bills new plans: "native" keeps plans and
+// subscriptions in gopay and charges stored payment methods on renewal,
+// while a provider name such as "stripe" creates them with that provider.
+// PlanProviders overrides it for individual plans, keyed by plan name.
+//
+// ProrationBehavior (immediately, next_renewal or none) is how plan and
+// quantity changes to native subscriptions are prorated when the request
+// does not say. TrialEndingDays is how many days before a native trial ends
+// its trial_ending event is recorded.
+type BillingConfig struct {
+	Enabled         bool              `json:"enabled"`
+	IntervalSeconds int               `json:"interval_seconds"`
+	BatchSize       int               `json:"batch_size"`
+	LeaseSeconds    int               `json:"lease_seconds"`
+	Dunning         DunningConfig     `json:"dunning"`
+	PlanProvider    string            `json:"plan_provider"`
+	PlanProviders   map[string]string `json:"plan_providers,omitempty"`
+	ProrationBehavior string          `json:"proration_behavior"`
+	TrialEndingDays int               `json:"trial_ending_days"`
+}
+
+// ProviderForPlan returns the provider that bills the named plan, or the
+// empty string for native billing
+func (c BillingConfig) ProviderForPlan(name string) string {
+	provider, ok := c.PlanProviders[name]
+	if !ok {
+		provider = c.PlanProvider
+	}
+	if provider == NativeBilling {
+		return ""
+	}
+	return provider
+}
+
+// DunningConfig is the retry schedule for failed renewals. RetryDays are
+// counted from the end of the unpaid period, so [1, 3, 5, 7] retries a
+// renewal due on the 1st on the 2nd, 4th, 6th and 8th. Once they are used
+// up, or on a hard decline, FinalAction (cancel, pause or unpaid) is applied
+// to subscriptions whose plan does not set its own.
+type DunningConfig struct {
+	RetryDays   []int  `json:"retry_days"`
+	FinalAction string `json:"final_action"`
+}
+
+// RoutingConfig holds the ordered rules used to pick a provider for each charge.
+// Rules are evaluated top to bottom and the first match wins.
+type RoutingConfig struct {
+	Rules []RoutingRule `json:"rules"`
+}
+
+type RoutingRule struct {
+	Name               string            `json:"name"`
+	Currencies         []string          `json:"currencies,omitempty"`
+	MinAmount          *int64            `json:"min_amount,omitempty"`
+	MaxAmount          *int64            `json:"max_amount,omitempty"`
+	PaymentMethodTypes []string          `json:"payment_method_types,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	Providers          []RoutingTarget   `json:"providers"`
+}
+
+// RoutingTarget is a provider eligible under a rule. Traffic is split between
+// targets in proportion to their weights.
+type RoutingTarget struct {
+	Provider string `json:"provider"`
+	Weight   int    `json:"weight"`
+}
+
 // LoadConfig loads configuration from a JSON file and environment variables
 func LoadConfig() (*Config, error) {
 	config := &Config{}
@@ -80,9 +173,15 @@ func LoadConfig() (*Config, error) {
 	if stripeKey := os.Getenv("STRIPE_API_KEY"); stripeKey != "" {
 		config.Stripe.Secret = stripeKey
 	}
+	if stripeWebhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET"); stripeWebhookSecret != "" {
+		config.Stripe.WebhookSecret = stripeWebhookSecret
+	}
 	if xenditKey := os.Getenv("XENDIT_API_KEY"); xenditKey != "" {
 		config.Xendit.Secret = xenditKey
 	}
+	if xenditWebhookSecret := os.Getenv("XENDIT_WEBHOOK_SECRET"); xenditWebhookSecret != "" {
+		config.Xendit.WebhookSecret = xenditWebhookSecret
+	}
 	if port := os.Getenv("PORT"); port != "" {
 		config.Server.Port = port
 	}
@@ -97,10 +196,78 @@ func LoadConfig() (*Config, error) {
 	if config.Database.SSLMode == "" {
 		config.Database.SSLMode = "disable"
 	}
+	if config.Health.WindowSeconds == 0 {
+		config.Health.WindowSeconds = 60
+	}
+	if config.Health.MinRequests == 0 {
+		config.Health.MinRequests = 10
+	}
+	if config.Health.ErrorRateThreshold == 0 {
+		config.Health.ErrorRateThreshold = 0.5
+	}
+	if config.Health.LatencyThresholdMs == 0 {
+		config.Health.LatencyThresholdMs = 10000
+	}
+	if config.Health.OpenSeconds == 0 {
+		config.Health.OpenSeconds = 30
+	}
+	if config.Health.HalfOpenProbes == 0 {
+		config.Health.HalfOpenProbes = 3
+	}
+	if config.Health.ProbeIntervalSeconds == 0 {
+		config.Health.ProbeIntervalSeconds = 15
+	}
+	if config.Billing.IntervalSeconds == 0 {
+		config.Billing.IntervalSeconds = 60
+	}
+	if config.Billing.BatchSize == 0 {
+		config.Billing.BatchSize = 50
+	}
+	if config.Billing.LeaseSeconds == 0 {
+		config.Billing.LeaseSeconds = 300
+	}
+	// An explicit empty list disables retries
+	if config.Billing.Dunning.RetryDays == nil {
+		config.Billing.Dunning.RetryDays = []int{1, 3, 5, 7}
+	}
+	if config.Billing.PlanProvider == "" {
+		config.Billing.PlanProvider = NativeBilling
+	}
+	if config.Billing.Dunning.FinalAction == "" {
+		config.Billing.Dunning.FinalAction = "cancel"
+	}
+	if err := config.Billing.Dunning.validate(); err != nil {
+		return nil, err
+	}
+	if config.Billing.TrialEndingDays == 0 {
+		config.Billing.TrialEndingDays = 3
+	}
+	switch config.Billing.ProrationBehavior {
+	case "":
+		config.Billing.ProrationBehavior = "next_renewal"
+	case "immediately", "next_renewal", "none":
+	default:
+		return nil, fmt.Errorf("billing.proration_behavior must be immediately, next_renewal or none, got %q", config.Billing.ProrationBehavior)
+	}
 
 	return config, nil
 }
 
+func (d DunningConfig) validate() error {
+	last := 0
+	for _, days := range d.RetryDays {
+		if days <= last {
+			return fmt.Errorf("billing.dunning.retry_days must be positive and increasing, got %v", d.RetryDays)
+		}
+		last = days
+	}
+	switch d.FinalAction {
+	case "cancel", "pause", "unpaid":
+		return nil
+	}
+	return fmt.Errorf("billing.dunning.final_action must be cancel, pause or unpaid, got %q", d.FinalAction)
+}
+
 func (c *Config) GetDatabaseURL() string {
 	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
 		c.Database.User,
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -41,6 +42,27 @@ func NewDB(dsn string) (*DB, error) {
 	return &DB{db}, nil
 }
 
+// txKey is the context key of the transaction started by InTransaction
+type txKey struct{}
+
+// WithContext returns a session bound to ctx. Within InTransaction the
+// session runs on its transaction, so every repository called with that
+// context shares it.
+func (db *DB) WithContext(ctx context.Context) *gorm.DB {
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return tx.WithContext(ctx)
+	}
+	return db.DB.WithContext(ctx)
+}
+
+// InTransaction runs fn in a transaction that is committed if fn returns nil.
+// fn must pass the context it is given to the repositories it calls.
+func (db *DB) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	})
+}
+
 func (db *DB) Close() error {
 	sqlDB, err := db.DB.DB()
 	if err != nil {
@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS webhook_events;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS evidence;
+DROP TABLE IF EXISTS disputes;
+DROP TABLE IF EXISTS refunds;
+DROP TABLE IF EXISTS payment_events;
+DROP TABLE IF EXISTS payment_attempts;
+DROP TABLE IF EXISTS payments;
+DROP TABLE IF EXISTS subscriptions;
+DROP TABLE IF EXISTS plans;
+DROP FUNCTION IF EXISTS update_updated_at_column();
@@ -1,21 +1,18 @@
--- Enable UUID extension
-CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
-
--- Create enum types
-CREATE TYPE subscription_status AS ENUM ('active', 'canceled', 'past_due', 'trialing');
-CREATE TYPE dispute_status AS ENUM ('open', 'under_review', 'won', 'lost', 'canceled');
-CREATE TYPE dispute_reason AS ENUM ('fraudulent', 'duplicate', 'product_not_received', 'product_unacceptable', 'unrecognized', 'credit_not_processed', 'general');
+-- gen_random_uuid() is built in from PostgreSQL 13; pgcrypto provides it on 12
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
 
 -- Plans table
 CREATE TABLE plans (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     name VARCHAR(255) NOT NULL,
     description TEXT,
-    amount BIGINT NOT NULL,
+    amount DOUBLE PRECISION NOT NULL,
     currency VARCHAR(3) NOT NULL,
-    interval VARCHAR(50) NOT NULL,
-    trial_days INTEGER DEFAULT 0,
-    active BOOLEAN DEFAULT true,
+    billing_period VARCHAR(20) NOT NULL,
+    pricing_type VARCHAR(20) NOT NULL DEFAULT 'fixed',
+    trial_days INTEGER NOT NULL DEFAULT 0,
+    features JSONB,
+    active BOOLEAN NOT NULL DEFAULT true,
     metadata JSONB DEFAULT '{}',
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
@@ -32,41 +29,77 @@ CREATE TABLE subscriptions (
     trial_start TIMESTAMP WITH TIME ZONE,
     trial_end TIMESTAMP WITH TIME ZONE,
     canceled_at TIMESTAMP WITH TIME ZONE,
-    ended_at TIMESTAMP WITH TIME ZONE,
+    quantity INTEGER NOT NULL DEFAULT 1,
+    payment_method_id VARCHAR(255),
+    provider_name VARCHAR(50),
+    provider_subscription_id VARCHAR(255),
     metadata JSONB DEFAULT '{}',
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
--- Payments table
+-- Payments table; amounts are in minor units
 CREATE TABLE payments (
-    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-    amount DECIMAL(10,2) NOT NULL,
-    currency VARCHAR(3) NOT NULL,
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     customer_id VARCHAR(255) NOT NULL,
+    amount BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'pending',
     payment_method VARCHAR(255) NOT NULL,
     description TEXT,
-    status VARCHAR(50) NOT NULL,
-    provider VARCHAR(50) NOT NULL,
-    provider_payment_id VARCHAR(255),
+    provider_name VARCHAR(50) NOT NULL,
+    provider_charge_id VARCHAR(255),
+    provider_status VARCHAR(50),
+    provider_response JSONB,
+    capture_method VARCHAR(20) NOT NULL DEFAULT 'automatic',
+    captured_amount BIGINT NOT NULL DEFAULT 0,
+    next_action JSONB,
+    routing_rule VARCHAR(100),
     metadata JSONB,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
--- Refunds table
+-- Payment attempts table
+CREATE TABLE payment_attempts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    payment_id UUID NOT NULL REFERENCES payments(id),
+    attempt_number INTEGER NOT NULL,
+    provider_name VARCHAR(50) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    provider_charge_id VARCHAR(255),
+    error_class VARCHAR(50),
+    error_code VARCHAR(100),
+    error_message TEXT,
+    duration_ms BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Payment events table (status change audit trail)
+CREATE TABLE payment_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    payment_id UUID NOT NULL REFERENCES payments(id),
+    from_status VARCHAR(50) NOT NULL,
+    to_status VARCHAR(50) NOT NULL,
+    source VARCHAR(100) NOT NULL,
+    event_id VARCHAR(255),
+    data JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Refunds table; amounts are in minor units
 CREATE TABLE refunds (
-    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-    payment_id UUID NOT NULL,
-    amount DECIMAL(10,2) NOT NULL,
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    payment_id UUID NOT NULL REFERENCES payments(id),
+    amount BIGINT NOT NULL,
     reason TEXT,
-    status VARCHAR(50) NOT NULL,
-    provider VARCHAR(50) NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    provider_name VARCHAR(50) NOT NULL,
     provider_refund_id VARCHAR(255),
+    provider_response JSONB,
     metadata JSONB,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    CONSTRAINT fk_payment FOREIGN KEY (payment_id) REFERENCES payments(id)
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
 -- Disputes table
@@ -78,9 +111,12 @@ CREATE TABLE disputes (
     currency VARCHAR(3) NOT NULL,
     reason TEXT NOT NULL,
     status VARCHAR(50) NOT NULL DEFAULT 'open',
+    evidence JSONB,
     due_by TIMESTAMP WITH TIME ZONE NOT NULL,
     closed_at TIMESTAMP WITH TIME ZONE,
     metadata JSONB DEFAULT '{}',
+    provider_name VARCHAR(50),
+    provider_dispute_id VARCHAR(255),
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
@@ -97,31 +133,53 @@ CREATE TABLE evidence (
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
--- Dispute evidence table
-CREATE TABLE dispute_evidence (
-    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-    dispute_id UUID NOT NULL,
-    evidence_type VARCHAR(100) NOT NULL,
-    file_url TEXT,
-    description TEXT,
+-- Idempotency keys table
+CREATE TABLE idempotency_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    key VARCHAR(255) NOT NULL,
+    endpoint VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'in_progress',
+    response_code INTEGER,
+    response_content_type VARCHAR(255),
+    response_body BYTEA,
+    locked_until TIMESTAMP WITH TIME ZONE NOT NULL,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    CONSTRAINT fk_dispute FOREIGN KEY (dispute_id) REFERENCES disputes(id)
+    CONSTRAINT idx_idempotency_keys_key_endpoint UNIQUE (key, endpoint)
+);
+
+-- Webhook events table
+CREATE TABLE webhook_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    provider_name VARCHAR(50) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    type VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT idx_webhook_events_provider_event UNIQUE (provider_name, event_id)
 );
 
 -- Indexes
 CREATE INDEX idx_subscriptions_customer_id ON subscriptions(customer_id);
 CREATE INDEX idx_subscriptions_plan_id ON subscriptions(plan_id);
 CREATE INDEX idx_subscriptions_status ON subscriptions(status);
+CREATE INDEX idx_subscriptions_provider_subscription_id ON subscriptions(provider_subscription_id);
+CREATE INDEX idx_payments_provider_charge_id ON payments(provider_charge_id);
+-- Payment listing filters and keyset pagination
+CREATE INDEX idx_payments_created_at ON payments(created_at, id);
+CREATE INDEX idx_payments_amount ON payments(amount, id);
+CREATE INDEX idx_payments_customer_created_at ON payments(customer_id, created_at, id);
+CREATE INDEX idx_payments_status_created_at ON payments(status, created_at, id);
+CREATE INDEX idx_payments_provider_created_at ON payments(provider_name, created_at, id);
+CREATE INDEX idx_payment_attempts_payment ON payment_attempts(payment_id);
+CREATE INDEX idx_payment_events_payment ON payment_events(payment_id);
+CREATE INDEX idx_refunds_payment ON refunds(payment_id);
+CREATE INDEX idx_refunds_provider_refund_id ON refunds(provider_refund_id);
 CREATE INDEX idx_disputes_customer_id ON disputes(customer_id);
 CREATE INDEX idx_disputes_transaction_id ON disputes(transaction_id);
 CREATE INDEX idx_disputes_status ON disputes(status);
+CREATE INDEX idx_disputes_provider_dispute_id ON disputes(provider_dispute_id);
 CREATE INDEX idx_evidence_dispute_id ON evidence(dispute_id);
-CREATE INDEX idx_subscriptions_customer ON subscriptions(customer_id);
-CREATE INDEX idx_payments_customer ON payments(customer_id);
-CREATE INDEX idx_disputes_payment ON disputes(payment_id);
-CREATE INDEX idx_disputes_customer ON disputes(customer_id);
-CREATE INDEX idx_refunds_payment ON refunds(payment_id);
 
 -- Update timestamp triggers
 CREATE OR REPLACE FUNCTION update_updated_at_column()
@@ -162,7 +220,7 @@ CREATE TRIGGER update_evidence_updated_at
     FOR EACH ROW
     EXECUTE FUNCTION update_updated_at_column();
 
-CREATE TRIGGER update_dispute_evidence_updated_at
-    BEFORE UPDATE ON dispute_evidence
+CREATE TRIGGER update_idempotency_keys_updated_at
+    BEFORE UPDATE ON idempotency_keys
     FOR EACH ROW
     EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,21 @@
+CREATE OR REPLACE FUNCTION pg_temp.currency_exponent(code TEXT) RETURNS INTEGER AS $$
+    SELECT CASE
+        WHEN UPPER(code) IN ('BIF', 'CLP', 'DJF', 'GNF', 'ISK', 'JPY', 'KMF', 'KRW', 'PYG', 'RWF', 'UGX', 'VND', 'VUV', 'XAF', 'XOF', 'XPF') THEN 0
+        WHEN UPPER(code) IN ('BHD', 'IQD', 'JOD', 'KWD', 'LYD', 'OMR', 'TND') THEN 3
+        ELSE 2
+    END
+$$ LANGUAGE SQL IMMUTABLE;
+
+UPDATE disputes
+SET amount = amount / POWER(10, pg_temp.currency_exponent(currency))::BIGINT
+WHERE provider_name = 'xendit';
+UPDATE refunds
+SET amount = refunds.amount / POWER(10, pg_temp.currency_exponent(payments.currency))::BIGINT
+FROM payments
+WHERE refunds.payment_id = payments.id AND refunds.provider_name = 'xendit';
+UPDATE payments
+SET amount = amount / POWER(10, pg_temp.currency_exponent(currency))::BIGINT,
+    captured_amount = captured_amount / POWER(10, pg_temp.currency_exponent(currency))::BIGINT
+WHERE provider_name = 'xendit';
+
+ALTER TABLE plans ALTER COLUMN amount TYPE DOUBLE PRECISION USING amount / POWER(10, pg_temp.currency_exponent(currency));
@@ -0,0 +1,32 @@
+-- ISO 4217 exponent of a currency code, for the rescaling below
+CREATE OR REPLACE FUNCTION pg_temp.currency_exponent(code TEXT) RETURNS INTEGER AS $$
+    SELECT CASE
+        WHEN UPPER(code) IN ('BIF', 'CLP', 'DJF', 'GNF', 'ISK', 'JPY', 'KMF', 'KRW', 'PYG', 'RWF', 'UGX', 'VND', 'VUV', 'XAF', 'XOF', 'XPF') THEN 0
+        WHEN UPPER(code) IN ('BHD', 'IQD', 'JOD', 'KWD', 'LYD', 'OMR', 'TND') THEN 3
+        ELSE 2
+    END
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Plan amounts move from decimal major units to integer minor units, scaled
+-- by the ISO 4217 exponent of the plan currency
+ALTER TABLE plans ALTER COLUMN amount TYPE BIGINT USING ROUND(amount * POWER(10, pg_temp.currency_exponent(currency)));
+
+-- Xendit payments, refunds and disputes were stored in the major units Xendit
+-- reports; the other providers already stored minor units. Refunds take the
+-- currency of their payment.
+UPDATE payments
+SET amount = amount * POWER(10, pg_temp.currency_exponent(currency))::BIGINT,
+    captured_amount = captured_amount * POWER(10, pg_temp.currency_exponent(currency))::BIGINT
+WHERE provider_name = 'xendit';
+UPDATE refunds
+SET amount = refunds.amount * POWER(10, pg_temp.currency_exponent(payments.currency))::BIGINT
+FROM payments
+WHERE refunds.payment_id = payments.id AND refunds.provider_name = 'xendit';
+UPDATE disputes
+SET amount = amount * POWER(10, pg_temp.currency_exponent(currency))::BIGINT
+WHERE provider_name = 'xendit';
+
+-- Currency codes are stored in upper case; Stripe reports them in lower case
+UPDATE plans SET currency = UPPER(currency) WHERE currency <> UPPER(currency);
+UPDATE payments SET currency = UPPER(currency) WHERE currency <> UPPER(currency);
+UPDATE disputes SET currency = UPPER(currency) WHERE currency <> UPPER(currency);
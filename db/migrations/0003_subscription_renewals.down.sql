@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_subscriptions_renewal;
+
+ALTER TABLE subscriptions
+    DROP COLUMN lease_expires_at,
+    DROP COLUMN lease_owner,
+    DROP COLUMN latest_payment_id,
+    DROP COLUMN billing_cycle_anchor;
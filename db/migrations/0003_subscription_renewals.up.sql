@@ -0,0 +1,10 @@
+ALTER TABLE subscriptions
+    ADD COLUMN billing_cycle_anchor TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN latest_payment_id UUID REFERENCES payments(id),
+    ADD COLUMN lease_owner VARCHAR(255),
+    ADD COLUMN lease_expires_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE subscriptions SET billing_cycle_anchor = current_period_start WHERE billing_cycle_anchor IS NULL;
+
+-- Billing workers look up subscriptions whose period has ended
+CREATE INDEX idx_subscriptions_renewal ON subscriptions(status, current_period_end);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_subscriptions_dunning;
+DROP TABLE IF EXISTS subscription_events;
+
+ALTER TABLE subscriptions
+    DROP COLUMN next_retry_at,
+    DROP COLUMN dunning_attempts;
+
+ALTER TABLE plans
+    DROP COLUMN dunning_action;
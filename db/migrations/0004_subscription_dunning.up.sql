@@ -0,0 +1,19 @@
+ALTER TABLE plans
+    ADD COLUMN dunning_action VARCHAR(50);
+
+ALTER TABLE subscriptions
+    ADD COLUMN dunning_attempts INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN next_retry_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE subscription_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    data JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_subscription_events_subscription ON subscription_events(subscription_id);
+
+-- Billing workers look up past_due subscriptions whose next retry is due
+CREATE INDEX idx_subscriptions_dunning ON subscriptions(status, next_retry_at);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_plans_provider_plan_id;
+
+ALTER TABLE subscriptions
+    DROP COLUMN cancel_at_period_end;
+
+ALTER TABLE plans
+    DROP COLUMN provider_plan_id,
+    DROP COLUMN provider_name;
@@ -0,0 +1,9 @@
+-- Plans without a provider are billed natively by the renewal scheduler
+ALTER TABLE plans
+    ADD COLUMN provider_name VARCHAR(50),
+    ADD COLUMN provider_plan_id VARCHAR(255);
+
+ALTER TABLE subscriptions
+    ADD COLUMN cancel_at_period_end BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX idx_plans_provider_plan_id ON plans(provider_plan_id);
@@ -0,0 +1,3 @@
+-- The tier table of tiered and volume plans, ordered by up_to
+ALTER TABLE plans
+    ADD COLUMN tiers JSONB;
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_usage_records_subscription_timestamp;
+DROP TABLE IF EXISTS usage_records;
+
+ALTER TABLE plans
+    DROP COLUMN usage_aggregation,
+    DROP COLUMN usage_type;
@@ -0,0 +1,17 @@
+-- Metered plans charge for the usage recorded during each period
+ALTER TABLE plans
+    ADD COLUMN usage_type VARCHAR(50) NOT NULL DEFAULT 'licensed',
+    ADD COLUMN usage_aggregation VARCHAR(50);
+
+CREATE TABLE usage_records (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    quantity BIGINT NOT NULL,
+    timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
+    idempotency_key VARCHAR(255),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (subscription_id, idempotency_key)
+);
+
+-- Usage is aggregated per subscription over a period
+CREATE INDEX idx_usage_records_subscription_timestamp ON usage_records(subscription_id, timestamp);
@@ -0,0 +1,2 @@
+ALTER TABLE subscriptions
+    DROP COLUMN balance;
@@ -0,0 +1,3 @@
+-- Proration credits and charges carried into the next renewal
+ALTER TABLE subscriptions
+    ADD COLUMN balance BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_subscriptions_trial_end;
+
+ALTER TABLE subscriptions
+    DROP COLUMN trial_ending_notified;
@@ -0,0 +1,5 @@
+ALTER TABLE subscriptions
+    ADD COLUMN trial_ending_notified BOOLEAN NOT NULL DEFAULT false;
+
+-- Billing workers look up trials that end soon
+CREATE INDEX idx_subscriptions_trial_end ON subscriptions(status, trial_end);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_subscriptions_resume;
+
+ALTER TABLE subscriptions
+    DROP COLUMN resume_at,
+    DROP COLUMN paused_at,
+    DROP COLUMN pause_mode;
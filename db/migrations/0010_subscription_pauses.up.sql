@@ -0,0 +1,7 @@
+ALTER TABLE subscriptions
+    ADD COLUMN pause_mode VARCHAR(50),
+    ADD COLUMN paused_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN resume_at TIMESTAMP WITH TIME ZONE;
+
+-- Billing workers look up subscriptions whose pause is due to end
+CREATE INDEX idx_subscriptions_resume ON subscriptions(status, resume_at);
@@ -0,0 +1,2 @@
+DROP INDEX idx_refunds_provider_refund_id;
+CREATE INDEX idx_refunds_provider_refund_id ON refunds(provider_refund_id);
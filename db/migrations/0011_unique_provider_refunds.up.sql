@@ -0,0 +1,21 @@
+-- Webhooks used to store a refund again when two events for it arrived at
+-- once. Keep the oldest copy of each refund, with the status of the copy
+-- updated last, and drop the others.
+UPDATE refunds r SET status = latest.status
+FROM (
+    SELECT DISTINCT ON (provider_refund_id) provider_refund_id, status
+    FROM refunds
+    WHERE provider_refund_id <> ''
+    ORDER BY provider_refund_id, updated_at DESC
+) latest
+WHERE r.provider_refund_id = latest.provider_refund_id AND r.status <> latest.status;
+
+DELETE FROM refunds r
+USING refunds kept
+WHERE r.provider_refund_id = kept.provider_refund_id
+    AND r.provider_refund_id <> ''
+    AND (kept.created_at, kept.id) < (r.created_at, r.id);
+
+-- Refunds reserved before the provider answers have no provider ID yet
+DROP INDEX idx_refunds_provider_refund_id;
+CREATE UNIQUE INDEX idx_refunds_provider_refund_id ON refunds(provider_refund_id) WHERE provider_refund_id <> '';
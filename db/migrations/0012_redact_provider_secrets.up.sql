@@ -0,0 +1,4 @@
+-- Stored Stripe PaymentIntents kept their client_secret, which the payments
+-- API returned with the payment
+UPDATE payments SET provider_response = provider_response - 'client_secret'
+WHERE provider_response ? 'client_secret';
@@ -0,0 +1,3 @@
+-- Every write to a subscription bumps its version, so writes made from a
+-- copy read before another write can be refused
+ALTER TABLE subscriptions ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
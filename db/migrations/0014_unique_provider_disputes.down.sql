@@ -0,0 +1,2 @@
+DROP INDEX idx_disputes_provider_dispute_id;
+CREATE INDEX idx_disputes_provider_dispute_id ON disputes(provider_dispute_id);
@@ -0,0 +1,31 @@
+-- Webhooks used to store a dispute again when two events for it arrived at
+-- once. Keep the oldest copy of each dispute, with the state of the copy
+-- updated last, move the evidence of the others onto it and drop them.
+UPDATE disputes d
+SET status = latest.status, amount = latest.amount, due_by = latest.due_by, closed_at = COALESCE(d.closed_at, latest.closed_at)
+FROM (
+    SELECT DISTINCT ON (provider_dispute_id) provider_dispute_id, status, amount, due_by, closed_at
+    FROM disputes
+    WHERE provider_dispute_id <> ''
+    ORDER BY provider_dispute_id, updated_at DESC
+) latest
+WHERE d.provider_dispute_id = latest.provider_dispute_id;
+
+UPDATE evidence e SET dispute_id = kept.id
+FROM disputes d, (
+    SELECT DISTINCT ON (provider_dispute_id) provider_dispute_id, id
+    FROM disputes
+    WHERE provider_dispute_id <> ''
+    ORDER BY provider_dispute_id, created_at, id
+) kept
+WHERE e.dispute_id = d.id AND d.provider_dispute_id = kept.provider_dispute_id AND d.id <> kept.id;
+
+DELETE FROM disputes d
+USING disputes kept
+WHERE d.provider_dispute_id = kept.provider_dispute_id
+    AND d.provider_dispute_id <> ''
+    AND (kept.created_at, kept.id) < (d.created_at, d.id);
+
+-- Disputes opened through the API have no provider ID yet
+DROP INDEX idx_disputes_provider_dispute_id;
+CREATE UNIQUE INDEX idx_disputes_provider_dispute_id ON disputes(provider_dispute_id) WHERE provider_dispute_id <> '';
@@ -0,0 +1,2 @@
+-- Redacted secrets cannot be restored
+SELECT 1;
@@ -0,0 +1,4 @@
+-- Stripe next actions kept the PaymentIntent's client_secret, which the
+-- payments API returned with the stored payment
+UPDATE payments SET next_action = next_action - 'client_secret'
+WHERE next_action ? 'client_secret';
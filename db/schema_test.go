@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// testDatabaseEnv names a Postgres DSN for a disposable database. The test
+// migrates it all the way down and up again, so never point it at real data.
+const testDatabaseEnv = "GOPAY_TEST_DATABASE_DSN"
+
+// TestMigrationsMatchModels applies the embedded migrations and checks that
+// the resulting schema agrees with the GORM models. It also rolls every
+// migration back and applies them again, so a broken down file fails too.
+func TestMigrationsMatchModels(t *testing.T) {
+	dsn := os.Getenv(testDatabaseEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDatabaseEnv)
+	}
+
+	database, err := NewDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	migrator, err := NewMigrator(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	verifySchema(t, database)
+
+	if _, err := migrator.Down(ctx, len(migrator.migrations)); err != nil {
+		t.Fatalf("migrate down: %v", err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("migrate up after down: %v", err)
+	}
+	verifySchema(t, database)
+}
+
+func verifySchema(t *testing.T, database *DB) {
+	t.Helper()
+	problems, err := database.VerifySchema(context.Background())
+	if err != nil {
+		t.Fatalf("verify schema: %v", err)
+	}
+	for _, problem := range problems {
+		t.Error(problem)
+	}
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/malwarebo/gopay/models"
+	"gorm.io/gorm/schema"
+)
+
+// schemaModels are the models persisted through GORM; VerifySchema checks
+// each of them against the migrated database.
+var schemaModels = []interface{}{
+	&models.Plan{},
+	&models.Subscription{},
+	&models.SubscriptionEvent{},
+	&models.UsageRecord{},
+	&models.Payment{},
+	&models.PaymentAttempt{},
+	&models.PaymentEvent{},
+	&models.Refund{},
+	&models.Dispute{},
+	&models.Evidence{},
+	&models.IdempotencyKey{},
+	&models.WebhookEvent{},
+}
+
+// columnTypes lists the Postgres data types each GORM data type may be stored
+// as. Fields with an explicit gorm type tag are matched on that tag instead.
+var columnTypes = map[schema.DataType][]string{
+	schema.Bool:   {"boolean"},
+	schema.Int:    {"smallint", "integer", "bigint"},
+	schema.Uint:   {"smallint", "integer", "bigint"},
+	schema.Float:  {"real", "double precision", "numeric"},
+	schema.String: {"character varying", "text", "character", "uuid"},
+	schema.Time:   {"timestamp with time zone", "timestamp without time zone", "date"},
+	schema.Bytes:  {"bytea"},
+}
+
+var taggedColumnTypes = map[string]string{
+	"uuid":   "uuid",
+	"jsonb":  "jsonb",
+	"json":   "json",
+	"bytea":  "bytea",
+	"text[]": "ARRAY",
+}
+
+// VerifySchema compares the GORM models with the columns of the connected
+// database and returns one message per mismatch. Columns that exist only in
+// the database are ignored.
+func (db *DB) VerifySchema(ctx context.Context) ([]string, error) {
+	var problems []string
+	cache := &sync.Map{}
+	for _, model := range schemaModels {
+		s, err := schema.Parse(model, cache, db.NamingStrategy)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%T: %v", model, err))
+			continue
+		}
+
+		columns, err := db.tableColumns(ctx, s.Table)
+		if err != nil {
+			return nil, err
+		}
+		if len(columns) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: table is missing", s.Table))
+			continue
+		}
+
+		for _, field := range s.Fields {
+			if field.DBName == "" {
+				continue
+			}
+			actual, ok := columns[field.DBName]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s: column is missing", s.Table, field.DBName))
+				continue
+			}
+			if !columnTypeMatches(field, actual) {
+				problems = append(problems, fmt.Sprintf("%s.%s: %s field %s is stored as %s",
+					s.Table, field.DBName, field.FieldType, field.Name, actual))
+			}
+		}
+	}
+	return problems, nil
+}
+
+func (db *DB) tableColumns(ctx context.Context, table string) (map[string]string, error) {
+	var rows []struct {
+		ColumnName string
+		DataType   string
+	}
+	err := db.WithContext(ctx).Raw(`
+		SELECT column_name, data_type
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ?
+	`, table).Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+
+	columns := make(map[string]string, len(rows))
+	for _, row := range rows {
+		columns[row.ColumnName] = row.DataType
+	}
+	return columns, nil
+}
+
+func columnTypeMatches(field *schema.Field, actual string) bool {
+	if tag, ok := field.TagSettings["TYPE"]; ok {
+		if expected, ok := taggedColumnTypes[strings.ToLower(tag)]; ok {
+			return expected == actual
+		}
+	}
+	for _, allowed := range columnTypes[field.DataType] {
+		if allowed == actual {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/malwarebo/gopay/api"
 	"github.com/malwarebo/gopay/config"
@@ -26,46 +28,96 @@ func main() {
 	}
 	defer db.Close()
 
-	// Initialize payment providers
-	stripeProvider := providers.NewStripeProvider(cfg.Stripe.Secret)
-	xenditProvider := providers.NewXenditProvider(cfg.Xendit.Secret)
-
-	// Create a provider selector that can handle multiple providers
-	providerSelector := &providers.MultiProviderSelector{
-		Providers: []providers.PaymentProvider{stripeProvider, xenditProvider},
+	// `gopay migrate ...` manages the schema instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(context.Background(), db, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
 	}
 
+	warnPendingMigrations(context.Background(), db)
+
+	// Initialize payment providers, each behind its own circuit breaker
+	stripeClient := providers.NewStripeProvider(cfg.Stripe.Secret, cfg.Stripe.WebhookSecret)
+	stripeProvider := providers.NewMonitoredProvider(stripeClient, providers.NewCircuitBreaker(cfg.Health))
+	xenditClient := providers.NewXenditProvider(cfg.Xendit.Secret, cfg.Xendit.WebhookSecret)
+	xenditProvider := providers.NewMonitoredProvider(xenditClient, providers.NewCircuitBreaker(cfg.Health))
+
+	// Probe providers in the background so breakers recover without traffic
+	healthMonitor := providers.NewHealthMonitor(cfg.Health, stripeProvider, xenditProvider)
+	go healthMonitor.Run(context.Background())
+
 	// Initialize repositories
 	paymentRepo := repositories.NewPaymentRepository(db)
+	ownershipRepo := repositories.NewOwnershipRepository(db)
 	planRepo := repositories.NewPlanRepository(db)
 	subscriptionRepo := repositories.NewSubscriptionRepository(db)
-	disputeRepo := repositories.NewDisputeRepository(db.DB)
+	usageRepo := repositories.NewUsageRepository(db)
+	disputeRepo := repositories.NewDisputeRepository(db)
+	idempotencyRepo := repositories.NewIdempotencyRepository(db)
+	webhookEventRepo := repositories.NewWebhookEventRepository(db)
+
+	// Build the charge routing engine from the configured rules
+	router, err := providers.NewRouter(cfg.Routing)
+	if err != nil {
+		log.Fatalf("Invalid routing configuration: %v", err)
+	}
+
+	// Create a provider selector that can handle multiple providers and
+	// routes follow-up operations back to the provider that owns the record
+	providerSelector := &providers.MultiProviderSelector{
+		Providers: []providers.PaymentProvider{stripeProvider, xenditProvider},
+		Owners:    ownershipRepo,
+		Router:    router,
+	}
 
 	// Initialize services
 	paymentService := services.NewPaymentService(paymentRepo, providerSelector)
-	subscriptionService := services.NewSubscriptionService(planRepo, subscriptionRepo, providerSelector)
+	subscriptionService := services.NewSubscriptionService(planRepo, subscriptionRepo, usageRepo, paymentService, cfg.Billing, providerSelector)
 	disputeService := services.NewDisputeService(disputeRepo, providerSelector)
+	idempotencyService := services.NewIdempotencyService(idempotencyRepo)
+	billingService := services.NewBillingService(subscriptionRepo, usageRepo, paymentService, cfg.Billing)
+	webhookService := services.NewWebhookService(paymentRepo, subscriptionRepo, disputeRepo, webhookEventRepo, stripeClient, xenditClient)
+
+	// Renew due subscriptions in the background; replicas coordinate through
+	// leases on the subscription rows
+	if cfg.Billing.Enabled {
+		go billingService.Run(context.Background())
+	}
 
 	// Initialize handlers
 	paymentHandler := api.NewPaymentHandler(paymentService)
 	subscriptionHandler := api.NewSubscriptionHandler(subscriptionService)
 	disputeHandler := api.NewDisputeHandler(disputeService)
+	adminHandler := api.NewAdminHandler(healthMonitor)
+	idempotency := api.NewIdempotencyMiddleware(idempotencyService)
+	webhookHandler := api.NewWebhookHandler(webhookService)
 
 	// Setup payment routes
-	http.HandleFunc("/charge", paymentHandler.HandleCharge)
-	http.HandleFunc("/refund", paymentHandler.HandleRefund)
+	http.HandleFunc("/charge", idempotency.Wrap(paymentHandler.HandleCharge))
+	http.HandleFunc("/refund", idempotency.Wrap(paymentHandler.HandleRefund))
+	http.HandleFunc("/payments", paymentHandler.HandlePayments)
+	http.HandleFunc("/payments/", idempotency.Wrap(paymentHandler.HandlePayments))
 
 	// Setup subscription routes
 	http.HandleFunc("/plans", subscriptionHandler.HandlePlans)
 	http.HandleFunc("/plans/", subscriptionHandler.HandlePlans)
-	http.HandleFunc("/subscriptions", subscriptionHandler.HandleSubscriptions)
-	http.HandleFunc("/subscriptions/", subscriptionHandler.HandleSubscriptions)
+	http.HandleFunc("/subscriptions", idempotency.Wrap(subscriptionHandler.HandleSubscriptions))
+	http.HandleFunc("/subscriptions/", idempotency.Wrap(subscriptionHandler.HandleSubscriptions))
 
 	// Setup dispute routes
-	http.HandleFunc("/disputes", disputeHandler.HandleDisputes)
-	http.HandleFunc("/disputes/", disputeHandler.HandleDisputes)
+	http.HandleFunc("/disputes", idempotency.Wrap(disputeHandler.HandleDisputes))
+	http.HandleFunc("/disputes/", idempotency.Wrap(disputeHandler.HandleDisputes))
 	http.HandleFunc("/disputes/stats", disputeHandler.HandleDisputes)
 
+	// Setup webhook routes
+	http.HandleFunc("/webhooks/stripe", webhookHandler.HandleStripe)
+	http.HandleFunc("/webhooks/xendit", webhookHandler.HandleXendit)
+
+	// Setup admin routes
+	http.HandleFunc("/admin/providers/health", adminHandler.HandleProviderHealth)
+
 	// Start server
 	log.Printf("Server starting on port %s", cfg.Server.Port)
 	if err := http.ListenAndServe(":"+cfg.Server.Port, nil); err != nil {
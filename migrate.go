@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/malwarebo/gopay/db"
+)
+
+const migrateUsage = "usage: gopay migrate up | down [steps] | baseline [version] | status | verify"
+
+// runMigrate implements the migrate subcommand
+func runMigrate(ctx context.Context, database *db.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(migrateUsage)
+	}
+
+	migrator, err := db.NewMigrator(database)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			log.Println("Database is up to date")
+		}
+		return nil
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			log.Printf("Reverted migration %04d_%s", m.Version, m.Name)
+		}
+		return err
+
+	case "baseline":
+		version := 1
+		if len(args) > 1 {
+			if version, err = strconv.Atoi(args[1]); err != nil {
+				return fmt.Errorf("invalid version %q", args[1])
+			}
+		}
+		recorded, err := migrator.Baseline(ctx, version)
+		for _, m := range recorded {
+			log.Printf("Recorded migration %04d_%s as applied", m.Version, m.Name)
+		}
+		return err
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return nil
+
+	case "verify":
+		problems, err := database.VerifySchema(ctx)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("schema does not match models: %d problem(s)", len(problems))
+		}
+		log.Println("Schema matches models")
+		return nil
+	}
+	return fmt.Errorf(migrateUsage)
+}
+
+// warnPendingMigrations logs when the database is behind the binary. The
+// server doesn't migrate on start so that deploys control when schema
+// changes run.
+func warnPendingMigrations(ctx context.Context, database *db.DB) {
+	migrator, err := db.NewMigrator(database)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		log.Printf("Failed to read migration status: %v", err)
+		return
+	}
+	if pending > 0 {
+		log.Printf("WARNING: %d database migration(s) pending; run `gopay migrate up`", pending)
+	}
+}
@@ -25,6 +25,8 @@ type Dispute struct {
 	DueBy          time.Time     `json:"due_by" gorm:"not null"`
 	ClosedAt       *time.Time    `json:"closed_at,omitempty"`
 	Metadata       map[string]interface{} `json:"metadata" gorm:"type:jsonb"`
+	ProviderName   string        `json:"provider_name"`
+	ProviderDisputeID string     `json:"provider_dispute_id,omitempty" gorm:"uniqueIndex:idx_disputes_provider_dispute_id,where:provider_dispute_id <> ''"`
 	CreatedAt      time.Time     `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt      time.Time     `json:"updated_at" gorm:"autoUpdateTime"`
 }
@@ -40,6 +42,11 @@ type Evidence struct {
 	UpdatedAt   time.Time `json:"updated_at" gorm:"autoUpdateTime"`
 }
 
+// TableName keeps evidence uncountable rather than GORM's default "evidences"
+func (Evidence) TableName() string {
+	return "evidence"
+}
+
 type CreateDisputeRequest struct {
 	CustomerID    string                 `json:"customer_id" binding:"required"`
 	TransactionID string                 `json:"transaction_id" binding:"required"`
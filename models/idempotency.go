@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+type IdempotencyStatus string
+
+const (
+	IdempotencyStatusInProgress IdempotencyStatus = "in_progress"
+	IdempotencyStatusCompleted  IdempotencyStatus = "completed"
+)
+
+// IdempotencyKey stores the first response returned for a client supplied
+// Idempotency-Key so that retries of the same request can be replayed.
+type IdempotencyKey struct {
+	ID                  string            `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	Key                 string            `json:"key" gorm:"not null;uniqueIndex:idx_idempotency_keys_key_endpoint"`
+	Endpoint            string            `json:"endpoint" gorm:"not null;uniqueIndex:idx_idempotency_keys_key_endpoint"`
+	RequestHash         string            `json:"request_hash" gorm:"not null"`
+	Status              IdempotencyStatus `json:"status" gorm:"not null;default:'in_progress'"`
+	ResponseCode        int               `json:"response_code"`
+	ResponseContentType string            `json:"response_content_type"`
+	ResponseBody        []byte            `json:"-" gorm:"type:bytea"`
+	LockedUntil         time.Time         `json:"locked_until"`
+	CreatedAt           time.Time         `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt           time.Time         `json:"updated_at" gorm:"autoUpdateTime"`
+}
@@ -0,0 +1,258 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var (
+	// ErrUnknownCurrency is returned for currency codes missing from the currency table
+	ErrUnknownCurrency = errors.New("unknown currency")
+	// ErrCurrencyMismatch is returned when combining amounts in different currencies
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	// ErrAmountOverflow is returned when arithmetic leaves the int64 range
+	ErrAmountOverflow = errors.New("amount overflows")
+	// ErrPrecisionLoss is returned when an amount cannot be expressed at a smaller exponent
+	ErrPrecisionLoss = errors.New("amount cannot be represented without losing precision")
+)
+
+// Currency describes an ISO 4217 currency. Exponent is the number of decimal
+// digits in the minor unit: 2 for USD cents, 0 for JPY, 3 for KWD fils.
+type Currency struct {
+	Code     string
+	Exponent int
+}
+
+// currencies lists the ISO 4217 exponents of the currencies we accept.
+// Providers that use a different exponent for a currency (Xendit charges IDR
+// in whole rupiah) convert at their own boundary.
+var currencies = map[string]Currency{}
+
+func init() {
+	for exponent, codes := range map[int][]string{
+		0: {"BIF", "CLP", "DJF", "GNF", "ISK", "JPY", "KMF", "KRW", "PYG", "RWF", "UGX", "VND", "VUV", "XAF", "XOF", "XPF"},
+		2: {"AED", "AUD", "BDT", "BRL", "CAD", "CHF", "CNY", "CZK", "DKK", "EGP", "EUR", "GBP", "HKD", "HUF", "IDR", "ILS",
+			"INR", "KES", "LKR", "MXN", "MYR", "NGN", "NOK", "NZD", "PHP", "PKR", "PLN", "QAR", "RON", "SAR", "SEK", "SGD",
+			"THB", "TRY", "TWD", "USD", "ZAR"},
+		3: {"BHD", "IQD", "JOD", "KWD", "LYD", "OMR", "TND"},
+	} {
+		for _, code := range codes {
+			currencies[code] = Currency{Code: code, Exponent: exponent}
+		}
+	}
+}
+
+// LookupCurrency returns the currency for a case-insensitive ISO 4217 code
+func LookupCurrency(code string) (Currency, error) {
+	currency, ok := currencies[strings.ToUpper(strings.TrimSpace(code))]
+	if !ok {
+		return Currency{}, fmt.Errorf("%w: %q", ErrUnknownCurrency, code)
+	}
+	return currency, nil
+}
+
+// Money is an amount in the minor unit of its currency, so 10.50 USD is
+// {1050, "USD"} and 1000 JPY is {1000, "JPY"}.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// NewMoney validates the currency and normalizes its code to upper case
+func NewMoney(amount int64, currency string) (Money, error) {
+	c, err := LookupCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: c.Code}, nil
+}
+
+// Exponent returns the ISO 4217 exponent of the currency
+func (m Money) Exponent() (int, error) {
+	c, err := LookupCurrency(m.Currency)
+	if err != nil {
+		return 0, err
+	}
+	return c.Exponent, nil
+}
+
+// Rescale returns the amount expressed with the given number of decimal
+// digits, e.g. 15000000 IDR (ISO exponent 2) is 150000 at exponent 0.
+func (m Money) Rescale(exponent int) (int64, error) {
+	from, err := m.Exponent()
+	if err != nil {
+		return 0, err
+	}
+	return rescale(m.Amount, from, exponent)
+}
+
+// FromScaled builds Money from an amount expressed with the given number of
+// decimal digits, the inverse of Rescale.
+func FromScaled(amount int64, exponent int, currency string) (Money, error) {
+	c, err := LookupCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	minor, err := rescale(amount, exponent, c.Exponent)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: minor, Currency: c.Code}, nil
+}
+
+// Major returns the amount in major units at the given exponent, for APIs
+// that take decimal amounts. The result is exact for any amount a float64
+// can represent to the cent, which covers every realistic payment.
+func (m Money) Major(exponent int) (float64, error) {
+	scaled, err := m.Rescale(exponent)
+	if err != nil {
+		return 0, err
+	}
+	return float64(scaled) / math.Pow10(exponent), nil
+}
+
+// FromMajor builds Money from a decimal amount in major units at the given
+// exponent, rounding away floating point noise.
+func FromMajor(amount float64, exponent int, currency string) (Money, error) {
+	scaled := math.Round(amount * math.Pow10(exponent))
+	if math.IsNaN(scaled) || math.Abs(scaled) >= math.MaxInt64 {
+		return Money{}, fmt.Errorf("%w: %v %s", ErrAmountOverflow, amount, currency)
+	}
+	return FromScaled(int64(scaled), exponent, currency)
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if err := m.sameCurrency(other); err != nil {
+		return Money{}, err
+	}
+	sum := m.Amount + other.Amount
+	if (other.Amount > 0 && sum < m.Amount) || (other.Amount < 0 && sum > m.Amount) {
+		return Money{}, ErrAmountOverflow
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if other.Amount == math.MinInt64 {
+		return Money{}, ErrAmountOverflow
+	}
+	return m.Add(Money{Amount: -other.Amount, Currency: other.Currency})
+}
+
+// Mul multiplies the amount by a whole quantity, such as a seat count
+func (m Money) Mul(quantity int64) (Money, error) {
+	if m.Amount == 0 || quantity == 0 {
+		return Money{Currency: m.Currency}, nil
+	}
+	product := m.Amount * quantity
+	if product/quantity != m.Amount || (quantity == -1 && m.Amount == math.MinInt64) {
+		return Money{}, ErrAmountOverflow
+	}
+	return Money{Amount: product, Currency: m.Currency}, nil
+}
+
+// Cmp returns -1, 0 or 1 as m is less than, equal to or greater than other
+func (m Money) Cmp(other Money) (int, error) {
+	if err := m.sameCurrency(other); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Amount < other.Amount:
+		return -1, nil
+	case m.Amount > other.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (m Money) IsZero() bool     { return m.Amount == 0 }
+func (m Money) IsPositive() bool { return m.Amount > 0 }
+func (m Money) IsNegative() bool { return m.Amount < 0 }
+
+// String formats the amount in major units, e.g. "10.50 USD"
+func (m Money) String() string {
+	exponent, err := m.Exponent()
+	if err != nil || exponent == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+
+	sign := ""
+	amount := uint64(m.Amount)
+	if m.Amount < 0 {
+		sign = "-"
+		amount = uint64(-(m.Amount + 1)) + 1
+	}
+	unit := uint64(math.Pow10(exponent))
+	return fmt.Sprintf("%s%d.%0*d %s", sign, amount/unit, exponent, amount%unit, m.Currency)
+}
+
+func (m Money) sameCurrency(other Money) error {
+	if !strings.EqualFold(m.Currency, other.Currency) {
+		return fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	return nil
+}
+
+// UnmarshalJSON rejects unknown currencies and normalizes the code
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	money, err := NewMoney(raw.Amount, raw.Currency)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+// Value stores Money in a single jsonb column
+func (m Money) Value() (driver.Value, error) {
+	return json.Marshal(struct {
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.Amount, m.Currency})
+}
+
+// Scan implements the sql.Scanner interface
+func (m *Money) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*m = Money{}
+		return nil
+	case []byte:
+		return m.UnmarshalJSON(v)
+	case string:
+		return m.UnmarshalJSON([]byte(v))
+	}
+	return fmt.Errorf("cannot scan %T into Money", value)
+}
+
+// rescale moves amount from one exponent to another, failing rather than
+// dropping digits when the target has fewer decimal places.
+func rescale(amount int64, from, to int) (int64, error) {
+	if from == to {
+		return amount, nil
+	}
+	if to > from {
+		factor := int64(math.Pow10(to - from))
+		scaled := amount * factor
+		if scaled/factor != amount {
+			return 0, ErrAmountOverflow
+		}
+		return scaled, nil
+	}
+	factor := int64(math.Pow10(from - to))
+	if amount%factor != 0 {
+		return 0, fmt.Errorf("%w: %d at exponent %d", ErrPrecisionLoss, amount, to)
+	}
+	return amount / factor, nil
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestNewMoney(t *testing.T) {
+	tests := []struct {
+		currency string
+		want     string
+		wantErr  error
+	}{
+		{"USD", "USD", nil},
+		{"usd", "USD", nil},
+		{" jpy ", "JPY", nil},
+		{"XXX", "", ErrUnknownCurrency},
+		{"", "", ErrUnknownCurrency},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.currency, func(t *testing.T) {
+			money, err := NewMoney(100, tt.currency)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewMoney() error = %v, want %v", err, tt.wantErr)
+			}
+			if money.Currency != tt.want {
+				t.Errorf("NewMoney().Currency = %q, want %q", money.Currency, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyRescale(t *testing.T) {
+	tests := []struct {
+		name     string
+		money    Money
+		exponent int
+		want     int64
+		wantErr  error
+	}{
+		{"same exponent", Money{1050, "USD"}, 2, 1050, nil},
+		{"whole rupiah", Money{15000000, "IDR"}, 0, 150000, nil},
+		{"fractional rupiah", Money{15000050, "IDR"}, 0, 0, ErrPrecisionLoss},
+		{"more digits", Money{1000, "JPY"}, 2, 100000, nil},
+		{"overflow", Money{math.MaxInt64, "JPY"}, 2, 0, ErrAmountOverflow},
+		{"unknown currency", Money{100, "XXX"}, 2, 0, ErrUnknownCurrency},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.money.Rescale(tt.exponent)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Rescale() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Rescale() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyFromMajor(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   float64
+		exponent int
+		currency string
+		want     Money
+		wantErr  error
+	}{
+		{"cents", 10.5, 2, "USD", Money{1050, "USD"}, nil},
+		{"floating point noise", 0.1 + 0.2, 2, "usd", Money{30, "USD"}, nil},
+		{"whole rupiah", 150000, 0, "IDR", Money{15000000, "IDR"}, nil},
+		{"fils", 1.234, 3, "KWD", Money{1234, "KWD"}, nil},
+		{"more digits than the currency", 1.234, 3, "USD", Money{}, ErrPrecisionLoss},
+		{"overflow", 1e300, 2, "USD", Money{}, ErrAmountOverflow},
+		{"not a number", math.NaN(), 2, "USD", Money{}, ErrAmountOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromMajor(tt.amount, tt.exponent, tt.currency)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FromMajor() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("FromMajor() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      func() (Money, error)
+		want    Money
+		wantErr error
+	}{
+		{"add", func() (Money, error) { return Money{150, "USD"}.Add(Money{250, "USD"}) }, Money{400, "USD"}, nil},
+		{"add mixed case currency", func() (Money, error) { return Money{150, "USD"}.Add(Money{250, "usd"}) }, Money{400, "USD"}, nil},
+		{"add currency mismatch", func() (Money, error) { return Money{150, "USD"}.Add(Money{250, "EUR"}) }, Money{}, ErrCurrencyMismatch},
+		{"add overflow", func() (Money, error) { return Money{math.MaxInt64, "USD"}.Add(Money{1, "USD"}) }, Money{}, ErrAmountOverflow},
+		{"add underflow", func() (Money, error) { return Money{math.MinInt64, "USD"}.Add(Money{-1, "USD"}) }, Money{}, ErrAmountOverflow},
+		{"sub", func() (Money, error) { return Money{150, "USD"}.Sub(Money{250, "USD"}) }, Money{-100, "USD"}, nil},
+		{"sub min int", func() (Money, error) { return Money{0, "USD"}.Sub(Money{math.MinInt64, "USD"}) }, Money{}, ErrAmountOverflow},
+		{"mul", func() (Money, error) { return Money{1999, "USD"}.Mul(3) }, Money{5997, "USD"}, nil},
+		{"mul by zero", func() (Money, error) { return Money{1999, "USD"}.Mul(0) }, Money{0, "USD"}, nil},
+		{"mul overflow", func() (Money, error) { return Money{math.MaxInt64 / 2, "USD"}.Mul(3) }, Money{}, ErrAmountOverflow},
+		{"mul min int by -1", func() (Money, error) { return Money{math.MinInt64, "USD"}.Mul(-1) }, Money{}, ErrAmountOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.op()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyCmp(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    Money
+		want    int
+		wantErr error
+	}{
+		{"less", Money{100, "USD"}, Money{200, "USD"}, -1, nil},
+		{"equal", Money{200, "USD"}, Money{200, "USD"}, 0, nil},
+		{"greater", Money{300, "USD"}, Money{200, "USD"}, 1, nil},
+		{"currency mismatch", Money{100, "USD"}, Money{100, "EUR"}, 0, ErrCurrencyMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.a.Cmp(tt.b)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Cmp() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Cmp() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{Money{1050, "USD"}, "10.50 USD"},
+		{Money{5, "USD"}, "0.05 USD"},
+		{Money{-1050, "USD"}, "-10.50 USD"},
+		{Money{1000, "JPY"}, "1000 JPY"},
+		{Money{1234, "KWD"}, "1.234 KWD"},
+		{Money{math.MinInt64, "USD"}, "-92233720368547758.08 USD"},
+		{Money{100, "XXX"}, "100 XXX"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.money.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    Money
+		wantErr error
+	}{
+		{`{"amount":1050,"currency":"usd"}`, Money{1050, "USD"}, nil},
+		{`{"amount":1050,"currency":"XXX"}`, Money{}, ErrUnknownCurrency},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.data, func(t *testing.T) {
+			var got Money
+			err := json.Unmarshal([]byte(tt.data), &got)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Unmarshal() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Unmarshal() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	var scanned Money
+	value, err := Money{1050, "USD"}.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := scanned.Scan(value); err != nil || scanned != (Money{1050, "USD"}) {
+		t.Errorf("Scan(Value()) = %+v, %v", scanned, err)
+	}
+}
@@ -11,8 +11,56 @@ const (
 	PaymentStatusSuccess   PaymentStatus = "success"
 	PaymentStatusFailed    PaymentStatus = "failed"
 	PaymentStatusRefunded  PaymentStatus = "refunded"
+	// PaymentStatusPartiallyRefunded means part of the amount has been refunded
+	PaymentStatusPartiallyRefunded PaymentStatus = "partially_refunded"
+	// PaymentStatusAuthorized means funds are held and waiting to be captured
+	PaymentStatusAuthorized PaymentStatus = "authorized"
+	PaymentStatusCaptured   PaymentStatus = "captured"
+	PaymentStatusVoided     PaymentStatus = "voided"
+	// PaymentStatusRequiresAction means the customer must authenticate (e.g. 3-D Secure)
+	// or complete the payment on a provider page; see NextAction
+	PaymentStatusRequiresAction PaymentStatus = "requires_action"
 )
 
+const (
+	CaptureMethodAutomatic = "automatic"
+	// CaptureMethodManual authorizes the charge and leaves capture to a later call
+	CaptureMethodManual = "manual"
+)
+
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusSucceeded = "succeeded"
+	RefundStatusFailed    = "failed"
+	RefundStatusCanceled  = "canceled"
+)
+
+// CanTransitionTo reports whether a payment in status s may move to next.
+// Settled outcomes are final, except that a successful or captured payment
+// can be refunded, in one go or in parts.
+func (s PaymentStatus) CanTransitionTo(next PaymentStatus) bool {
+	switch s {
+	case PaymentStatusPending:
+		return next == PaymentStatusSuccess || next == PaymentStatusFailed || next == PaymentStatusAuthorized ||
+			next == PaymentStatusRequiresAction
+	case PaymentStatusRequiresAction:
+		return next == PaymentStatusSuccess || next == PaymentStatusFailed || next == PaymentStatusAuthorized
+	case PaymentStatusAuthorized:
+		return next == PaymentStatusCaptured || next == PaymentStatusVoided || next == PaymentStatusFailed
+	case PaymentStatusSuccess, PaymentStatusCaptured:
+		return next == PaymentStatusRefunded || next == PaymentStatusPartiallyRefunded
+	case PaymentStatusPartiallyRefunded:
+		return next == PaymentStatusRefunded
+	default:
+		return false
+	}
+}
+
+// IsRefundable reports whether refunds may be issued against a payment in status s
+func (s PaymentStatus) IsRefundable() bool {
+	return s == PaymentStatusSuccess || s == PaymentStatusCaptured || s == PaymentStatusPartiallyRefunded
+}
+
 type Payment struct {
 	ID              string        `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
 	CustomerID      string        `json:"customer_id" gorm:"not null;index"`
@@ -23,19 +71,120 @@ type Payment struct {
 	Description     string        `json:"description"`
 	ProviderName    string        `json:"provider_name" gorm:"not null"`
 	ProviderChargeID string       `json:"provider_charge_id" gorm:"index"`
+	ProviderStatus  string        `json:"provider_status"`
+	ProviderResponse JSON         `json:"provider_response,omitempty" gorm:"type:jsonb"`
+	CaptureMethod   string        `json:"capture_method" gorm:"not null;default:'automatic'"`
+	CapturedAmount  int64         `json:"captured_amount"`
+	NextAction      JSON          `json:"next_action,omitempty" gorm:"type:jsonb"`
+	RoutingRule     string        `json:"routing_rule"`
+	Attempts        []PaymentAttempt `json:"attempts,omitempty" gorm:"foreignKey:PaymentID"`
+	Refunds         []Refund      `json:"refunds,omitempty" gorm:"foreignKey:PaymentID"`
+	RefundSummary   *RefundSummary `json:"refund_summary,omitempty" gorm:"-"`
 	Metadata        JSON          `json:"metadata" gorm:"type:jsonb"`
 	CreatedAt       time.Time     `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt       time.Time     `json:"updated_at" gorm:"autoUpdateTime"`
 }
 
+// SettledAmount is the amount actually collected: the captured amount for
+// manual-capture payments and the charged amount otherwise.
+func (p *Payment) SettledAmount() int64 {
+	if p.CaptureMethod == CaptureMethodManual {
+		return p.CapturedAmount
+	}
+	return p.Amount
+}
+
+const (
+	PaymentSortCreatedAt = "created_at"
+	PaymentSortAmount    = "amount"
+)
+
+// PaymentFilter selects payments for listing. Zero values leave a field
+// unfiltered. Cursor is the NextCursor of the previous page.
+type PaymentFilter struct {
+	CustomerID   string
+	Status       PaymentStatus
+	ProviderName string
+	Currency     string
+	MinAmount    *int64
+	MaxAmount    *int64
+	CreatedFrom  *time.Time
+	CreatedTo    *time.Time
+	SortBy       string // created_at or amount
+	Ascending    bool
+	Limit        int
+	Cursor       string
+}
+
+// PaymentPage is one page of a payment listing
+type PaymentPage struct {
+	Payments   []*Payment `json:"payments"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// RefundSummary totals the refunds issued against a payment
+type RefundSummary struct {
+	Count            int   `json:"count"`
+	RefundedAmount   int64 `json:"refunded_amount"`
+	PendingAmount    int64 `json:"pending_amount"`
+	RefundableAmount int64 `json:"refundable_amount"`
+}
+
+// SummarizeRefunds sets RefundSummary from the refund totals, working out
+// how much is left to refund
+func (p *Payment) SummarizeRefunds(summary RefundSummary) {
+	summary.RefundableAmount = 0
+	if p.Status.IsRefundable() {
+		if left := p.SettledAmount() - summary.RefundedAmount - summary.PendingAmount; left > 0 {
+			summary.RefundableAmount = left
+		}
+	}
+	p.RefundSummary = &summary
+}
+
+// RefundList is the refunds of one payment together with their totals
+type RefundList struct {
+	PaymentID string        `json:"payment_id"`
+	Refunds   []*Refund     `json:"refunds"`
+	Summary   RefundSummary `json:"summary"`
+}
+
+// PaymentAttempt records a single provider call made while processing a charge
+type PaymentAttempt struct {
+	ID               string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	PaymentID        string    `json:"payment_id" gorm:"not null;index"`
+	AttemptNumber    int       `json:"attempt_number" gorm:"not null"`
+	ProviderName     string    `json:"provider_name" gorm:"not null"`
+	Status           string    `json:"status" gorm:"not null"` // succeeded or failed
+	ProviderChargeID string    `json:"provider_charge_id,omitempty"`
+	ErrorClass       string    `json:"error_class,omitempty"`
+	ErrorCode        string    `json:"error_code,omitempty"`
+	ErrorMessage     string    `json:"error_message,omitempty"`
+	DurationMs       int64     `json:"duration_ms"`
+	CreatedAt        time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// PaymentEvent is an audit record of a payment status change
+type PaymentEvent struct {
+	ID           string        `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	PaymentID    string        `json:"payment_id" gorm:"not null;index"`
+	FromStatus   PaymentStatus `json:"from_status" gorm:"not null"`
+	ToStatus     PaymentStatus `json:"to_status" gorm:"not null"`
+	Source       string        `json:"source" gorm:"not null"` // e.g. stripe_webhook, xendit_callback
+	EventID      string        `json:"event_id,omitempty"`
+	Data         JSON          `json:"data,omitempty" gorm:"type:jsonb"`
+	CreatedAt    time.Time     `json:"created_at" gorm:"autoCreateTime"`
+}
+
 type Refund struct {
 	ID              string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
 	PaymentID       string    `json:"payment_id" gorm:"not null;index"`
 	Amount          int64     `json:"amount" gorm:"not null"`
 	Reason          string    `json:"reason"`
-	Status          string    `json:"status" gorm:"not null;default:'pending'"`
+	Status          string    `json:"status" gorm:"not null;default:'pending'"` // pending, succeeded, failed or canceled
 	ProviderName    string    `json:"provider_name" gorm:"not null"`
-	ProviderRefundID string   `json:"provider_refund_id" gorm:"index"`
+	ProviderRefundID string   `json:"provider_refund_id" gorm:"uniqueIndex:idx_refunds_provider_refund_id,where:provider_refund_id <> ''"`
+	ProviderResponse JSON     `json:"provider_response,omitempty" gorm:"type:jsonb"`
 	Metadata        JSON      `json:"metadata" gorm:"type:jsonb"`
 	CreatedAt       time.Time `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt       time.Time `json:"updated_at" gorm:"autoUpdateTime"`
@@ -46,8 +195,22 @@ type ChargeRequest struct {
 	Amount        int64  `json:"amount"`
 	Currency      string `json:"currency"`
 	PaymentMethod string `json:"payment_method"`
+	// PaymentMethodType is the kind of instrument (card, ewallet, ...) used for routing
+	PaymentMethodType string `json:"payment_method_type,omitempty"`
 	Description   string `json:"description"`
+	// CaptureMethod is automatic (default) or manual to only authorize the charge
+	CaptureMethod string `json:"capture_method,omitempty"`
+	// ReturnURL is where the customer is sent back to after authenticating
+	ReturnURL     string `json:"return_url,omitempty"`
 	Metadata      JSON   `json:"metadata,omitempty"`
+	// OffSession marks charges made without the customer present, which
+	// cannot complete a redirect or hosted payment page
+	OffSession    bool   `json:"-"`
+}
+
+// Money returns the charge amount; providers scale it to their own units
+func (r *ChargeRequest) Money() Money {
+	return Money{Amount: r.Amount, Currency: r.Currency}
 }
 
 type ChargeResponse struct {
@@ -60,18 +223,64 @@ type ChargeResponse struct {
 	Description     string        `json:"description"`
 	ProviderName    string        `json:"provider_name"`
 	ProviderChargeID string       `json:"provider_charge_id"`
+	ProviderStatus  string        `json:"provider_status,omitempty"`
+	ProviderResponse JSON         `json:"provider_response,omitempty"`
+	CaptureMethod   string        `json:"capture_method,omitempty"`
+	CapturedAmount  int64         `json:"captured_amount,omitempty"`
+	// NextAction tells the client how to complete a requires_action payment,
+	// e.g. {"type": "redirect_to_url", "url": "..."}
+	NextAction      JSON          `json:"next_action,omitempty"`
+	RoutingRule     string        `json:"routing_rule,omitempty"`
+	Attempts        []PaymentAttempt `json:"attempts,omitempty"`
 	Metadata        JSON          `json:"metadata,omitempty"`
 	CreatedAt       time.Time     `json:"created_at"`
 }
 
+// ConfirmRequest completes a requires_action payment once the customer has
+// authenticated
+type ConfirmRequest struct {
+	PaymentID        string `json:"-"`
+	ProviderChargeID string `json:"-"`
+	CaptureMethod    string `json:"-"`
+	ReturnURL        string `json:"return_url,omitempty"`
+}
+
+// CaptureRequest captures an authorized payment. A zero Amount captures the
+// full authorized amount.
+type CaptureRequest struct {
+	PaymentID        string `json:"-"`
+	// ProviderChargeID is filled in from the stored payment before the provider is called
+	ProviderChargeID string `json:"-"`
+	Currency         string `json:"-"`
+	Amount           int64  `json:"amount,omitempty"`
+}
+
+func (r *CaptureRequest) Money() Money {
+	return Money{Amount: r.Amount, Currency: r.Currency}
+}
+
+// VoidRequest releases the funds held by an authorized payment
+type VoidRequest struct {
+	PaymentID        string `json:"-"`
+	ProviderChargeID string `json:"-"`
+	Reason           string `json:"reason,omitempty"`
+}
+
 type RefundRequest struct {
 	PaymentID string `json:"payment_id"`
+	// ProviderChargeID is filled in from the stored payment before the provider is called
+	ProviderChargeID string `json:"-"`
+	CaptureMethod    string `json:"-"`
 	Amount    int64  `json:"amount"`
 	Currency  string `json:"currency"`
 	Reason    string `json:"reason,omitempty"`
 	Metadata  JSON   `json:"metadata,omitempty"`
 }
 
+func (r *RefundRequest) Money() Money {
+	return Money{Amount: r.Amount, Currency: r.Currency}
+}
+
 type RefundResponse struct {
 	ID              string    `json:"id"`
 	PaymentID       string    `json:"payment_id"`
@@ -81,6 +290,7 @@ type RefundResponse struct {
 	Reason          string    `json:"reason"`
 	ProviderName    string    `json:"provider_name"`
 	ProviderRefundID string   `json:"provider_refund_id"`
+	ProviderResponse JSON     `json:"provider_response,omitempty"`
 	Metadata        JSON      `json:"metadata,omitempty"`
 	CreatedAt       time.Time `json:"created_at"`
 }
@@ -0,0 +1,63 @@
+package models
+
+import "testing"
+
+func TestPaymentStatusCanTransitionTo(t *testing.T) {
+	statuses := []PaymentStatus{
+		PaymentStatusPending,
+		PaymentStatusRequiresAction,
+		PaymentStatusAuthorized,
+		PaymentStatusSuccess,
+		PaymentStatusCaptured,
+		PaymentStatusPartiallyRefunded,
+		PaymentStatusRefunded,
+		PaymentStatusFailed,
+		PaymentStatusVoided,
+	}
+
+	allowed := map[PaymentStatus][]PaymentStatus{
+		PaymentStatusPending:           {PaymentStatusSuccess, PaymentStatusFailed, PaymentStatusAuthorized, PaymentStatusRequiresAction},
+		PaymentStatusRequiresAction:    {PaymentStatusSuccess, PaymentStatusFailed, PaymentStatusAuthorized},
+		PaymentStatusAuthorized:        {PaymentStatusCaptured, PaymentStatusVoided, PaymentStatusFailed},
+		PaymentStatusSuccess:           {PaymentStatusRefunded, PaymentStatusPartiallyRefunded},
+		PaymentStatusCaptured:          {PaymentStatusRefunded, PaymentStatusPartiallyRefunded},
+		PaymentStatusPartiallyRefunded: {PaymentStatusRefunded},
+	}
+
+	for _, from := range statuses {
+		want := map[PaymentStatus]bool{}
+		for _, next := range allowed[from] {
+			want[next] = true
+		}
+		for _, to := range statuses {
+			if got := from.CanTransitionTo(to); got != want[to] {
+				t.Errorf("%s.CanTransitionTo(%s) = %v, want %v", from, to, got, want[to])
+			}
+		}
+	}
+}
+
+func TestPaymentStatusIsRefundable(t *testing.T) {
+	tests := []struct {
+		status PaymentStatus
+		want   bool
+	}{
+		{PaymentStatusPending, false},
+		{PaymentStatusRequiresAction, false},
+		{PaymentStatusAuthorized, false},
+		{PaymentStatusSuccess, true},
+		{PaymentStatusCaptured, true},
+		{PaymentStatusPartiallyRefunded, true},
+		{PaymentStatusRefunded, false},
+		{PaymentStatusFailed, false},
+		{PaymentStatusVoided, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			if got := tt.status.IsRefundable(); got != tt.want {
+				t.Errorf("IsRefundable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,27 @@
 package models
 
 import (
+	"errors"
 	"time"
 )
 
+var (
+	// ErrInvalidBillingPeriod is returned for billing periods we cannot advance
+	ErrInvalidBillingPeriod = errors.New("invalid billing period")
+	// ErrInvalidDunningAction is returned for unknown final dunning actions
+	ErrInvalidDunningAction = errors.New("invalid dunning action")
+	// ErrInvalidProrationBehavior is returned for unknown proration behaviors
+	ErrInvalidProrationBehavior = errors.New("invalid proration behavior")
+)
+
 type PricingType string
 type SubscriptionStatus string
 type BillingPeriod string
+type DunningAction string
+type UsageType string
+type UsageAggregation string
+type ProrationBehavior string
+type PauseMode string
 
 const (
 	PricingTypeFixed    PricingType = "fixed"
@@ -19,28 +34,202 @@ const (
 	SubscriptionStatusPaused    SubscriptionStatus = "paused"
 	SubscriptionStatusTrialing  SubscriptionStatus = "trialing"
 	SubscriptionStatusPastDue   SubscriptionStatus = "past_due"
+	// SubscriptionStatusUnpaid is left behind by the unpaid dunning action:
+	// the subscription stays open but is no longer retried
+	SubscriptionStatusUnpaid    SubscriptionStatus = "unpaid"
 
 	BillingPeriodDaily    BillingPeriod = "daily"
 	BillingPeriodWeekly   BillingPeriod = "weekly"
 	BillingPeriodMonthly  BillingPeriod = "monthly"
 	BillingPeriodYearly   BillingPeriod = "yearly"
+
+	DunningActionCancel   DunningAction = "cancel"
+	DunningActionPause    DunningAction = "pause"
+	DunningActionUnpaid   DunningAction = "unpaid"
+
+	UsageTypeLicensed     UsageType = "licensed"
+	UsageTypeMetered      UsageType = "metered"
+
+	UsageAggregationSum   UsageAggregation = "sum"
+	UsageAggregationMax   UsageAggregation = "max"
+	UsageAggregationLast  UsageAggregation = "last"
+
+	// ProrationBehaviorImmediately charges the proration when the change is
+	// made; credits are carried into the next renewal
+	ProrationBehaviorImmediately ProrationBehavior = "immediately"
+	// ProrationBehaviorNextRenewal adds the proration to the next renewal charge
+	ProrationBehaviorNextRenewal ProrationBehavior = "next_renewal"
+	ProrationBehaviorNone        ProrationBehavior = "none"
+
+	// PauseModeCollection keeps the subscription running but stops charging
+	// it: renewals move it into the next period for free
+	PauseModeCollection PauseMode = "collection"
+	// PauseModeFull stops the subscription itself: it is not renewed, and
+	// resuming it extends the current period by the time spent paused
+	PauseModeFull       PauseMode = "full"
+)
+
+// Subscription event types
+const (
+	SubscriptionEventPaymentSucceeded = "payment_succeeded"
+	SubscriptionEventPaymentFailed    = "payment_failed"
+	// SubscriptionEventDunningExhausted is recorded when the final dunning
+	// action is applied, either after the last retry or on a hard decline
+	SubscriptionEventDunningExhausted = "dunning_exhausted"
+	// SubscriptionEventProrated is recorded when a plan or quantity change
+	// is prorated
+	SubscriptionEventProrated = "prorated"
+	// SubscriptionEventTrialEnding is recorded billing.trial_ending_days
+	// before a native trial ends
+	SubscriptionEventTrialEnding = "trial_ending"
+	// SubscriptionEventTrialEnded is recorded when a native trial ends, with
+	// the status the subscription moved to
+	SubscriptionEventTrialEnded = "trial_ended"
+	SubscriptionEventPaused     = "paused"
+	SubscriptionEventResumed    = "resumed"
 )
 
+// Valid reports whether a is a known dunning action. The empty action is
+// valid and defers to the configured default.
+func (a DunningAction) Valid() bool {
+	switch a {
+	case "", DunningActionCancel, DunningActionPause, DunningActionUnpaid:
+		return true
+	}
+	return false
+}
+
+// Valid reports whether b is a known proration behavior. The empty behavior
+// is valid and defers to the configured default.
+func (b ProrationBehavior) Valid() bool {
+	switch b {
+	case "", ProrationBehaviorImmediately, ProrationBehaviorNextRenewal, ProrationBehaviorNone:
+		return true
+	}
+	return false
+}
+
+// Valid reports whether m is a known pause mode. The empty mode is valid and
+// pauses the subscription fully.
+func (m PauseMode) Valid() bool {
+	switch m {
+	case "", PauseModeCollection, PauseModeFull:
+		return true
+	}
+	return false
+}
+
+// Advance returns the end of the billing period that starts at start. Monthly
+// and yearly periods fall on the anchor's day of the month, or the last day
+// of months too short for it, so a subscription started on the 31st renews
+// on Feb 28 and then on Mar 31 rather than drifting to the 28th.
+func (p BillingPeriod) Advance(start, anchor time.Time) (time.Time, error) {
+	switch p {
+	case BillingPeriodDaily:
+		return start.AddDate(0, 0, 1), nil
+	case BillingPeriodWeekly:
+		return start.AddDate(0, 0, 7), nil
+	case BillingPeriodMonthly:
+		return addMonths(start, 1, anchor.Day()), nil
+	case BillingPeriodYearly:
+		return addMonths(start, 12, anchor.Day()), nil
+	}
+	return time.Time{}, ErrInvalidBillingPeriod
+}
+
+func addMonths(t time.Time, months int, day int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
 type Plan struct {
 	ID            string      `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
 	Name          string      `json:"name" gorm:"not null"`
 	Description   string      `json:"description"`
-	Amount        float64     `json:"amount" gorm:"not null"`
+	// Amount is in the minor unit of Currency
+	Amount        int64       `json:"amount" gorm:"not null"`
 	Currency      string      `json:"currency" gorm:"not null"`
 	BillingPeriod BillingPeriod `json:"billing_period" gorm:"not null"`
 	PricingType   PricingType `json:"pricing_type" gorm:"not null"`
+	// Tiers price tiered and volume plans, in order of increasing UpTo.
+	// Amount is not used by those pricing types.
+	Tiers         []PlanTier  `json:"tiers,omitempty" gorm:"type:jsonb;serializer:json"`
+	// UsageType is licensed for plans charged in advance for the
+	// subscription quantity, and metered for plans charged in arrears for the
+	// usage recorded during the period
+	UsageType     UsageType   `json:"usage_type" gorm:"not null;default:'licensed'"`
+	// UsageAggregation turns the usage records of a period into the quantity
+	// a metered plan charges for
+	UsageAggregation UsageAggregation `json:"usage_aggregation,omitempty"`
 	TrialDays     int         `json:"trial_days"`
-	Features      []string    `json:"features"`
+	// DunningAction is applied once renewal retries are exhausted; empty uses
+	// the configured default
+	DunningAction DunningAction `json:"dunning_action,omitempty"`
+	Features      []string    `json:"features" gorm:"type:jsonb;serializer:json"`
+	Active        bool        `json:"active" gorm:"default:true"`
+	// ProviderName is the provider that bills subscriptions to the plan. It
+	// is empty for native plans, which gopay bills itself by charging the
+	// subscription's stored payment method.
+	ProviderName  string      `json:"provider_name,omitempty"`
+	ProviderPlanID string     `json:"provider_plan_id,omitempty"`
 	Metadata      interface{} `json:"metadata" gorm:"type:jsonb"`
 	CreatedAt     time.Time   `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt     time.Time   `json:"updated_at" gorm:"autoUpdateTime"`
 }
 
+// PlanTier is one row of the tier table of a tiered or volume plan. It
+// covers the quantities above the previous tier up to and including UpTo;
+// the last tier has no UpTo and covers every quantity above that. Amounts
+// are in the minor unit of the plan currency.
+type PlanTier struct {
+	UpTo       *int64 `json:"up_to"`
+	UnitAmount int64  `json:"unit_amount"`
+	FlatAmount int64  `json:"flat_amount"`
+}
+
+// Quote is the price of one billing period of a plan for a quantity
+type Quote struct {
+	PlanID      string          `json:"plan_id"`
+	PricingType PricingType     `json:"pricing_type"`
+	Quantity    int64           `json:"quantity"`
+	Currency    string          `json:"currency"`
+	LineItems   []QuoteLineItem `json:"line_items"`
+	// Total is the sum of the line item amounts
+	Total       int64           `json:"total"`
+}
+
+// QuoteLineItem is one charge in a quote: Quantity units at UnitAmount, or
+// a flat fee with a Quantity of 1
+type QuoteLineItem struct {
+	Description string `json:"description"`
+	Quantity    int64  `json:"quantity"`
+	UnitAmount  int64  `json:"unit_amount"`
+	Amount      int64  `json:"amount"`
+}
+
+type QuoteRequest struct {
+	Quantity int64 `json:"quantity"`
+}
+
+// IsNative reports whether the plan is billed by gopay rather than a provider
+func (p *Plan) IsNative() bool {
+	return p.ProviderName == ""
+}
+
+// IsMetered reports whether the plan charges for recorded usage rather than
+// the subscription quantity
+func (p *Plan) IsMetered() bool {
+	return p.UsageType == UsageTypeMetered
+}
+
+// Price returns the plan amount per billing period and unit
+func (p *Plan) Price() Money {
+	return Money{Amount: p.Amount, Currency: p.Currency}
+}
+
 type Subscription struct {
 	ID              string             `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
 	CustomerID      string             `json:"customer_id" gorm:"not null;index"`
@@ -49,21 +238,97 @@ type Subscription struct {
 	Status          SubscriptionStatus `json:"status" gorm:"not null;default:'active'"`
 	CurrentPeriodStart time.Time       `json:"current_period_start"`
 	CurrentPeriodEnd   time.Time       `json:"current_period_end"`
+	// BillingCycleAnchor fixes the day of the month monthly and yearly periods renew on
+	BillingCycleAnchor time.Time       `json:"billing_cycle_anchor"`
 	CanceledAt      *time.Time         `json:"canceled_at,omitempty"`
+	// CancelAtPeriodEnd cancels the subscription instead of renewing it
+	CancelAtPeriodEnd bool             `json:"cancel_at_period_end"`
 	TrialStart      *time.Time         `json:"trial_start,omitempty"`
 	TrialEnd        *time.Time         `json:"trial_end,omitempty"`
+	// TrialEndingNotified is set once the trial_ending event is recorded
+	TrialEndingNotified bool           `json:"-"`
 	Quantity        int                `json:"quantity"`
 	PaymentMethodID string             `json:"payment_method_id"`
 	ProviderName    string             `json:"provider_name"`
+	ProviderSubscriptionID string      `json:"provider_subscription_id,omitempty" gorm:"index"`
+	// LatestPaymentID is the payment of the most recent renewal charge
+	LatestPaymentID *string            `json:"latest_payment_id,omitempty"`
+	// DunningAttempts counts the failed charges for the current period and
+	// NextRetryAt is when a past_due subscription is charged again
+	DunningAttempts int                `json:"dunning_attempts"`
+	NextRetryAt     *time.Time         `json:"next_retry_at,omitempty"`
+	// Balance is added to the next renewal charge, in the minor unit of the
+	// plan currency. Proration credits make it negative.
+	Balance         int64              `json:"balance"`
+	// PauseMode is set while the subscription is paused; a full pause also
+	// sets the status to paused. ResumeAt is when the pause ends on its own.
+	PauseMode       PauseMode          `json:"pause_mode,omitempty"`
+	PausedAt        *time.Time         `json:"paused_at,omitempty"`
+	ResumeAt        *time.Time         `json:"resume_at,omitempty"`
+	// LeaseOwner and LeaseExpiresAt mark the billing worker renewing the
+	// subscription. A lease left behind by a crashed worker simply expires.
+	LeaseOwner      string             `json:"-"`
+	LeaseExpiresAt  *time.Time         `json:"-"`
+	// Version is bumped by every write, so a write made from a stale copy
+	// fails instead of overwriting the changes made since
+	Version         int64              `json:"-" gorm:"not null;default:0"`
 	Metadata        interface{}        `json:"metadata" gorm:"type:jsonb"`
 	CreatedAt       time.Time          `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt       time.Time          `json:"updated_at" gorm:"autoUpdateTime"`
 }
 
+// IsNative reports whether the subscription is billed by gopay's renewal
+// scheduler rather than by a provider
+func (s *Subscription) IsNative() bool {
+	return s.ProviderSubscriptionID == ""
+}
+
+// IsPaused reports whether the subscription is paused, fully or only for
+// payment collection
+func (s *Subscription) IsPaused() bool {
+	return s.PauseMode != "" || s.Status == SubscriptionStatusPaused
+}
+
+// ApplyProviderState copies the fields a provider owns from update, the
+// provider's view of the same subscription. Periods and trial dates the
+// provider does not report are kept.
+func (s *Subscription) ApplyProviderState(update *Subscription) {
+	s.Status = update.Status
+	if !update.CurrentPeriodStart.IsZero() {
+		s.CurrentPeriodStart = update.CurrentPeriodStart
+		s.CurrentPeriodEnd = update.CurrentPeriodEnd
+	}
+	s.CanceledAt = update.CanceledAt
+	s.CancelAtPeriodEnd = update.CancelAtPeriodEnd
+	if update.TrialStart != nil {
+		s.TrialStart = update.TrialStart
+		s.TrialEnd = update.TrialEnd
+	}
+	if update.Quantity > 0 {
+		s.Quantity = update.Quantity
+	}
+	if update.PaymentMethodID != "" {
+		s.PaymentMethodID = update.PaymentMethodID
+	}
+	s.PauseMode = update.PauseMode
+	s.ResumeAt = update.ResumeAt
+	if s.PauseMode == "" {
+		s.PausedAt = nil
+	}
+}
+
 type CreateSubscriptionRequest struct {
 	CustomerID      string                 `json:"customer_id" binding:"required"`
 	PlanID          string                 `json:"plan_id" binding:"required"`
 	Quantity        int                   `json:"quantity"`
+	// PaymentMethodID is charged for each period of native subscriptions
+	PaymentMethodID string                `json:"payment_method_id,omitempty"`
+	// ProviderPlanID is the plan's ID at its provider, set by the subscription
+	// service for provider-billed plans
+	ProviderPlanID  string                `json:"-"`
+	// Plan is the plan being subscribed to, set by the subscription service
+	// for providers that keep no plan catalogue of their own
+	Plan            *Plan                 `json:"-"`
 	TrialDays       *int                  `json:"trial_days,omitempty"`
 	Metadata        interface{}            `json:"metadata,omitempty"`
 }
@@ -73,6 +338,16 @@ type UpdateSubscriptionRequest struct {
 	PlanID          *string               `json:"plan_id,omitempty"`
 	PaymentMethodID *string               `json:"payment_method_id,omitempty"`
 	Metadata        interface{}            `json:"metadata,omitempty"`
+	// ProviderPlanID is the new plan's ID at its provider, set by the
+	// subscription service when PlanID changes
+	ProviderPlanID  string                `json:"-"`
+	// Plan is the subscription's plan after the update, set by the
+	// subscription service
+	Plan            *Plan                 `json:"-"`
+	// ProrationBehavior decides how a plan or quantity change is prorated.
+	// Empty uses billing.proration_behavior for native subscriptions and the
+	// provider's own default otherwise.
+	ProrationBehavior ProrationBehavior   `json:"proration_behavior,omitempty"`
 }
 
 type CancelSubscriptionRequest struct {
@@ -80,12 +355,49 @@ type CancelSubscriptionRequest struct {
 	Reason            string             `json:"reason,omitempty"`
 }
 
+type PauseSubscriptionRequest struct {
+	// Mode defaults to a full pause for native subscriptions and to a
+	// collection pause for provider-billed ones
+	Mode     PauseMode  `json:"mode,omitempty"`
+	// ResumeAt resumes the subscription automatically
+	ResumeAt *time.Time `json:"resume_at,omitempty"`
+}
+
+// SubscriptionEvent is an audit record of a renewal attempt or other change
+// to a subscription
 type SubscriptionEvent struct {
-	ID              string             `json:"id"`
-	SubscriptionID  string             `json:"subscription_id"`
-	Type            string             `json:"type"` // created, updated, canceled, payment_failed, etc.
-	Data            interface{}        `json:"data"`
-	CreatedAt       time.Time          `json:"created_at"`
+	ID              string             `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	SubscriptionID  string             `json:"subscription_id" gorm:"not null;index"`
+	Type            string             `json:"type" gorm:"not null"` // payment_succeeded, payment_failed, dunning_exhausted, etc.
+	Data            JSON               `json:"data,omitempty" gorm:"type:jsonb"`
+	CreatedAt       time.Time          `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// Proration is the money moved by changing a subscription's plan or quantity
+// during a paid period: a credit for the time left on the old price and a
+// charge for the same time on the new one
+type Proration struct {
+	SubscriptionID string              `json:"subscription_id"`
+	Behavior       ProrationBehavior   `json:"behavior"`
+	ProrationDate  time.Time           `json:"proration_date"`
+	PeriodEnd      time.Time           `json:"period_end"`
+	Currency       string              `json:"currency"`
+	LineItems      []ProrationLineItem `json:"line_items"`
+	// Total is the sum of the line item amounts; a negative total is a credit
+	Total          int64               `json:"total"`
+	// AmountDue is charged when the change is made
+	AmountDue      int64               `json:"amount_due"`
+	// Balance is the subscription's balance after the change
+	Balance        int64               `json:"balance"`
+}
+
+// ProrationLineItem credits (a negative Amount) or charges the rest of the
+// current period for Quantity units of a plan
+type ProrationLineItem struct {
+	Description string `json:"description"`
+	PlanID      string `json:"plan_id"`
+	Quantity    int    `json:"quantity"`
+	Amount      int64  `json:"amount"`
 }
 
 type SubscriptionResponse struct {
@@ -94,7 +406,7 @@ type SubscriptionResponse struct {
 
 type CreatePlanRequest struct {
 	Name      string  `json:"name"`
-	Amount    float64 `json:"amount"`
+	Amount    int64   `json:"amount"`
 	Currency  string  `json:"currency"`
 	Interval  string  `json:"interval"`
 	TrialDays int     `json:"trial_days,omitempty"`
@@ -103,7 +415,7 @@ type CreatePlanRequest struct {
 
 type UpdatePlanRequest struct {
 	Name      string  `json:"name,omitempty"`
-	Amount    float64 `json:"amount,omitempty"`
+	Amount    int64   `json:"amount,omitempty"`
 	Currency  string  `json:"currency,omitempty"`
 	Interval  string  `json:"interval,omitempty"`
 	TrialDays int     `json:"trial_days,omitempty"`
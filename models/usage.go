@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// UsageRecord is a quantity reported for a subscription to a metered plan
+type UsageRecord struct {
+	ID             string `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	SubscriptionID string `json:"subscription_id" gorm:"not null;index"`
+	Quantity       int64  `json:"quantity" gorm:"not null"`
+	// Timestamp is when the usage happened and decides the period it is
+	// billed in
+	Timestamp time.Time `json:"timestamp" gorm:"not null"`
+	// IdempotencyKey is the key the record was reported with, if any. A
+	// subscription has at most one record per key.
+	IdempotencyKey *string   `json:"-"`
+	CreatedAt      time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+type RecordUsageRequest struct {
+	Quantity int64 `json:"quantity"`
+	// Timestamp defaults to the time the record is received
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// UsageSummary is the usage of a subscription during one billing period
+type UsageSummary struct {
+	SubscriptionID string           `json:"subscription_id"`
+	PeriodStart    time.Time        `json:"period_start"`
+	PeriodEnd      time.Time        `json:"period_end"`
+	Aggregation    UsageAggregation `json:"aggregation"`
+	// Quantity is the aggregated usage the period is charged for
+	Quantity int64 `json:"quantity"`
+	// Quote prices Quantity with the subscription's current plan
+	Quote   *Quote         `json:"quote"`
+	Records []*UsageRecord `json:"records"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// WebhookEvent records a provider event that has been applied, so that
+// redelivered events are ignored.
+type WebhookEvent struct {
+	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ProviderName string    `json:"provider_name" gorm:"not null;uniqueIndex:idx_webhook_events_provider_event"`
+	EventID      string    `json:"event_id" gorm:"not null;uniqueIndex:idx_webhook_events_provider_event"`
+	Type         string    `json:"type" gorm:"not null"`
+	CreatedAt    time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
@@ -0,0 +1,79 @@
+package providers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/malwarebo/gopay/models"
+)
+
+// xenditExponents overrides the ISO 4217 exponent for currencies Xendit
+// only accepts in whole units.
+var xenditExponents = map[string]int{
+	"IDR": 0,
+}
+
+// stripeThreeDecimal lists the three-decimal currencies for which Stripe
+// requires the last digit of the amount to be zero.
+var stripeThreeDecimal = map[string]bool{
+	"BHD": true, "JOD": true, "KWD": true, "OMR": true, "TND": true,
+}
+
+// stripeAmount converts Money into the integer amount and lower-case
+// currency Stripe expects. Stripe uses ISO exponents, so the amount passes
+// through unchanged once it is validated.
+func stripeAmount(m models.Money) (int64, string, error) {
+	money, err := models.NewMoney(m.Amount, m.Currency)
+	if err != nil {
+		return 0, "", err
+	}
+	if stripeThreeDecimal[money.Currency] && money.Amount%10 != 0 {
+		return 0, "", fmt.Errorf("stripe: %w: %s amounts must be a multiple of 10", models.ErrPrecisionLoss, money.Currency)
+	}
+	return money.Amount, strings.ToLower(money.Currency), nil
+}
+
+// stripeMoney maps a Stripe amount and currency back onto Money. Unknown
+// currencies are kept as reported rather than dropping the amount.
+func stripeMoney(amount int64, currency string) models.Money {
+	money, err := models.NewMoney(amount, currency)
+	if err != nil {
+		return models.Money{Amount: amount, Currency: strings.ToUpper(currency)}
+	}
+	return money
+}
+
+func xenditExponent(currency string) (int, error) {
+	c, err := models.LookupCurrency(currency)
+	if err != nil {
+		return 0, err
+	}
+	if exponent, ok := xenditExponents[c.Code]; ok {
+		return exponent, nil
+	}
+	return c.Exponent, nil
+}
+
+// xenditAmount converts Money into the decimal major-unit amount Xendit
+// expects, e.g. 15000000 IDR minor units becomes 150000 rupiah. Amounts
+// with fractions Xendit cannot charge are rejected rather than rounded.
+func xenditAmount(m models.Money) (float64, string, error) {
+	exponent, err := xenditExponent(m.Currency)
+	if err != nil {
+		return 0, "", err
+	}
+	amount, err := m.Major(exponent)
+	if err != nil {
+		return 0, "", fmt.Errorf("xendit: %w", err)
+	}
+	return amount, strings.ToUpper(m.Currency), nil
+}
+
+// xenditMoney maps a Xendit major-unit amount back onto minor units
+func xenditMoney(amount float64, currency string) (models.Money, error) {
+	exponent, err := xenditExponent(currency)
+	if err != nil {
+		return models.Money{}, err
+	}
+	return models.FromMajor(amount, exponent, currency)
+}
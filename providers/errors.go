@@ -0,0 +1,229 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/xendit/xendit-go/v6/common"
+)
+
+// ErrorClass tells the selector whether a failed call may be retried elsewhere
+type ErrorClass string
+
+const (
+	// ErrorClassRetryable covers rate limits, provider outages and calls the
+	// circuit breaker refused. The charge did not go through and another
+	// provider may be tried.
+	ErrorClassRetryable ErrorClass = "retryable"
+	// ErrorClassAmbiguous covers timeouts and dropped connections, after
+	// which the charge may or may not have gone through. It must not be
+	// retried on another provider, only on the same one with the same
+	// idempotency key.
+	ErrorClassAmbiguous ErrorClass = "ambiguous"
+	// ErrorClassTerminal covers invalid requests and authentication failures.
+	// Retrying on another provider would fail the same way.
+	ErrorClassTerminal ErrorClass = "terminal"
+	// ErrorClassDeclined means the issuer or provider refused the payment.
+	// It must never be retried on another provider.
+	ErrorClassDeclined ErrorClass = "declined"
+)
+
+// ProviderError wraps an error returned by a provider with its classification
+type ProviderError struct {
+	Provider string
+	Class    ErrorClass
+	Code     string
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s: %s (%s): %v", e.Provider, e.Class, e.Code, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Provider, e.Class, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// NewProviderError classifies err and attributes it to the named provider
+func NewProviderError(provider string, err error) *ProviderError {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr
+	}
+	return &ProviderError{
+		Provider: provider,
+		Class:    ClassifyError(err),
+		Code:     errorCode(err),
+		Err:      err,
+	}
+}
+
+// ClassifyError maps provider SDK and transport errors onto an ErrorClass.
+// Anything not recognised as transient is treated as terminal so that we
+// never retry a charge we don't understand.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.Class
+	}
+
+	// A call refused by the circuit breaker never reached the provider
+	if errors.Is(err, ErrProviderUnavailable) {
+		return ErrorClassRetryable
+	}
+	// A call that ran out of time may have reached the provider
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassAmbiguous
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassTerminal
+	}
+
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) {
+		return classifyStripeError(stripeErr)
+	}
+
+	var xenditErr *common.XenditSdkError
+	if errors.As(err, &xenditErr) {
+		return classifyXenditError(xenditErr)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassAmbiguous
+	}
+
+	return ErrorClassTerminal
+}
+
+func classifyStripeError(err *stripe.Error) ErrorClass {
+	switch err.Type {
+	case stripe.ErrorTypeCard:
+		return ErrorClassDeclined
+	case stripe.ErrorTypeAPIConnection:
+		// The request may have been sent before the connection failed
+		return ErrorClassAmbiguous
+	case stripe.ErrorTypeRateLimit:
+		return ErrorClassRetryable
+	}
+	if err.Code == stripe.ErrorCodeLockTimeout || err.Code == stripe.ErrorCodeRateLimit {
+		return ErrorClassRetryable
+	}
+	if isRetryableStatus(err.HTTPStatusCode) {
+		return ErrorClassRetryable
+	}
+	return ErrorClassTerminal
+}
+
+// xenditDeclineCodes are error codes Xendit returns when the payer's
+// instrument was refused rather than the request being malformed.
+var xenditDeclineCodes = map[string]bool{
+	"CARD_DECLINED":           true,
+	"INSUFFICIENT_BALANCE":    true,
+	"EXPIRED_CARD":            true,
+	"STOLEN_CARD":             true,
+	"ISSUER_SUSPECT_FRAUD":    true,
+	"ACCOUNT_ACCESS_BLOCKED":  true,
+	"ACCOUNT_NOT_ACTIVATED":   true,
+	"MAX_AMOUNT_LIMIT_ERROR":  true,
+	"INVALID_PAYMENT_METHOD":  true,
+	"PAYMENT_METHOD_REJECTED": true,
+}
+
+func classifyXenditError(err *common.XenditSdkError) ErrorClass {
+	code := strings.ToUpper(err.ErrorCode())
+	if xenditDeclineCodes[code] {
+		return ErrorClassDeclined
+	}
+	switch code {
+	case "RATE_LIMIT_EXCEEDED", "SERVER_ERROR", "SERVICE_UNAVAILABLE", "PROCESSOR_ERROR", "CHANNEL_UNAVAILABLE":
+		return ErrorClassRetryable
+	}
+
+	// Status holds the HTTP status line, e.g. "503 Service Unavailable"
+	if fields := strings.Fields(err.Status()); len(fields) > 0 {
+		if status, convErr := strconv.Atoi(fields[0]); convErr == nil && isRetryableStatus(status) {
+			return ErrorClassRetryable
+		}
+	}
+	return ErrorClassTerminal
+}
+
+// hardDeclineCodes are decline codes, lower-cased, after which retrying the
+// same payment method will not succeed: the instrument is lost, closed,
+// expired or blocked. Other declines, such as insufficient funds, are soft
+// and worth retrying later.
+var hardDeclineCodes = map[string]bool{
+	// Stripe
+	"card_not_supported":                true,
+	"currency_not_supported":            true,
+	"expired_card":                      true,
+	"fraudulent":                        true,
+	"incorrect_number":                  true,
+	"invalid_account":                   true,
+	"invalid_number":                    true,
+	"lost_card":                         true,
+	"new_account_information_available": true,
+	"pickup_card":                       true,
+	"restricted_card":                   true,
+	"revocation_of_all_authorizations":  true,
+	"revocation_of_authorization":       true,
+	"security_violation":                true,
+	"stolen_card":                       true,
+	"stop_payment_order":                true,
+	"transaction_not_allowed":           true,
+	// Xendit
+	"account_access_blocked":  true,
+	"account_not_activated":   true,
+	"invalid_payment_method":  true,
+	"issuer_suspect_fraud":    true,
+	"payment_method_rejected": true,
+}
+
+// IsHardDecline reports whether err is a decline that retrying the same
+// payment method cannot fix
+func IsHardDecline(err error) bool {
+	if ClassifyError(err) != ErrorClassDeclined {
+		return false
+	}
+	code := errorCode(err)
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		code = providerErr.Code
+	}
+	return hardDeclineCodes[strings.ToLower(code)]
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= http.StatusInternalServerError
+}
+
+func errorCode(err error) string {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) {
+		if stripeErr.DeclineCode != "" {
+			return string(stripeErr.DeclineCode)
+		}
+		return string(stripeErr.Code)
+	}
+
+	var xenditErr *common.XenditSdkError
+	if errors.As(err, &xenditErr) {
+		return xenditErr.ErrorCode()
+	}
+	return ""
+}
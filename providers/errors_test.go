@@ -0,0 +1,81 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/xendit/xendit-go/v6/common"
+)
+
+func xenditError(status, body string) error {
+	raw := []byte(body)
+	return common.NewXenditSdkError(&raw, status, "")
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ""},
+		{"circuit open", ErrProviderUnavailable, ErrorClassRetryable},
+		{"wrapped circuit open", fmt.Errorf("stripe: %w", ErrProviderUnavailable), ErrorClassRetryable},
+		{"deadline exceeded", context.DeadlineExceeded, ErrorClassAmbiguous},
+		{"canceled", context.Canceled, ErrorClassTerminal},
+		{"transport timeout", &url.Error{Op: "Post", URL: "https://api.stripe.com", Err: os.ErrDeadlineExceeded}, ErrorClassAmbiguous},
+		{"classified provider error", &ProviderError{Provider: "stripe", Class: ErrorClassDeclined, Err: errors.New("declined")}, ErrorClassDeclined},
+		{"unknown error", errors.New("boom"), ErrorClassTerminal},
+
+		{"stripe card error", &stripe.Error{Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeCardDeclined, HTTPStatusCode: 402}, ErrorClassDeclined},
+		{"stripe connection error", &stripe.Error{Type: stripe.ErrorTypeAPIConnection}, ErrorClassAmbiguous},
+		{"stripe rate limit", &stripe.Error{Type: stripe.ErrorTypeRateLimit, HTTPStatusCode: 429}, ErrorClassRetryable},
+		{"stripe lock timeout", &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeLockTimeout, HTTPStatusCode: 400}, ErrorClassRetryable},
+		{"stripe server error", &stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: 500}, ErrorClassRetryable},
+		{"stripe invalid request", &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, HTTPStatusCode: 400}, ErrorClassTerminal},
+		{"stripe authentication", &stripe.Error{Type: stripe.ErrorTypeAuthentication, HTTPStatusCode: 401}, ErrorClassTerminal},
+
+		{"xendit decline", xenditError("400 Bad Request", `{"error_code":"CARD_DECLINED"}`), ErrorClassDeclined},
+		{"xendit lower-case decline", xenditError("400 Bad Request", `{"error_code":"insufficient_balance"}`), ErrorClassDeclined},
+		{"xendit channel unavailable", xenditError("400 Bad Request", `{"error_code":"CHANNEL_UNAVAILABLE"}`), ErrorClassRetryable},
+		{"xendit unavailable status", xenditError("503 Service Unavailable", `{}`), ErrorClassRetryable},
+		{"xendit validation error", xenditError("400 Bad Request", `{"error_code":"API_VALIDATION_ERROR"}`), ErrorClassTerminal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHardDecline(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"stripe expired card", &stripe.Error{Type: stripe.ErrorTypeCard, DeclineCode: stripe.DeclineCodeExpiredCard}, true},
+		{"stripe insufficient funds", &stripe.Error{Type: stripe.ErrorTypeCard, DeclineCode: stripe.DeclineCodeInsufficientFunds}, false},
+		{"stripe card code without decline code", &stripe.Error{Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeExpiredCard}, true},
+		{"xendit blocked account", xenditError("400 Bad Request", `{"error_code":"ACCOUNT_ACCESS_BLOCKED"}`), true},
+		{"xendit insufficient balance", xenditError("400 Bad Request", `{"error_code":"INSUFFICIENT_BALANCE"}`), false},
+		{"wrapped provider error", NewProviderError("stripe", &stripe.Error{Type: stripe.ErrorTypeCard, DeclineCode: stripe.DeclineCodeLostCard}), true},
+		{"not a decline", &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeExpiredCard}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsHardDecline(tt.err); got != tt.want {
+				t.Errorf("IsHardDecline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package providers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/malwarebo/gopay/config"
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// HealthChecker is implemented by providers that can be probed with a cheap,
+// side-effect free API call.
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+}
+
+type callOutcome struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+// ProviderHealth is a point-in-time view of a provider's circuit breaker
+type ProviderHealth struct {
+	Provider     string       `json:"provider"`
+	State        CircuitState `json:"state"`
+	Requests     int          `json:"requests"`
+	Failures     int          `json:"failures"`
+	ErrorRate    float64      `json:"error_rate"`
+	AvgLatencyMs int64        `json:"avg_latency_ms"`
+	MaxLatencyMs int64        `json:"max_latency_ms"`
+	OpenedAt     *time.Time   `json:"opened_at,omitempty"`
+	LastError    string       `json:"last_error,omitempty"`
+}
+
+// CircuitBreaker tracks the error rate and latency of real calls to a provider
+// over a rolling window. Once the circuit opens, the provider reports itself
+// unavailable until the cool-down has passed; it then half-opens and lets a
+// limited number of probe calls through before closing again.
+type CircuitBreaker struct {
+	cfg config.HealthConfig
+
+	mu    sync.Mutex
+	state CircuitState
+	// generation changes on every state transition. A call is recorded only
+	// if it finishes in the generation it was admitted in, so a slow call
+	// cannot affect a later open or half-open cycle.
+	generation     uint64
+	outcomes       []callOutcome
+	openedAt       time.Time
+	probesInFlight int
+	probeSuccesses int
+	lastError      string
+	now            func() time.Time
+}
+
+func NewCircuitBreaker(cfg config.HealthConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		cfg:   cfg,
+		state: CircuitClosed,
+		now:   time.Now,
+	}
+}
+
+// State returns the current state, moving an open circuit to half-open once
+// its cool-down has elapsed.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState()
+}
+
+func (b *CircuitBreaker) currentState() CircuitState {
+	if b.state == CircuitOpen && b.now().Sub(b.openedAt) >= time.Duration(b.cfg.OpenSeconds)*time.Second {
+		b.state = CircuitHalfOpen
+		b.generation++
+		b.probesInFlight = 0
+		b.probeSuccesses = 0
+	}
+	return b.state
+}
+
+// Available reports whether a call would be let through right now, without
+// reserving a half-open probe slot for it
+func (b *CircuitBreaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState() {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return b.probesInFlight < b.cfg.HalfOpenProbes
+	default:
+		return true
+	}
+}
+
+// Allow admits a call to the provider and returns a function that records
+// its outcome. While half-open, the check and the reservation of a probe
+// slot happen under one lock, so no more than HalfOpenProbes calls reach a
+// recovering provider at once. ok is false when the call must not be sent.
+func (b *CircuitBreaker) Allow() (done func(err error), ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := false
+	switch b.currentState() {
+	case CircuitOpen:
+		return nil, false
+	case CircuitHalfOpen:
+		if b.probesInFlight >= b.cfg.HalfOpenProbes {
+			return nil, false
+		}
+		b.probesInFlight++
+		probe = true
+	}
+
+	started, generation := b.now(), b.generation
+	return func(err error) {
+		b.record(started, generation, err, probe)
+	}, true
+}
+
+func (b *CircuitBreaker) record(started time.Time, generation uint64, err error, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The circuit has changed state since the call was admitted: a closed
+	// call finishing during half-open is not a probe, and a probe from an
+	// earlier cycle holds no slot in the current one
+	state := b.currentState()
+	if generation != b.generation {
+		return
+	}
+
+	now := b.now()
+	latency := now.Sub(started)
+	// Declines and invalid requests mean the provider answered correctly,
+	// so only transient errors, timeouts and slow calls count against its
+	// health.
+	class := ClassifyError(err)
+	failed := class == ErrorClassRetryable || class == ErrorClassAmbiguous ||
+		latency > time.Duration(b.cfg.LatencyThresholdMs)*time.Millisecond
+	if failed && err != nil {
+		b.lastError = err.Error()
+	}
+
+	switch state {
+	case CircuitHalfOpen:
+		if !probe {
+			return
+		}
+		b.probesInFlight--
+		if failed {
+			b.open(now)
+			return
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.cfg.HalfOpenProbes {
+			b.state = CircuitClosed
+			b.generation++
+			b.outcomes = nil
+		}
+	case CircuitClosed:
+		b.outcomes = append(b.outcomes, callOutcome{at: now, latency: latency, failed: failed})
+		b.prune(now)
+		requests, failures := len(b.outcomes), b.failures()
+		if requests >= b.cfg.MinRequests && float64(failures)/float64(requests) >= b.cfg.ErrorRateThreshold {
+			b.open(now)
+		}
+	}
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.state = CircuitOpen
+	b.generation++
+	b.openedAt = now
+	b.probesInFlight = 0
+	b.probeSuccesses = 0
+}
+
+func (b *CircuitBreaker) prune(now time.Time) {
+	cutoff := now.Add(-time.Duration(b.cfg.WindowSeconds) * time.Second)
+	i := 0
+	for i < len(b.outcomes) && b.outcomes[i].at.Before(cutoff) {
+		i++
+	}
+	b.outcomes = b.outcomes[i:]
+}
+
+func (b *CircuitBreaker) failures() int {
+	failures := 0
+	for _, outcome := range b.outcomes {
+		if outcome.failed {
+			failures++
+		}
+	}
+	return failures
+}
+
+// Snapshot returns the breaker state and rolling window statistics
+func (b *CircuitBreaker) Snapshot(provider string) ProviderHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.prune(now)
+	health := ProviderHealth{
+		Provider:  provider,
+		State:     b.currentState(),
+		Requests:  len(b.outcomes),
+		Failures:  b.failures(),
+		LastError: b.lastError,
+	}
+
+	var total time.Duration
+	for _, outcome := range b.outcomes {
+		total += outcome.latency
+		if ms := outcome.latency.Milliseconds(); ms > health.MaxLatencyMs {
+			health.MaxLatencyMs = ms
+		}
+	}
+	if health.Requests > 0 {
+		health.ErrorRate = float64(health.Failures) / float64(health.Requests)
+		health.AvgLatencyMs = (total / time.Duration(health.Requests)).Milliseconds()
+	}
+	if health.State != CircuitClosed {
+		openedAt := b.openedAt
+		health.OpenedAt = &openedAt
+	}
+	return health
+}
+
+// HealthMonitor owns the monitored providers and periodically probes them
+type HealthMonitor struct {
+	providers []*MonitoredProvider
+	interval  time.Duration
+}
+
+func NewHealthMonitor(cfg config.HealthConfig, providers ...*MonitoredProvider) *HealthMonitor {
+	return &HealthMonitor{
+		providers: providers,
+		interval:  time.Duration(cfg.ProbeIntervalSeconds) * time.Second,
+	}
+}
+
+// Run probes every provider on each tick until ctx is canceled. Closed
+// circuits get a background health check; half-open circuits use the probe
+// to decide whether to close again. Open circuits are left alone until their
+// cool-down has passed.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, provider := range m.providers {
+				provider.probe(ctx, m.interval)
+			}
+		}
+	}
+}
+
+func (m *HealthMonitor) Snapshot() []ProviderHealth {
+	health := make([]ProviderHealth, 0, len(m.providers))
+	for _, provider := range m.providers {
+		health = append(health, provider.Health())
+	}
+	return health
+}
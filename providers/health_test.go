@@ -0,0 +1,240 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/malwarebo/gopay/config"
+	"github.com/stripe/stripe-go/v72"
+)
+
+var testHealthConfig = config.HealthConfig{
+	WindowSeconds:      60,
+	MinRequests:        2,
+	ErrorRateThreshold: 0.5,
+	LatencyThresholdMs: 1000,
+	OpenSeconds:        30,
+	HalfOpenProbes:     2,
+}
+
+// breakerHarness drives a CircuitBreaker on a fake clock, keeping the done
+// functions of admitted calls by name
+type breakerHarness struct {
+	t       *testing.T
+	breaker *CircuitBreaker
+	clock   time.Time
+	calls   map[string]func(error)
+}
+
+func (h *breakerHarness) admit(name string) {
+	h.t.Helper()
+	done, ok := h.breaker.Allow()
+	if !ok {
+		h.t.Fatalf("call %s was refused", name)
+	}
+	h.calls[name] = done
+}
+
+func (h *breakerHarness) refused() {
+	h.t.Helper()
+	if _, ok := h.breaker.Allow(); ok {
+		h.t.Fatal("call was admitted")
+	}
+}
+
+func (h *breakerHarness) finish(name string, err error) {
+	h.calls[name](err)
+}
+
+func (h *breakerHarness) call(name string, err error) {
+	h.t.Helper()
+	h.admit(name)
+	h.finish(name, err)
+}
+
+func (h *breakerHarness) advance(d time.Duration) {
+	h.clock = h.clock.Add(d)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	unavailable := &ProviderError{Provider: "test", Class: ErrorClassRetryable, Err: errors.New("service unavailable")}
+	declined := &stripe.Error{Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeCardDeclined}
+	cooldown := time.Duration(testHealthConfig.OpenSeconds) * time.Second
+
+	tests := []struct {
+		name          string
+		steps         func(h *breakerHarness)
+		wantState     CircuitState
+		wantAvailable bool
+	}{
+		{
+			name: "stays closed on success",
+			steps: func(h *breakerHarness) {
+				h.call("a", nil)
+				h.call("b", nil)
+			},
+			wantState:     CircuitClosed,
+			wantAvailable: true,
+		},
+		{
+			name: "opens at the error rate threshold",
+			steps: func(h *breakerHarness) {
+				h.call("a", nil)
+				h.call("b", unavailable)
+			},
+			wantState: CircuitOpen,
+		},
+		{
+			name: "declines do not count as failures",
+			steps: func(h *breakerHarness) {
+				h.call("a", declined)
+				h.call("b", declined)
+			},
+			wantState:     CircuitClosed,
+			wantAvailable: true,
+		},
+		{
+			name: "timeouts count as failures",
+			steps: func(h *breakerHarness) {
+				h.call("a", context.DeadlineExceeded)
+				h.call("b", context.DeadlineExceeded)
+			},
+			wantState: CircuitOpen,
+		},
+		{
+			name: "slow calls count as failures",
+			steps: func(h *breakerHarness) {
+				h.admit("a")
+				h.advance(2 * time.Second)
+				h.finish("a", nil)
+				h.call("b", nil)
+			},
+			wantState: CircuitOpen,
+		},
+		{
+			name: "failures outside the window are forgotten",
+			steps: func(h *breakerHarness) {
+				h.call("a", unavailable)
+				h.advance(2 * time.Minute)
+				h.call("b", nil)
+				h.call("c", nil)
+				h.call("d", unavailable)
+			},
+			wantState:     CircuitClosed,
+			wantAvailable: true,
+		},
+		{
+			name: "half-opens after the cool-down",
+			steps: func(h *breakerHarness) {
+				h.call("a", unavailable)
+				h.call("b", unavailable)
+				h.refused()
+				h.advance(cooldown)
+			},
+			wantState:     CircuitHalfOpen,
+			wantAvailable: true,
+		},
+		{
+			name: "half-open admits a limited number of probes",
+			steps: func(h *breakerHarness) {
+				h.call("a", unavailable)
+				h.call("b", unavailable)
+				h.advance(cooldown)
+				h.admit("p1")
+				h.admit("p2")
+				h.refused()
+			},
+			wantState: CircuitHalfOpen,
+		},
+		{
+			name: "successful probes close the circuit",
+			steps: func(h *breakerHarness) {
+				h.call("a", unavailable)
+				h.call("b", unavailable)
+				h.advance(cooldown)
+				h.call("p1", nil)
+				h.call("p2", nil)
+			},
+			wantState:     CircuitClosed,
+			wantAvailable: true,
+		},
+		{
+			name: "a failed probe reopens the circuit",
+			steps: func(h *breakerHarness) {
+				h.call("a", unavailable)
+				h.call("b", unavailable)
+				h.advance(cooldown)
+				h.call("p1", nil)
+				h.call("p2", unavailable)
+			},
+			wantState: CircuitOpen,
+		},
+		{
+			name: "calls admitted while closed do not count as probes",
+			steps: func(h *breakerHarness) {
+				h.admit("slow1")
+				h.admit("slow2")
+				h.call("a", unavailable)
+				h.call("b", unavailable)
+				h.advance(cooldown)
+				h.finish("slow1", nil)
+				h.finish("slow2", nil)
+			},
+			wantState:     CircuitHalfOpen,
+			wantAvailable: true,
+		},
+		{
+			name: "a stale probe does not free a slot in a later cycle",
+			steps: func(h *breakerHarness) {
+				h.call("a", unavailable)
+				h.call("b", unavailable)
+				h.advance(cooldown)
+				h.admit("stale")
+				h.call("p1", unavailable)
+				h.advance(cooldown)
+				h.admit("p2")
+				h.admit("p3")
+				h.finish("stale", nil)
+				h.refused()
+			},
+			wantState: CircuitHalfOpen,
+		},
+		{
+			name: "a stale probe failure does not reopen a later cycle",
+			steps: func(h *breakerHarness) {
+				h.call("a", unavailable)
+				h.call("b", unavailable)
+				h.advance(cooldown)
+				h.admit("stale")
+				h.call("p1", unavailable)
+				h.advance(cooldown)
+				h.finish("stale", unavailable)
+			},
+			wantState:     CircuitHalfOpen,
+			wantAvailable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &breakerHarness{
+				t:       t,
+				breaker: NewCircuitBreaker(testHealthConfig),
+				clock:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				calls:   map[string]func(error){},
+			}
+			h.breaker.now = func() time.Time { return h.clock }
+
+			tt.steps(h)
+
+			if got := h.breaker.State(); got != tt.wantState {
+				t.Errorf("State() = %s, want %s", got, tt.wantState)
+			}
+			if got := h.breaker.Available(); got != tt.wantAvailable {
+				t.Errorf("Available() = %v, want %v", got, tt.wantAvailable)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+type idempotencyKeyContextKey struct{}
+
+// WithIdempotencyKey attaches an idempotency key to ctx so providers with
+// native idempotency support can forward it. Each provider call derives a key
+// of its own from it with IdempotencyKey.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+func IdempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	return key
+}
+
+// IdempotencyKey returns the key to send with operation under the key
+// attached to ctx, or "" if there is none. Provider keys apply to the whole
+// account, so every operation made under one key needs a key of its own.
+func IdempotencyKey(ctx context.Context, operation string) string {
+	key := IdempotencyKeyFromContext(ctx)
+	if key == "" {
+		return ""
+	}
+	return key + ":" + operation
+}
+
+// ScopeIdempotencyKey derives the key forwarded to providers from a client's
+// Idempotency-Key. Client keys are only unique per endpoint, so the endpoint
+// is part of the derived key.
+func ScopeIdempotencyKey(endpoint, key string) string {
+	sum := sha256.Sum256([]byte(endpoint + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
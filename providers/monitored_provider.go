@@ -0,0 +1,302 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+)
+
+// MonitoredProvider wraps a provider with a circuit breaker. Every call is
+// recorded and IsAvailable reports the breaker state.
+type MonitoredProvider struct {
+	PaymentProvider
+	breaker *CircuitBreaker
+}
+
+func NewMonitoredProvider(provider PaymentProvider, breaker *CircuitBreaker) *MonitoredProvider {
+	return &MonitoredProvider{
+		PaymentProvider: provider,
+		breaker:         breaker,
+	}
+}
+
+func (p *MonitoredProvider) IsAvailable(ctx context.Context) bool {
+	return p.breaker.Available() && p.PaymentProvider.IsAvailable(ctx)
+}
+
+// begin admits a call through the breaker, failing with
+// ErrProviderUnavailable when it is open or out of half-open probes
+func (p *MonitoredProvider) begin() (func(err error), error) {
+	done, ok := p.breaker.Allow()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProviderUnavailable, p.Name())
+	}
+	return done, nil
+}
+
+func (p *MonitoredProvider) ChargesOffSession() bool {
+	return chargesOffSession(p.PaymentProvider)
+}
+
+func (p *MonitoredProvider) Health() ProviderHealth {
+	return p.breaker.Snapshot(p.Name())
+}
+
+// probe sends a health check when the provider supports one
+func (p *MonitoredProvider) probe(ctx context.Context, timeout time.Duration) {
+	checker, ok := p.PaymentProvider.(HealthChecker)
+	if !ok {
+		return
+	}
+	done, ok := p.breaker.Allow()
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done(checker.Ping(ctx))
+}
+
+func (p *MonitoredProvider) Charge(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.Charge(ctx, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) Refund(ctx context.Context, req *models.RefundRequest) (*models.RefundResponse, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.Refund(ctx, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) Confirm(ctx context.Context, req *models.ConfirmRequest) (*models.ChargeResponse, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.Confirm(ctx, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) Authorize(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.Authorize(ctx, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) Capture(ctx context.Context, req *models.CaptureRequest) (*models.ChargeResponse, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.Capture(ctx, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) Void(ctx context.Context, req *models.VoidRequest) (*models.ChargeResponse, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.Void(ctx, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) CreateSubscription(ctx context.Context, req *models.CreateSubscriptionRequest) (*models.Subscription, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.CreateSubscription(ctx, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) UpdateSubscription(ctx context.Context, subscriptionID string, req *models.UpdateSubscriptionRequest) (*models.Subscription, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.UpdateSubscription(ctx, subscriptionID, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) CancelSubscription(ctx context.Context, subscriptionID string, req *models.CancelSubscriptionRequest) (*models.Subscription, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.CancelSubscription(ctx, subscriptionID, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) PauseSubscription(ctx context.Context, subscriptionID string, req *models.PauseSubscriptionRequest) (*models.Subscription, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.PauseSubscription(ctx, subscriptionID, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) ResumeSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.ResumeSubscription(ctx, subscriptionID)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.GetSubscription(ctx, subscriptionID)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) ListSubscriptions(ctx context.Context, customerID string) ([]*models.Subscription, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.ListSubscriptions(ctx, customerID)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) CreatePlan(ctx context.Context, plan *models.Plan) (*models.Plan, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.CreatePlan(ctx, plan)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) UpdatePlan(ctx context.Context, planID string, plan *models.Plan) (*models.Plan, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.UpdatePlan(ctx, planID, plan)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) DeletePlan(ctx context.Context, planID string) error {
+	done, err := p.begin()
+	if err != nil {
+		return err
+	}
+	err = p.PaymentProvider.DeletePlan(ctx, planID)
+	done(err)
+	return err
+}
+
+func (p *MonitoredProvider) GetPlan(ctx context.Context, planID string) (*models.Plan, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.GetPlan(ctx, planID)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) ListPlans(ctx context.Context) ([]*models.Plan, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.ListPlans(ctx)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) CreateDispute(ctx context.Context, req *models.CreateDisputeRequest) (*models.Dispute, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.CreateDispute(ctx, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) UpdateDispute(ctx context.Context, disputeID string, req *models.UpdateDisputeRequest) (*models.Dispute, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.UpdateDispute(ctx, disputeID, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) SubmitDisputeEvidence(ctx context.Context, disputeID string, req *models.SubmitEvidenceRequest) (*models.Evidence, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.SubmitDisputeEvidence(ctx, disputeID, req)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) GetDispute(ctx context.Context, disputeID string) (*models.Dispute, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.GetDispute(ctx, disputeID)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) ListDisputes(ctx context.Context, customerID string) ([]*models.Dispute, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.ListDisputes(ctx, customerID)
+	done(err)
+	return result, err
+}
+
+func (p *MonitoredProvider) GetDisputeStats(ctx context.Context) (*models.DisputeStats, error) {
+	done, err := p.begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.PaymentProvider.GetDisputeStats(ctx)
+	done(err)
+	return result, err
+}
@@ -2,13 +2,30 @@ package providers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/malwarebo/gopay/config"
 	"github.com/malwarebo/gopay/models"
 )
 
+var (
+	// ErrProviderUnavailable is returned when the provider that owns a record
+	// is down, or when its circuit breaker refuses a call
+	ErrProviderUnavailable = errors.New("payment provider is unavailable")
+	// ErrUnknownProvider is returned when a record references a provider that is not registered
+	ErrUnknownProvider = errors.New("unknown payment provider")
+	// ErrOperationNotSupported is returned when a provider has no equivalent for an operation
+	ErrOperationNotSupported = errors.New("operation not supported by provider")
+)
+
 type MultiProviderSelector struct {
 	Providers []PaymentProvider
+	// Owners resolves the provider for follow-up operations on stored records
+	Owners OwnerResolver
+	// Router picks the provider for new charges; when nil the first available provider is used
+	Router *Router
 }
 
 func (m *MultiProviderSelector) selectAvailableProvider(ctx context.Context) (PaymentProvider, error) {
@@ -20,34 +37,203 @@ func (m *MultiProviderSelector) selectAvailableProvider(ctx context.Context) (Pa
 	return nil, fmt.Errorf("no available payment provider")
 }
 
+func (m *MultiProviderSelector) providerByName(name string) (PaymentProvider, error) {
+	for _, provider := range m.Providers {
+		if provider.Name() == name {
+			return provider, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, name)
+}
+
+// selectOwningProvider returns the provider that created the record identified by id.
+// It never falls back to another provider: if the owner is down the call fails.
+func (m *MultiProviderSelector) selectOwningProvider(ctx context.Context, lookup func(OwnerResolver, context.Context, string) (string, error), id string) (PaymentProvider, error) {
+	if m.Owners == nil {
+		return nil, errors.New("no owner resolver configured")
+	}
+
+	name, err := lookup(m.Owners, ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve provider for %s: %w", id, err)
+	}
+
+	provider, err := m.providerByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if !provider.IsAvailable(ctx) {
+		return nil, fmt.Errorf("%w: %s", ErrProviderUnavailable, name)
+	}
+	return provider, nil
+}
+
+// ChargeError is returned by Charge when no attempt succeeded. It carries every
+// attempt made so the caller can persist them.
+type ChargeError struct {
+	RoutingRule string
+	Attempts    []models.PaymentAttempt
+	Err         error
+}
+
+func (e *ChargeError) Error() string {
+	return fmt.Sprintf("charge failed after %d attempt(s): %v", len(e.Attempts), e.Err)
+}
+
+func (e *ChargeError) Unwrap() error {
+	return e.Err
+}
+
+// chargeCandidates evaluates the routing rules for a charge and returns the
+// available providers of the matched rule in the order they should be tried.
+// Without a matching rule every available provider is eligible. Off-session
+// charges skip providers that cannot make them.
+func (m *MultiProviderSelector) chargeCandidates(ctx context.Context, req *models.ChargeRequest) ([]PaymentProvider, string, error) {
+	var route *Route
+	if m.Router != nil {
+		route = m.Router.Route(req)
+	}
+
+	rule := DefaultRouteName
+	var names []string
+	if route != nil {
+		rule = route.Rule
+		names = route.Providers
+	} else {
+		for _, provider := range m.Providers {
+			names = append(names, provider.Name())
+		}
+	}
+
+	var candidates []PaymentProvider
+	offSession := false
+	for _, name := range names {
+		provider, err := m.providerByName(name)
+		if err != nil {
+			return nil, rule, fmt.Errorf("routing rule %q: %w", rule, err)
+		}
+		if req.OffSession && !chargesOffSession(provider) {
+			continue
+		}
+		offSession = true
+		if provider.IsAvailable(ctx) {
+			candidates = append(candidates, provider)
+		}
+	}
+	if req.OffSession && !offSession {
+		return nil, rule, fmt.Errorf("%w: no provider of routing rule %q charges off-session", ErrOperationNotSupported, rule)
+	}
+	if len(candidates) == 0 {
+		return nil, rule, fmt.Errorf("no available payment provider for routing rule %q", rule)
+	}
+	return candidates, rule, nil
+}
+
 // Implement PaymentProvider interface methods with provider selection logic
 
+// Charge tries each eligible provider in turn. Only retryable failures move on
+// to the next provider; declines, terminal errors and timeouts whose outcome
+// is unknown stop immediately so a customer is never charged twice.
 func (m *MultiProviderSelector) Charge(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	return m.chargeWithFailover(ctx, req, PaymentProvider.Charge)
+}
+
+// Authorize follows the same routing and failover rules as Charge
+func (m *MultiProviderSelector) Authorize(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error) {
+	return m.chargeWithFailover(ctx, req, PaymentProvider.Authorize)
+}
+
+func (m *MultiProviderSelector) chargeWithFailover(ctx context.Context, req *models.ChargeRequest, call func(PaymentProvider, context.Context, *models.ChargeRequest) (*models.ChargeResponse, error)) (*models.ChargeResponse, error) {
+	candidates, rule, err := m.chargeCandidates(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	return provider.Charge(ctx, req)
+
+	var attempts []models.PaymentAttempt
+	var lastErr error
+	for _, provider := range candidates {
+		started := time.Now()
+		resp, err := call(provider, ctx, req)
+		attempt := models.PaymentAttempt{
+			AttemptNumber: len(attempts) + 1,
+			ProviderName:  provider.Name(),
+			DurationMs:    time.Since(started).Milliseconds(),
+		}
+
+		if err == nil {
+			attempt.Status = "succeeded"
+			attempt.ProviderChargeID = resp.ProviderChargeID
+			resp.RoutingRule = rule
+			resp.Attempts = append(attempts, attempt)
+			return resp, nil
+		}
+
+		providerErr := NewProviderError(provider.Name(), err)
+		attempt.Status = "failed"
+		attempt.ErrorClass = string(providerErr.Class)
+		attempt.ErrorCode = providerErr.Code
+		attempt.ErrorMessage = err.Error()
+		attempts = append(attempts, attempt)
+		lastErr = providerErr
+
+		if providerErr.Class != ErrorClassRetryable {
+			break
+		}
+	}
+
+	return nil, &ChargeError{RoutingRule: rule, Attempts: attempts, Err: lastErr}
 }
 
 func (m *MultiProviderSelector) Refund(ctx context.Context, req *models.RefundRequest) (*models.RefundResponse, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.PaymentOwner, req.PaymentID)
 	if err != nil {
 		return nil, err
 	}
 	return provider.Refund(ctx, req)
 }
 
+func (m *MultiProviderSelector) Confirm(ctx context.Context, req *models.ConfirmRequest) (*models.ChargeResponse, error) {
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.PaymentOwner, req.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Confirm(ctx, req)
+}
+
+func (m *MultiProviderSelector) Capture(ctx context.Context, req *models.CaptureRequest) (*models.ChargeResponse, error) {
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.PaymentOwner, req.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Capture(ctx, req)
+}
+
+func (m *MultiProviderSelector) Void(ctx context.Context, req *models.VoidRequest) (*models.ChargeResponse, error) {
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.PaymentOwner, req.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Void(ctx, req)
+}
+
+// CreateSubscription creates the subscription with the provider that bills its plan
 func (m *MultiProviderSelector) CreateSubscription(ctx context.Context, req *models.CreateSubscriptionRequest) (*models.Subscription, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.PlanOwner, req.PlanID)
 	if err != nil {
 		return nil, err
 	}
-	return provider.CreateSubscription(ctx, req)
+	subscription, err := provider.CreateSubscription(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if subscription.ProviderName == "" {
+		subscription.ProviderName = provider.Name()
+	}
+	return subscription, nil
 }
 
 func (m *MultiProviderSelector) UpdateSubscription(ctx context.Context, subscriptionID string, req *models.UpdateSubscriptionRequest) (*models.Subscription, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.SubscriptionOwner, subscriptionID)
 	if err != nil {
 		return nil, err
 	}
@@ -55,15 +241,31 @@ func (m *MultiProviderSelector) UpdateSubscription(ctx context.Context, subscrip
 }
 
 func (m *MultiProviderSelector) CancelSubscription(ctx context.Context, subscriptionID string, req *models.CancelSubscriptionRequest) (*models.Subscription, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.SubscriptionOwner, subscriptionID)
 	if err != nil {
 		return nil, err
 	}
 	return provider.CancelSubscription(ctx, subscriptionID, req)
 }
 
+func (m *MultiProviderSelector) PauseSubscription(ctx context.Context, subscriptionID string, req *models.PauseSubscriptionRequest) (*models.Subscription, error) {
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.SubscriptionOwner, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return provider.PauseSubscription(ctx, subscriptionID, req)
+}
+
+func (m *MultiProviderSelector) ResumeSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.SubscriptionOwner, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return provider.ResumeSubscription(ctx, subscriptionID)
+}
+
 func (m *MultiProviderSelector) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.SubscriptionOwner, subscriptionID)
 	if err != nil {
 		return nil, err
 	}
@@ -78,16 +280,34 @@ func (m *MultiProviderSelector) ListSubscriptions(ctx context.Context, customerI
 	return provider.ListSubscriptions(ctx, customerID)
 }
 
+// CreatePlan creates the plan with the provider named in plan.ProviderName,
+// or the first available provider when it is empty
 func (m *MultiProviderSelector) CreatePlan(ctx context.Context, plan *models.Plan) (*models.Plan, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	var provider PaymentProvider
+	var err error
+	if plan.ProviderName != "" {
+		provider, err = m.providerByName(plan.ProviderName)
+		if err == nil && !provider.IsAvailable(ctx) {
+			err = fmt.Errorf("%w: %s", ErrProviderUnavailable, plan.ProviderName)
+		}
+	} else {
+		provider, err = m.selectAvailableProvider(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return provider.CreatePlan(ctx, plan)
+	created, err := provider.CreatePlan(ctx, plan)
+	if err != nil {
+		return nil, err
+	}
+	if created.ProviderName == "" {
+		created.ProviderName = provider.Name()
+	}
+	return created, nil
 }
 
 func (m *MultiProviderSelector) UpdatePlan(ctx context.Context, planID string, plan *models.Plan) (*models.Plan, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.PlanOwner, planID)
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +315,7 @@ func (m *MultiProviderSelector) UpdatePlan(ctx context.Context, planID string, p
 }
 
 func (m *MultiProviderSelector) DeletePlan(ctx context.Context, planID string) error {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.PlanOwner, planID)
 	if err != nil {
 		return err
 	}
@@ -103,7 +323,7 @@ func (m *MultiProviderSelector) DeletePlan(ctx context.Context, planID string) e
 }
 
 func (m *MultiProviderSelector) GetPlan(ctx context.Context, planID string) (*models.Plan, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.PlanOwner, planID)
 	if err != nil {
 		return nil, err
 	}
@@ -119,15 +339,22 @@ func (m *MultiProviderSelector) ListPlans(ctx context.Context) ([]*models.Plan,
 }
 
 func (m *MultiProviderSelector) CreateDispute(ctx context.Context, req *models.CreateDisputeRequest) (*models.Dispute, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.PaymentOwner, req.TransactionID)
 	if err != nil {
 		return nil, err
 	}
-	return provider.CreateDispute(ctx, req)
+	dispute, err := provider.CreateDispute(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if dispute.ProviderName == "" {
+		dispute.ProviderName = provider.Name()
+	}
+	return dispute, nil
 }
 
 func (m *MultiProviderSelector) UpdateDispute(ctx context.Context, disputeID string, req *models.UpdateDisputeRequest) (*models.Dispute, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.DisputeOwner, disputeID)
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +362,7 @@ func (m *MultiProviderSelector) UpdateDispute(ctx context.Context, disputeID str
 }
 
 func (m *MultiProviderSelector) SubmitDisputeEvidence(ctx context.Context, disputeID string, req *models.SubmitEvidenceRequest) (*models.Evidence, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.DisputeOwner, disputeID)
 	if err != nil {
 		return nil, err
 	}
@@ -143,7 +370,7 @@ func (m *MultiProviderSelector) SubmitDisputeEvidence(ctx context.Context, dispu
 }
 
 func (m *MultiProviderSelector) GetDispute(ctx context.Context, disputeID string) (*models.Dispute, error) {
-	provider, err := m.selectAvailableProvider(ctx)
+	provider, err := m.selectOwningProvider(ctx, OwnerResolver.DisputeOwner, disputeID)
 	if err != nil {
 		return nil, err
 	}
@@ -166,6 +393,47 @@ func (m *MultiProviderSelector) GetDisputeStats(ctx context.Context) (*models.Di
 	return provider.GetDisputeStats(ctx)
 }
 
+// CheckOffSession fails with ErrOperationNotSupported if a charge in
+// currency could be routed to a rule, or by default, to providers none of
+// which charges off-session
+func (m *MultiProviderSelector) CheckOffSession(currency string) error {
+	var rules []config.RoutingRule
+	fallback := true
+	if m.Router != nil {
+		rules, fallback = m.Router.CurrencyRules(currency)
+	}
+
+	check := func(rule string, names []string) error {
+		for _, name := range names {
+			provider, err := m.providerByName(name)
+			if err != nil {
+				return fmt.Errorf("routing rule %q: %w", rule, err)
+			}
+			if chargesOffSession(provider) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s charges can be routed by rule %q to providers that cannot charge off-session", ErrOperationNotSupported, currency, rule)
+	}
+	for _, rule := range rules {
+		names := make([]string, len(rule.Providers))
+		for i, target := range rule.Providers {
+			names[i] = target.Provider
+		}
+		if err := check(rule.Name, names); err != nil {
+			return err
+		}
+	}
+	if !fallback {
+		return nil
+	}
+	var names []string
+	for _, provider := range m.Providers {
+		names = append(names, provider.Name())
+	}
+	return check(DefaultRouteName, names)
+}
+
 func (m *MultiProviderSelector) IsAvailable(ctx context.Context) bool {
 	for _, provider := range m.Providers {
 		if provider.IsAvailable(ctx) {
@@ -174,3 +442,7 @@ func (m *MultiProviderSelector) IsAvailable(ctx context.Context) bool {
 	}
 	return false
 }
+
+func (m *MultiProviderSelector) Name() string {
+	return "multi"
+}
@@ -11,11 +11,20 @@ type PaymentProvider interface {
 	// Payment methods
 	Charge(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error)
 	Refund(ctx context.Context, req *models.RefundRequest) (*models.RefundResponse, error)
+	// Confirm completes a charge that required customer action such as 3-D Secure
+	Confirm(ctx context.Context, req *models.ConfirmRequest) (*models.ChargeResponse, error)
+
+	// Authorization methods, for charges captured after the fact
+	Authorize(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error)
+	Capture(ctx context.Context, req *models.CaptureRequest) (*models.ChargeResponse, error)
+	Void(ctx context.Context, req *models.VoidRequest) (*models.ChargeResponse, error)
 
 	// Subscription methods
 	CreateSubscription(ctx context.Context, req *models.CreateSubscriptionRequest) (*models.Subscription, error)
 	UpdateSubscription(ctx context.Context, subscriptionID string, req *models.UpdateSubscriptionRequest) (*models.Subscription, error)
 	CancelSubscription(ctx context.Context, subscriptionID string, req *models.CancelSubscriptionRequest) (*models.Subscription, error)
+	PauseSubscription(ctx context.Context, subscriptionID string, req *models.PauseSubscriptionRequest) (*models.Subscription, error)
+	ResumeSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error)
 	GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error)
 	ListSubscriptions(ctx context.Context, customerID string) ([]*models.Subscription, error)
 
@@ -36,42 +45,35 @@ type PaymentProvider interface {
 
 	// Provider status
 	IsAvailable(ctx context.Context) bool
+
+	// Name returns the identifier stored in ProviderName on payments, subscriptions and disputes
+	Name() string
 }
 
-type ChargeRequest struct {
-	Amount        float64
-	Currency      string
-	PaymentMethod string
-	Description   string
-	CustomerID    string
-	Metadata      map[string]string
+// OffSessionCharger is implemented by providers that can charge a stored
+// payment method without the customer present. Charges marked OffSession,
+// such as native subscription renewals, are only routed to them.
+type OffSessionCharger interface {
+	ChargesOffSession() bool
 }
 
-type ChargeResponse struct {
-	TransactionID string
-	Status        string
-	Amount        float64
-	Currency      string
-	PaymentMethod string
-	ProviderName  string
-	CreatedAt     int64
-	Metadata      map[string]string
+// OffSessionChecker is implemented by providers that route charges and can
+// tell whether charges in a currency can be made off-session
+type OffSessionChecker interface {
+	CheckOffSession(currency string) error
 }
 
-type RefundRequest struct {
-	TransactionID string
-	Amount        float64
-	Reason        string
-	Metadata      map[string]string
+// chargesOffSession reports whether provider implements OffSessionCharger
+// and can charge off-session
+func chargesOffSession(provider PaymentProvider) bool {
+	charger, ok := provider.(OffSessionCharger)
+	return ok && charger.ChargesOffSession()
 }
 
-type RefundResponse struct {
-	RefundID      string
-	TransactionID string
-	Status        string
-	Amount        float64
-	Currency      string
-	ProviderName  string
-	CreatedAt     int64
-	Metadata      map[string]string
+// OwnerResolver looks up which provider owns a previously stored record
+type OwnerResolver interface {
+	PaymentOwner(ctx context.Context, paymentID string) (string, error)
+	SubscriptionOwner(ctx context.Context, subscriptionID string) (string, error)
+	PlanOwner(ctx context.Context, planID string) (string, error)
+	DisputeOwner(ctx context.Context, disputeID string) (string, error)
 }
@@ -0,0 +1,161 @@
+package providers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/malwarebo/gopay/config"
+	"github.com/malwarebo/gopay/models"
+)
+
+// DefaultRouteName is recorded on charges that did not match any routing rule
+const DefaultRouteName = "default"
+
+// Router picks the providers eligible for a charge from the configured rules
+type Router struct {
+	rules []config.RoutingRule
+}
+
+// Route is the outcome of evaluating the rules against a charge. Providers are
+// listed in the order they should be tried.
+type Route struct {
+	Rule      string
+	Providers []string
+}
+
+func NewRouter(cfg config.RoutingConfig) (*Router, error) {
+	seen := make(map[string]bool)
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("routing rule %d: name is required", i)
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("routing rule %q: duplicate name", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		if len(rule.Providers) == 0 {
+			return nil, fmt.Errorf("routing rule %q: at least one provider is required", rule.Name)
+		}
+		for _, target := range rule.Providers {
+			if target.Provider == "" {
+				return nil, fmt.Errorf("routing rule %q: provider name is required", rule.Name)
+			}
+			if target.Weight < 0 {
+				return nil, fmt.Errorf("routing rule %q: negative weight for %s", rule.Name, target.Provider)
+			}
+		}
+		if rule.MinAmount != nil && rule.MaxAmount != nil && *rule.MinAmount > *rule.MaxAmount {
+			return nil, fmt.Errorf("routing rule %q: min_amount is greater than max_amount", rule.Name)
+		}
+	}
+
+	return &Router{rules: cfg.Rules}, nil
+}
+
+// Route returns nil when no rule matches the charge
+func (r *Router) Route(req *models.ChargeRequest) *Route {
+	for _, rule := range r.rules {
+		if matchesRule(rule, req) {
+			return &Route{
+				Rule:      rule.Name,
+				Providers: orderTargets(rule.Providers, routingKey(req)),
+			}
+		}
+	}
+	return nil
+}
+
+// CurrencyRules returns the rules a charge in currency could match, in
+// order, up to the first one that matches on the currency alone. fallback
+// reports whether such a charge can also match no rule.
+func (r *Router) CurrencyRules(currency string) (rules []config.RoutingRule, fallback bool) {
+	for _, rule := range r.rules {
+		if len(rule.Currencies) > 0 && !containsFold(rule.Currencies, currency) {
+			continue
+		}
+		rules = append(rules, rule)
+		if rule.MinAmount == nil && rule.MaxAmount == nil && len(rule.PaymentMethodTypes) == 0 && len(rule.Metadata) == 0 {
+			return rules, false
+		}
+	}
+	return rules, true
+}
+
+func matchesRule(rule config.RoutingRule, req *models.ChargeRequest) bool {
+	if len(rule.Currencies) > 0 && !containsFold(rule.Currencies, req.Currency) {
+		return false
+	}
+	if rule.MinAmount != nil && req.Amount < *rule.MinAmount {
+		return false
+	}
+	if rule.MaxAmount != nil && req.Amount > *rule.MaxAmount {
+		return false
+	}
+	if len(rule.PaymentMethodTypes) > 0 && !containsFold(rule.PaymentMethodTypes, req.PaymentMethodType) {
+		return false
+	}
+	for key, want := range rule.Metadata {
+		got, ok := req.Metadata[key]
+		if !ok || fmt.Sprint(got) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// orderTargets puts the weighted pick first and the remaining targets after it
+// by descending weight, so the same key always produces the same order.
+func orderTargets(targets []config.RoutingTarget, key string) []string {
+	ordered := make([]config.RoutingTarget, len(targets))
+	copy(ordered, targets)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Weight > ordered[j].Weight
+	})
+
+	total := 0
+	for _, target := range ordered {
+		total += target.Weight
+	}
+
+	if total > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		bucket := int(h.Sum32() % uint32(total))
+
+		for i, target := range ordered {
+			if bucket < target.Weight {
+				picked := ordered[i]
+				copy(ordered[1:i+1], ordered[:i])
+				ordered[0] = picked
+				break
+			}
+			bucket -= target.Weight
+		}
+	}
+
+	names := make([]string, len(ordered))
+	for i, target := range ordered {
+		names[i] = target.Provider
+	}
+	return names
+}
+
+// routingKey keeps a customer on the same side of a percentage split
+func routingKey(req *models.ChargeRequest) string {
+	if req.CustomerID != "" {
+		return req.CustomerID
+	}
+	return fmt.Sprintf("%s:%d:%s", req.Currency, req.Amount, req.PaymentMethod)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,223 @@
+package providers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/malwarebo/gopay/config"
+	"github.com/malwarebo/gopay/models"
+)
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func targets(names ...string) []config.RoutingTarget {
+	result := make([]config.RoutingTarget, len(names))
+	for i, name := range names {
+		result[i] = config.RoutingTarget{Provider: name}
+	}
+	return result
+}
+
+func TestNewRouterValidatesRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []config.RoutingRule
+		wantErr bool
+	}{
+		{"valid", []config.RoutingRule{{Name: "idr", Currencies: []string{"IDR"}, Providers: targets("xendit")}}, false},
+		{"no rules", nil, false},
+		{"missing name", []config.RoutingRule{{Providers: targets("stripe")}}, true},
+		{"duplicate name", []config.RoutingRule{{Name: "a", Providers: targets("stripe")}, {Name: "a", Providers: targets("xendit")}}, true},
+		{"no providers", []config.RoutingRule{{Name: "a"}}, true},
+		{"missing provider name", []config.RoutingRule{{Name: "a", Providers: targets("")}}, true},
+		{"negative weight", []config.RoutingRule{{Name: "a", Providers: []config.RoutingTarget{{Provider: "stripe", Weight: -1}}}}, true},
+		{"inverted amount range", []config.RoutingRule{{Name: "a", MinAmount: int64Ptr(100), MaxAmount: int64Ptr(10), Providers: targets("stripe")}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRouter(config.RoutingConfig{Rules: tt.rules})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewRouter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRouterRoute(t *testing.T) {
+	router, err := NewRouter(config.RoutingConfig{Rules: []config.RoutingRule{
+		{Name: "large-usd", Currencies: []string{"USD"}, MinAmount: int64Ptr(100000), Providers: targets("stripe")},
+		{Name: "idr-ewallet", Currencies: []string{"IDR"}, PaymentMethodTypes: []string{"ewallet"}, Providers: targets("xendit")},
+		{Name: "vip", Metadata: map[string]string{"tier": "vip"}, Providers: targets("stripe", "xendit")},
+		{Name: "small", MaxAmount: int64Ptr(500), Providers: targets("xendit", "stripe")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		req       models.ChargeRequest
+		wantRule  string
+		wantOrder []string
+	}{
+		{
+			name:      "amount at the minimum",
+			req:       models.ChargeRequest{Amount: 100000, Currency: "USD"},
+			wantRule:  "large-usd",
+			wantOrder: []string{"stripe"},
+		},
+		{
+			name:     "amount below the minimum",
+			req:      models.ChargeRequest{Amount: 99999, Currency: "USD"},
+			wantRule: "",
+		},
+		{
+			name:      "currency and method match case-insensitively",
+			req:       models.ChargeRequest{Amount: 2000000, Currency: "idr", PaymentMethodType: "EWALLET"},
+			wantRule:  "idr-ewallet",
+			wantOrder: []string{"xendit"},
+		},
+		{
+			name:     "method does not match",
+			req:      models.ChargeRequest{Amount: 2000000, Currency: "IDR", PaymentMethodType: "card"},
+			wantRule: "",
+		},
+		{
+			name:      "metadata match",
+			req:       models.ChargeRequest{Amount: 1000, Currency: "EUR", Metadata: map[string]interface{}{"tier": "vip"}},
+			wantRule:  "vip",
+			wantOrder: []string{"stripe", "xendit"},
+		},
+		{
+			name:      "first matching rule wins",
+			req:       models.ChargeRequest{Amount: 100, Currency: "EUR", Metadata: map[string]interface{}{"tier": "vip"}},
+			wantRule:  "vip",
+			wantOrder: []string{"stripe", "xendit"},
+		},
+		{
+			name:      "amount at the maximum",
+			req:       models.ChargeRequest{Amount: 500, Currency: "EUR"},
+			wantRule:  "small",
+			wantOrder: []string{"xendit", "stripe"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := router.Route(&tt.req)
+			if tt.wantRule == "" {
+				if route != nil {
+					t.Fatalf("Route() = %+v, want no match", route)
+				}
+				return
+			}
+			if route == nil {
+				t.Fatalf("Route() = nil, want rule %q", tt.wantRule)
+			}
+			if route.Rule != tt.wantRule {
+				t.Errorf("Route().Rule = %q, want %q", route.Rule, tt.wantRule)
+			}
+			if !reflect.DeepEqual(route.Providers, tt.wantOrder) {
+				t.Errorf("Route().Providers = %v, want %v", route.Providers, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestRouterWeightedSplit(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers []config.RoutingTarget
+		wantFirst map[string]bool
+	}{
+		{
+			name:      "all traffic to one provider",
+			providers: []config.RoutingTarget{{Provider: "xendit", Weight: 0}, {Provider: "stripe", Weight: 100}},
+			wantFirst: map[string]bool{"stripe": true},
+		},
+		{
+			name:      "even split",
+			providers: []config.RoutingTarget{{Provider: "stripe", Weight: 50}, {Provider: "xendit", Weight: 50}},
+			wantFirst: map[string]bool{"stripe": true, "xendit": true},
+		},
+		{
+			name:      "no weights keeps the configured order",
+			providers: targets("xendit", "stripe"),
+			wantFirst: map[string]bool{"xendit": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, err := NewRouter(config.RoutingConfig{Rules: []config.RoutingRule{{Name: "split", Providers: tt.providers}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			first := map[string]bool{}
+			for i := 0; i < 200; i++ {
+				req := &models.ChargeRequest{CustomerID: fmt.Sprintf("cus_%d", i), Amount: 1000, Currency: "USD"}
+				route := router.Route(req)
+				if len(route.Providers) != len(tt.providers) {
+					t.Fatalf("Route().Providers = %v, want every provider", route.Providers)
+				}
+				if again := router.Route(req); !reflect.DeepEqual(again.Providers, route.Providers) {
+					t.Fatalf("customer %s routed to %v, then %v", req.CustomerID, route.Providers, again.Providers)
+				}
+				first[route.Providers[0]] = true
+			}
+			if !reflect.DeepEqual(first, tt.wantFirst) {
+				t.Errorf("providers tried first = %v, want %v", first, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestRouterCurrencyRules(t *testing.T) {
+	router, err := NewRouter(config.RoutingConfig{Rules: []config.RoutingRule{
+		{Name: "large-usd", Currencies: []string{"USD"}, MinAmount: int64Ptr(100000), Providers: targets("stripe")},
+		{Name: "idr", Currencies: []string{"IDR"}, Providers: targets("xendit")},
+		{Name: "card", PaymentMethodTypes: []string{"card"}, Providers: targets("stripe")},
+		{Name: "rest", Providers: targets("stripe", "xendit")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		currency     string
+		wantRules    []string
+		wantFallback bool
+	}{
+		{"USD", []string{"large-usd", "card", "rest"}, false},
+		{"idr", []string{"idr"}, false},
+		{"EUR", []string{"card", "rest"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.currency, func(t *testing.T) {
+			rules, fallback := router.CurrencyRules(tt.currency)
+			var names []string
+			for _, rule := range rules {
+				names = append(names, rule.Name)
+			}
+			if !reflect.DeepEqual(names, tt.wantRules) || fallback != tt.wantFallback {
+				t.Errorf("CurrencyRules() = %v, %v, want %v, %v", names, fallback, tt.wantRules, tt.wantFallback)
+			}
+		})
+	}
+
+	router, err = NewRouter(config.RoutingConfig{Rules: []config.RoutingRule{
+		{Name: "large-usd", Currencies: []string{"USD"}, MinAmount: int64Ptr(100000), Providers: targets("stripe")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules, fallback := router.CurrencyRules("USD"); len(rules) != 1 || !fallback {
+		t.Errorf("CurrencyRules() = %d rules, %v, want 1 rule and the fallback", len(rules), fallback)
+	}
+}
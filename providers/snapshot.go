@@ -0,0 +1,69 @@
+package providers
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/malwarebo/gopay/models"
+)
+
+// responseSnapshot converts a provider response into a JSON document that is
+// stored alongside our record. raw is used when the SDK kept the response
+// body; otherwise v is marshaled.
+func responseSnapshot(raw []byte, v interface{}) models.JSON {
+	if len(raw) == 0 {
+		var err error
+		if raw, err = json.Marshal(v); err != nil {
+			return nil
+		}
+	}
+
+	var snapshot models.JSON
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return nil
+	}
+	redactSecrets(snapshot)
+	return snapshot
+}
+
+// StorableNextAction returns a copy of a charge's next action without the
+// secrets it carries for the client, to be stored with the payment. The
+// secrets are only returned by the call that produced the action.
+func StorableNextAction(action models.JSON) models.JSON {
+	if action == nil {
+		return nil
+	}
+	raw, err := json.Marshal(action)
+	if err != nil {
+		return nil
+	}
+	var stored models.JSON
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil
+	}
+	redactSecrets(stored)
+	return stored
+}
+
+// redactSecrets removes credentials such as a PaymentIntent's client_secret
+// from a snapshot, at any depth. Snapshots are stored and returned by the
+// payments API, while secrets are only ever handed to the client through a
+// charge's next_action.
+func redactSecrets(v interface{}) {
+	switch v := v.(type) {
+	case models.JSON:
+		redactSecrets(map[string]interface{}(v))
+	case map[string]interface{}:
+		for key, value := range v {
+			if key == "secret" || strings.HasSuffix(key, "_secret") {
+				delete(v, key)
+				continue
+			}
+			redactSecrets(value)
+		}
+	case []interface{}:
+		for _, value := range v {
+			redactSecrets(value)
+		}
+	}
+}
@@ -7,32 +7,54 @@ import (
 
 	"github.com/malwarebo/gopay/models"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/charge"
+	"github.com/stripe/stripe-go/v72/balance"
+	"github.com/stripe/stripe-go/v72/paymentintent"
 	"github.com/stripe/stripe-go/v72/refund"
+	"github.com/stripe/stripe-go/v72/webhook"
 )
 
 type StripeProvider struct {
-	apiKey string
+	apiKey        string
+	webhookSecret string
 }
 
-func NewStripeProvider(apiKey string) *StripeProvider {
+func NewStripeProvider(apiKey, webhookSecret string) *StripeProvider {
 	stripe.Key = apiKey
 	return &StripeProvider{
-		apiKey: apiKey,
+		apiKey:        apiKey,
+		webhookSecret: webhookSecret,
 	}
 }
 
+// Charge creates and confirms an automatic-capture PaymentIntent. Cards that
+// need 3-D Secure come back as requires_action with the next action to take.
 func (p *StripeProvider) Charge(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error) {
-	params := &stripe.ChargeParams{
-		Amount:      stripe.Int64(req.Amount), // Amount is already in cents
-		Currency:    stripe.String(req.Currency),
-		Description: stripe.String(req.Description),
-		Customer:    stripe.String(req.CustomerID),
+	return p.createPaymentIntent(ctx, req, stripe.PaymentIntentCaptureMethodAutomatic)
+}
+
+func (p *StripeProvider) createPaymentIntent(ctx context.Context, req *models.ChargeRequest, captureMethod stripe.PaymentIntentCaptureMethod) (*models.ChargeResponse, error) {
+	amount, currency, err := stripeAmount(req.Money())
+	if err != nil {
+		return nil, err
 	}
 
-	// Set payment method
-	if req.PaymentMethod != "" {
-		params.SetSource(req.PaymentMethod)
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(amount),
+		Currency:      stripe.String(currency),
+		Description:   stripe.String(req.Description),
+		Customer:      stripe.String(req.CustomerID),
+		PaymentMethod: stripe.String(req.PaymentMethod),
+		CaptureMethod: stripe.String(string(captureMethod)),
+		Confirm:       stripe.Bool(true),
+	}
+	if req.ReturnURL != "" {
+		params.ReturnURL = stripe.String(req.ReturnURL)
+	}
+
+	params.Context = ctx
+	// Forward the client's idempotency key so Stripe deduplicates retries
+	if key := IdempotencyKey(ctx, "payment_intent"); key != "" {
+		params.SetIdempotencyKey(key)
 	}
 
 	if req.Metadata != nil {
@@ -44,38 +66,58 @@ func (p *StripeProvider) Charge(ctx context.Context, req *models.ChargeRequest)
 		}
 	}
 
-	ch, err := charge.New(params)
+	pi, err := paymentintent.New(params)
 	if err != nil {
 		return nil, err
 	}
 
-	metadata := make(map[string]interface{})
-	for k, v := range ch.Metadata {
-		metadata[k] = v
+	resp := paymentIntentResponse(pi)
+	resp.CustomerID = req.CustomerID
+	resp.PaymentMethod = req.PaymentMethod
+	return resp, nil
+}
+
+// Confirm refreshes the PaymentIntent after the customer has authenticated and
+// confirms it again if Stripe is still waiting for confirmation.
+func (p *StripeProvider) Confirm(ctx context.Context, req *models.ConfirmRequest) (*models.ChargeResponse, error) {
+	pi, err := paymentintent.Get(req.ProviderChargeID, &stripe.PaymentIntentParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		return nil, err
 	}
 
-	return &models.ChargeResponse{
-		ID:               ch.ID,
-		CustomerID:       req.CustomerID,
-		Amount:           ch.Amount,
-		Currency:         string(ch.Currency),
-		Status:           models.PaymentStatusSuccess,
-		PaymentMethod:    ch.Source.ID,
-		Description:      req.Description,
-		ProviderName:     "stripe",
-		ProviderChargeID: ch.ID,
-		Metadata:         metadata,
-		CreatedAt:        time.Unix(ch.Created, 0),
-	}, nil
+	if pi.Status == stripe.PaymentIntentStatusRequiresConfirmation {
+		params := &stripe.PaymentIntentConfirmParams{}
+		if req.ReturnURL != "" {
+			params.ReturnURL = stripe.String(req.ReturnURL)
+		}
+		params.Context = ctx
+		if key := IdempotencyKey(ctx, "payment_intent_confirm"); key != "" {
+			params.SetIdempotencyKey(key)
+		}
+		if pi, err = paymentintent.Confirm(req.ProviderChargeID, params); err != nil {
+			return nil, err
+		}
+	}
+	return paymentIntentResponse(pi), nil
 }
 
 func (p *StripeProvider) Refund(ctx context.Context, req *models.RefundRequest) (*models.RefundResponse, error) {
+	amount, _, err := stripeAmount(req.Money())
+	if err != nil {
+		return nil, err
+	}
+
 	params := &stripe.RefundParams{
-		PaymentIntent: stripe.String(req.PaymentID),
-		Amount:        stripe.Int64(req.Amount), // Amount is already in cents
+		PaymentIntent: stripe.String(req.ProviderChargeID),
+		Amount:        stripe.Int64(amount),
 		Reason:        stripe.String(req.Reason),
 	}
 
+	params.Context = ctx
+	if key := IdempotencyKey(ctx, "refund"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
+
 	if req.Metadata != nil {
 		params.Metadata = make(map[string]string)
 		for k, v := range req.Metadata {
@@ -95,63 +137,158 @@ func (p *StripeProvider) Refund(ctx context.Context, req *models.RefundRequest)
 		metadata[k] = v
 	}
 
+	var raw []byte
+	if ref.LastResponse != nil {
+		raw = ref.LastResponse.RawJSON
+	}
+
+	money := stripeMoney(ref.Amount, string(ref.Currency))
 	return &models.RefundResponse{
 		ID:               ref.ID,
 		PaymentID:        req.PaymentID,
-		Amount:           ref.Amount,
-		Currency:         string(ref.Currency),
+		Amount:           money.Amount,
+		Currency:         money.Currency,
 		Status:           string(ref.Status),
 		Reason:           req.Reason,
 		ProviderName:     "stripe",
 		ProviderRefundID: ref.ID,
+		ProviderResponse: responseSnapshot(raw, ref),
 		Metadata:         metadata,
 		CreatedAt:        time.Unix(ref.Created, 0),
 	}, nil
 }
 
-func (p *StripeProvider) ValidateWebhookSignature(payload []byte, signature string) error {
-	// Implement webhook signature validation
-	return nil
+// Authorize creates a manual-capture PaymentIntent, holding the funds until
+// Capture or Void is called.
+func (p *StripeProvider) Authorize(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error) {
+	return p.createPaymentIntent(ctx, req, stripe.PaymentIntentCaptureMethodManual)
 }
 
-func (p *StripeProvider) CreateSubscription(ctx context.Context, req *models.CreateSubscriptionRequest) (*models.Subscription, error) {
-	return nil, fmt.Errorf("stripe: subscription creation not implemented")
-}
+func (p *StripeProvider) Capture(ctx context.Context, req *models.CaptureRequest) (*models.ChargeResponse, error) {
+	params := &stripe.PaymentIntentCaptureParams{}
+	if req.Amount > 0 {
+		amount, _, err := stripeAmount(req.Money())
+		if err != nil {
+			return nil, err
+		}
+		params.AmountToCapture = stripe.Int64(amount)
+	}
+	params.Context = ctx
+	if key := IdempotencyKey(ctx, "payment_intent_capture"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
 
-func (p *StripeProvider) UpdateSubscription(ctx context.Context, subscriptionID string, req *models.UpdateSubscriptionRequest) (*models.Subscription, error) {
-	return nil, fmt.Errorf("stripe: subscription update not implemented")
+	pi, err := paymentintent.Capture(req.ProviderChargeID, params)
+	if err != nil {
+		return nil, err
+	}
+	return paymentIntentResponse(pi), nil
 }
 
-func (p *StripeProvider) CancelSubscription(ctx context.Context, subscriptionID string, req *models.CancelSubscriptionRequest) (*models.Subscription, error) {
-	return nil, fmt.Errorf("stripe: subscription cancellation not implemented")
-}
+func (p *StripeProvider) Void(ctx context.Context, req *models.VoidRequest) (*models.ChargeResponse, error) {
+	params := &stripe.PaymentIntentCancelParams{}
+	if req.Reason != "" {
+		params.CancellationReason = stripe.String(req.Reason)
+	}
+	params.Context = ctx
+	if key := IdempotencyKey(ctx, "payment_intent_cancel"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
 
-func (p *StripeProvider) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
-	return nil, fmt.Errorf("stripe: get subscription not implemented")
+	pi, err := paymentintent.Cancel(req.ProviderChargeID, params)
+	if err != nil {
+		return nil, err
+	}
+	return paymentIntentResponse(pi), nil
 }
 
-func (p *StripeProvider) ListSubscriptions(ctx context.Context, customerID string) ([]*models.Subscription, error) {
-	return nil, fmt.Errorf("stripe: list subscriptions not implemented")
-}
+func paymentIntentResponse(pi *stripe.PaymentIntent) *models.ChargeResponse {
+	metadata := make(map[string]interface{})
+	for k, v := range pi.Metadata {
+		metadata[k] = v
+	}
 
-func (p *StripeProvider) CreatePlan(ctx context.Context, plan *models.Plan) (*models.Plan, error) {
-	return nil, fmt.Errorf("stripe: create plan not implemented")
-}
+	var raw []byte
+	if pi.LastResponse != nil {
+		raw = pi.LastResponse.RawJSON
+	}
 
-func (p *StripeProvider) UpdatePlan(ctx context.Context, planID string, plan *models.Plan) (*models.Plan, error) {
-	return nil, fmt.Errorf("stripe: update plan not implemented")
+	money := stripeMoney(pi.Amount, string(pi.Currency))
+	resp := &models.ChargeResponse{
+		ID:               pi.ID,
+		Amount:           money.Amount,
+		Currency:         money.Currency,
+		Status:           mapStripePaymentIntentStatus(pi),
+		Description:      pi.Description,
+		ProviderName:     "stripe",
+		ProviderChargeID: pi.ID,
+		ProviderStatus:   string(pi.Status),
+		ProviderResponse: responseSnapshot(raw, pi),
+		CaptureMethod:    string(pi.CaptureMethod),
+		CapturedAmount:   pi.AmountReceived,
+		Metadata:         metadata,
+		CreatedAt:        time.Unix(pi.Created, 0),
+	}
+	if pi.Customer != nil {
+		resp.CustomerID = pi.Customer.ID
+	}
+	if pi.PaymentMethod != nil {
+		resp.PaymentMethod = pi.PaymentMethod.ID
+	}
+	if pi.Status == stripe.PaymentIntentStatusRequiresAction && pi.NextAction != nil {
+		resp.NextAction = stripeNextAction(pi)
+	}
+	return resp
 }
 
-func (p *StripeProvider) DeletePlan(ctx context.Context, planID string) error {
-	return fmt.Errorf("stripe: delete plan not implemented")
+// stripeNextAction returns the action the client must take. Redirects carry
+// the URL; other actions are handled by Stripe.js with the client secret.
+func stripeNextAction(pi *stripe.PaymentIntent) models.JSON {
+	action := models.JSON{
+		"type":          string(pi.NextAction.Type),
+		"client_secret": pi.ClientSecret,
+	}
+	if redirect := pi.NextAction.RedirectToURL; redirect != nil {
+		action["url"] = redirect.URL
+		action["return_url"] = redirect.ReturnURL
+	}
+	return action
 }
 
-func (p *StripeProvider) GetPlan(ctx context.Context, planID string) (*models.Plan, error) {
-	return nil, fmt.Errorf("stripe: get plan not implemented")
+func mapStripePaymentIntentStatus(pi *stripe.PaymentIntent) models.PaymentStatus {
+	manual := pi.CaptureMethod == stripe.PaymentIntentCaptureMethodManual
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresCapture:
+		return models.PaymentStatusAuthorized
+	case stripe.PaymentIntentStatusSucceeded:
+		if manual {
+			return models.PaymentStatusCaptured
+		}
+		return models.PaymentStatusSuccess
+	case stripe.PaymentIntentStatusCanceled:
+		if manual {
+			return models.PaymentStatusVoided
+		}
+		return models.PaymentStatusFailed
+	case stripe.PaymentIntentStatusRequiresAction:
+		return models.PaymentStatusRequiresAction
+	case stripe.PaymentIntentStatusRequiresPaymentMethod:
+		return models.PaymentStatusFailed
+	default:
+		return models.PaymentStatusPending
+	}
 }
 
-func (p *StripeProvider) ListPlans(ctx context.Context) ([]*models.Plan, error) {
-	return nil, fmt.Errorf("stripe: list plans not implemented")
+// ValidateWebhookSignature checks the Stripe-Signature header against the
+// endpoint secret and rejects events signed outside the default tolerance.
+func (p *StripeProvider) ValidateWebhookSignature(payload []byte, signature string) error {
+	if p.webhookSecret == "" {
+		return fmt.Errorf("%w: stripe webhook secret is not configured", ErrInvalidWebhookSignature)
+	}
+	if err := webhook.ValidatePayloadWithTolerance(payload, signature, p.webhookSecret, webhook.DefaultTolerance); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookSignature, err)
+	}
+	return nil
 }
 
 func (p *StripeProvider) CreateDispute(ctx context.Context, req *models.CreateDisputeRequest) (*models.Dispute, error) {
@@ -178,6 +315,26 @@ func (p *StripeProvider) GetDisputeStats(ctx context.Context) (*models.DisputeSt
 	return nil, fmt.Errorf("stripe: get dispute stats not implemented")
 }
 
+// IsAvailable is always true here; availability is decided by the circuit
+// breaker in MonitoredProvider, which wraps this provider.
 func (p *StripeProvider) IsAvailable(ctx context.Context) bool {
-	return true // Assume Stripe is always available
+	return true
+}
+
+// Ping retrieves the account balance as a cheap authenticated health check
+func (p *StripeProvider) Ping(ctx context.Context) error {
+	params := &stripe.BalanceParams{}
+	params.Context = ctx
+	_, err := balance.Get(params)
+	return err
+}
+
+// ChargesOffSession is true: PaymentIntents are confirmed against the
+// customer's saved payment method
+func (p *StripeProvider) ChargesOffSession() bool {
+	return true
+}
+
+func (p *StripeProvider) Name() string {
+	return "stripe"
 }
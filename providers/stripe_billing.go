@@ -0,0 +1,532 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/malwarebo/gopay/models"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/price"
+	"github.com/stripe/stripe-go/v72/product"
+	"github.com/stripe/stripe-go/v72/sub"
+)
+
+// stripePlanIDKey is the metadata key holding our plan ID on Stripe
+// subscriptions, so that webhooks can be mapped back onto the plan
+const stripePlanIDKey = "gopay_plan_id"
+
+var stripeIntervals = map[models.BillingPeriod]stripe.PriceRecurringInterval{
+	models.BillingPeriodDaily:   stripe.PriceRecurringIntervalDay,
+	models.BillingPeriodWeekly:  stripe.PriceRecurringIntervalWeek,
+	models.BillingPeriodMonthly: stripe.PriceRecurringIntervalMonth,
+	models.BillingPeriodYearly:  stripe.PriceRecurringIntervalYear,
+}
+
+// stripeProrationBehaviors maps our proration behaviors onto Stripe's. An
+// empty behavior leaves Stripe's default, which prorates on the next invoice.
+var stripeProrationBehaviors = map[models.ProrationBehavior]stripe.SubscriptionProrationBehavior{
+	models.ProrationBehaviorImmediately: stripe.SubscriptionProrationBehaviorAlwaysInvoice,
+	models.ProrationBehaviorNextRenewal: stripe.SubscriptionProrationBehaviorCreateProrations,
+	models.ProrationBehaviorNone:        stripe.SubscriptionProrationBehaviorNone,
+}
+
+// Plans map onto a Stripe Product holding the name and description and a
+// recurring Price holding the pricing and billing period. Per-unit plans
+// use a per-unit Price and the other pricing types a tiered one. The Price
+// ID is stored as the plan's ProviderPlanID; later calls take that ID.
+// Prices cannot change their amounts, so a new Price replaces the old one
+// when the pricing, currency or period changes.
+
+func (p *StripeProvider) CreatePlan(ctx context.Context, plan *models.Plan) (*models.Plan, error) {
+	productParams := &stripe.ProductParams{
+		Name: stripe.String(plan.Name),
+	}
+	if plan.Description != "" {
+		productParams.Description = stripe.String(plan.Description)
+	}
+	productParams.Context = ctx
+	if key := IdempotencyKey(ctx, "product"); key != "" {
+		productParams.SetIdempotencyKey(key)
+	}
+	prod, err := product.New(productParams)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, err := p.createPrice(ctx, prod.ID, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	created := *plan
+	created.ProviderName = p.Name()
+	created.ProviderPlanID = pr.ID
+	return &created, nil
+}
+
+func (p *StripeProvider) createPrice(ctx context.Context, productID string, plan *models.Plan) (*stripe.Price, error) {
+	interval, ok := stripeIntervals[plan.BillingPeriod]
+	if !ok {
+		return nil, fmt.Errorf("stripe: %w: %q", models.ErrInvalidBillingPeriod, plan.BillingPeriod)
+	}
+	_, currency, err := stripeAmount(plan.Price())
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.PriceParams{
+		Product:  stripe.String(productID),
+		Currency: stripe.String(currency),
+		Nickname: stripe.String(plan.Name),
+		Recurring: &stripe.PriceRecurringParams{
+			Interval:      stripe.String(string(interval)),
+			IntervalCount: stripe.Int64(1),
+		},
+	}
+	if plan.PricingType == models.PricingTypePerUnit {
+		params.UnitAmount = stripe.Int64(plan.Amount)
+	} else {
+		tiers, err := stripeTiers(plan)
+		if err != nil {
+			return nil, err
+		}
+		params.BillingScheme = stripe.String(string(stripe.PriceBillingSchemeTiered))
+		params.TiersMode = stripe.String(string(stripeTiersMode(plan)))
+		for _, tier := range tiers {
+			param := &stripe.PriceTierParams{
+				UnitAmount: stripe.Int64(tier.UnitAmount),
+				FlatAmount: stripe.Int64(tier.FlatAmount),
+			}
+			if tier.UpTo == nil {
+				param.UpToInf = stripe.Bool(true)
+			} else {
+				param.UpTo = stripe.Int64(*tier.UpTo)
+			}
+			params.Tiers = append(params.Tiers, param)
+		}
+	}
+	params.Context = ctx
+	if key := IdempotencyKey(ctx, "price"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
+	pr, err := price.New(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Point the product at the price so the Dashboard shows the current amount
+	defaultPrice := &stripe.ProductParams{DefaultPrice: stripe.String(pr.ID)}
+	defaultPrice.Context = ctx
+	if _, err := product.Update(productID, defaultPrice); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// UpdatePlan brings the Stripe Product and Price identified by priceID in
+// line with plan and returns plan with the ID of the Price now in use.
+// Subscriptions already on the old Price keep it until they are moved.
+func (p *StripeProvider) UpdatePlan(ctx context.Context, priceID string, plan *models.Plan) (*models.Plan, error) {
+	current, err := p.getPrice(ctx, priceID)
+	if err != nil {
+		return nil, err
+	}
+
+	productParams := &stripe.ProductParams{
+		Name:        stripe.String(plan.Name),
+		Description: stripe.String(plan.Description),
+	}
+	productParams.Context = ctx
+	if _, err := product.Update(current.Product.ID, productParams); err != nil {
+		return nil, err
+	}
+
+	updated := *plan
+	updated.ProviderName = p.Name()
+	updated.ProviderPlanID = current.ID
+
+	unchanged, err := stripePriceMatches(current, plan)
+	if err != nil {
+		return nil, err
+	}
+	if unchanged {
+		return &updated, nil
+	}
+
+	replacement, err := p.createPrice(ctx, current.Product.ID, plan)
+	if err != nil {
+		return nil, err
+	}
+	if err := archivePrice(ctx, current.ID); err != nil {
+		return nil, err
+	}
+	updated.ProviderPlanID = replacement.ID
+	return &updated, nil
+}
+
+// DeletePlan archives the Price and its Product. Stripe does not delete
+// products that have prices, and archived ones can no longer be subscribed to.
+func (p *StripeProvider) DeletePlan(ctx context.Context, priceID string) error {
+	current, err := p.getPrice(ctx, priceID)
+	if err != nil {
+		return err
+	}
+	if err := archivePrice(ctx, current.ID); err != nil {
+		return err
+	}
+	params := &stripe.ProductParams{Active: stripe.Bool(false)}
+	params.Context = ctx
+	_, err = product.Update(current.Product.ID, params)
+	return err
+}
+
+func archivePrice(ctx context.Context, priceID string) error {
+	params := &stripe.PriceParams{Active: stripe.Bool(false)}
+	params.Context = ctx
+	_, err := price.Update(priceID, params)
+	return err
+}
+
+func (p *StripeProvider) GetPlan(ctx context.Context, priceID string) (*models.Plan, error) {
+	pr, err := p.getPrice(ctx, priceID)
+	if err != nil {
+		return nil, err
+	}
+	return mapStripePrice(pr), nil
+}
+
+// ListPlans returns the active recurring prices on the Stripe account
+func (p *StripeProvider) ListPlans(ctx context.Context) ([]*models.Plan, error) {
+	params := &stripe.PriceListParams{
+		Active: stripe.Bool(true),
+		Type:   stripe.String(string(stripe.PriceTypeRecurring)),
+	}
+	params.AddExpand("data.product")
+	params.AddExpand("data.tiers")
+	params.Context = ctx
+
+	var plans []*models.Plan
+	iter := price.List(params)
+	for iter.Next() {
+		plans = append(plans, mapStripePrice(iter.Price()))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+func (p *StripeProvider) getPrice(ctx context.Context, priceID string) (*stripe.Price, error) {
+	params := &stripe.PriceParams{}
+	params.Context = ctx
+	params.AddExpand("product")
+	params.AddExpand("tiers")
+	return price.Get(priceID, params)
+}
+
+// stripeTiers returns the tiers of the Stripe price for a plan priced by
+// tiers. A fixed plan becomes a single volume tier with only a flat amount,
+// so that Stripe charges the same whatever the subscription quantity.
+func stripeTiers(plan *models.Plan) ([]models.PlanTier, error) {
+	tiers := plan.Tiers
+	if plan.PricingType == models.PricingTypeFixed || plan.PricingType == "" {
+		tiers = []models.PlanTier{{FlatAmount: plan.Amount}}
+	}
+	for _, tier := range tiers {
+		for _, amount := range []int64{tier.UnitAmount, tier.FlatAmount} {
+			if _, _, err := stripeAmount(models.Money{Amount: amount, Currency: plan.Currency}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tiers, nil
+}
+
+func stripeTiersMode(plan *models.Plan) stripe.PriceTiersMode {
+	if plan.PricingType == models.PricingTypeTiered {
+		return stripe.PriceTiersModeGraduated
+	}
+	return stripe.PriceTiersModeVolume
+}
+
+// stripePriceMatches reports whether the Stripe price already charges what
+// the plan does, so that it can be kept when the plan is updated
+func stripePriceMatches(current *stripe.Price, plan *models.Plan) (bool, error) {
+	_, currency, err := stripeAmount(plan.Price())
+	if err != nil {
+		return false, err
+	}
+	if string(current.Currency) != currency || current.Recurring == nil || current.Recurring.IntervalCount != 1 ||
+		current.Recurring.Interval != stripeIntervals[plan.BillingPeriod] {
+		return false, nil
+	}
+
+	if plan.PricingType == models.PricingTypePerUnit {
+		return current.BillingScheme == stripe.PriceBillingSchemePerUnit && current.UnitAmount == plan.Amount, nil
+	}
+	tiers, err := stripeTiers(plan)
+	if err != nil {
+		return false, err
+	}
+	if current.BillingScheme != stripe.PriceBillingSchemeTiered || current.TiersMode != stripeTiersMode(plan) ||
+		len(current.Tiers) != len(tiers) {
+		return false, nil
+	}
+	for i, tier := range tiers {
+		upTo := int64(0)
+		if tier.UpTo != nil {
+			upTo = *tier.UpTo
+		}
+		got := current.Tiers[i]
+		if got.UpTo != upTo || got.UnitAmount != tier.UnitAmount || got.FlatAmount != tier.FlatAmount {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func mapStripePrice(pr *stripe.Price) *models.Plan {
+	plan := &models.Plan{
+		Amount:         pr.UnitAmount,
+		Currency:       strings.ToUpper(string(pr.Currency)),
+		PricingType:    models.PricingTypePerUnit,
+		Active:         pr.Active,
+		ProviderName:   "stripe",
+		ProviderPlanID: pr.ID,
+	}
+	if pr.BillingScheme == stripe.PriceBillingSchemeTiered {
+		plan.PricingType = models.PricingTypeVolume
+		if pr.TiersMode == stripe.PriceTiersModeGraduated {
+			plan.PricingType = models.PricingTypeTiered
+		}
+		for _, tier := range pr.Tiers {
+			planTier := models.PlanTier{UnitAmount: tier.UnitAmount, FlatAmount: tier.FlatAmount}
+			if tier.UpTo > 0 {
+				upTo := tier.UpTo
+				planTier.UpTo = &upTo
+			}
+			plan.Tiers = append(plan.Tiers, planTier)
+		}
+		// A single flat tier is how fixed plans are priced
+		if len(plan.Tiers) == 1 && plan.Tiers[0].UpTo == nil && plan.Tiers[0].UnitAmount == 0 {
+			plan.PricingType = models.PricingTypeFixed
+			plan.Amount = plan.Tiers[0].FlatAmount
+			plan.Tiers = nil
+		}
+	}
+	if pr.Product != nil {
+		plan.Name = pr.Product.Name
+		plan.Description = pr.Product.Description
+		plan.Active = pr.Active && pr.Product.Active
+	}
+	if plan.Name == "" {
+		plan.Name = pr.Nickname
+	}
+	if pr.Recurring != nil && pr.Recurring.IntervalCount == 1 {
+		for period, interval := range stripeIntervals {
+			if interval == pr.Recurring.Interval {
+				plan.BillingPeriod = period
+			}
+		}
+		plan.TrialDays = int(pr.Recurring.TrialPeriodDays)
+	}
+	return plan
+}
+
+// CreateSubscription subscribes the customer to the plan's Stripe Price.
+// Stripe charges the first invoice; a payment that does not complete leaves
+// the subscription incomplete, which maps onto past_due.
+func (p *StripeProvider) CreateSubscription(ctx context.Context, req *models.CreateSubscriptionRequest) (*models.Subscription, error) {
+	if req.ProviderPlanID == "" {
+		return nil, fmt.Errorf("stripe: plan %s has no Stripe price", req.PlanID)
+	}
+	quantity := int64(req.Quantity)
+	if quantity < 1 {
+		quantity = 1
+	}
+
+	params := &stripe.SubscriptionParams{
+		Customer: stripe.String(req.CustomerID),
+		Items: []*stripe.SubscriptionItemsParams{{
+			Price:    stripe.String(req.ProviderPlanID),
+			Quantity: stripe.Int64(quantity),
+		}},
+	}
+	if req.TrialDays != nil && *req.TrialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(int64(*req.TrialDays))
+	}
+	if req.PaymentMethodID != "" {
+		params.DefaultPaymentMethod = stripe.String(req.PaymentMethodID)
+	}
+	params.Metadata = stripeSubscriptionMetadata(req.Metadata)
+	params.Metadata[stripePlanIDKey] = req.PlanID
+	params.Context = ctx
+	if key := IdempotencyKey(ctx, "subscription"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
+
+	s, err := sub.New(params)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription := mapStripeSubscription(s)
+	subscription.PlanID = req.PlanID
+	subscription.CustomerID = req.CustomerID
+	subscription.PaymentMethodID = req.PaymentMethodID
+	subscription.Metadata = req.Metadata
+	return subscription, nil
+}
+
+// UpdateSubscription changes the price, quantity or default payment method
+// of the Stripe subscription. Stripe prorates the change by default.
+func (p *StripeProvider) UpdateSubscription(ctx context.Context, subscriptionID string, req *models.UpdateSubscriptionRequest) (*models.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	if req.ProviderPlanID != "" || req.Quantity != nil {
+		current, err := sub.Get(subscriptionID, &stripe.SubscriptionParams{Params: stripe.Params{Context: ctx}})
+		if err != nil {
+			return nil, err
+		}
+		if current.Items == nil || len(current.Items.Data) != 1 {
+			return nil, fmt.Errorf("stripe: %w: subscription %s does not have exactly one item", ErrOperationNotSupported, subscriptionID)
+		}
+
+		item := &stripe.SubscriptionItemsParams{ID: stripe.String(current.Items.Data[0].ID)}
+		if req.ProviderPlanID != "" {
+			item.Price = stripe.String(req.ProviderPlanID)
+		}
+		if req.Quantity != nil {
+			item.Quantity = stripe.Int64(int64(*req.Quantity))
+		}
+		params.Items = []*stripe.SubscriptionItemsParams{item}
+	}
+	if req.PaymentMethodID != nil {
+		params.DefaultPaymentMethod = stripe.String(*req.PaymentMethodID)
+	}
+	if behavior, ok := stripeProrationBehaviors[req.ProrationBehavior]; ok {
+		params.ProrationBehavior = stripe.String(string(behavior))
+	}
+	if req.Metadata != nil || req.PlanID != nil {
+		params.Metadata = stripeSubscriptionMetadata(req.Metadata)
+		if req.PlanID != nil {
+			params.Metadata[stripePlanIDKey] = *req.PlanID
+		}
+	}
+	params.Context = ctx
+	if key := IdempotencyKey(ctx, "subscription_update"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
+
+	s, err := sub.Update(subscriptionID, params)
+	if err != nil {
+		return nil, err
+	}
+	return mapStripeSubscription(s), nil
+}
+
+// CancelSubscription cancels immediately, or at the end of the current
+// period when CancelAtPeriodEnd is set
+func (p *StripeProvider) CancelSubscription(ctx context.Context, subscriptionID string, req *models.CancelSubscriptionRequest) (*models.Subscription, error) {
+	var s *stripe.Subscription
+	var err error
+	if req.CancelAtPeriodEnd {
+		params := &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(true)}
+		params.Context = ctx
+		s, err = sub.Update(subscriptionID, params)
+	} else {
+		s, err = sub.Cancel(subscriptionID, &stripe.SubscriptionCancelParams{Params: stripe.Params{Context: ctx}})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mapStripeSubscription(s), nil
+}
+
+// PauseSubscription pauses payment collection, voiding the invoices of the
+// periods it covers. Stripe cannot pause a subscription fully.
+func (p *StripeProvider) PauseSubscription(ctx context.Context, subscriptionID string, req *models.PauseSubscriptionRequest) (*models.Subscription, error) {
+	if req.Mode != models.PauseModeCollection {
+		return nil, fmt.Errorf("stripe: %w: only payment collection can be paused", ErrOperationNotSupported)
+	}
+	pause := &stripe.SubscriptionPauseCollectionParams{
+		Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorVoid)),
+	}
+	if req.ResumeAt != nil {
+		pause.ResumesAt = stripe.Int64(req.ResumeAt.Unix())
+	}
+	params := &stripe.SubscriptionParams{PauseCollection: pause}
+	params.Context = ctx
+	if key := IdempotencyKey(ctx, "subscription_pause"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
+
+	s, err := sub.Update(subscriptionID, params)
+	if err != nil {
+		return nil, err
+	}
+	return mapStripeSubscription(s), nil
+}
+
+// ResumeSubscription resumes payment collection
+func (p *StripeProvider) ResumeSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	// An empty pause_collection clears it
+	params.AddExtra("pause_collection", "")
+	params.Context = ctx
+	if key := IdempotencyKey(ctx, "subscription_resume"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
+
+	s, err := sub.Update(subscriptionID, params)
+	if err != nil {
+		return nil, err
+	}
+	return mapStripeSubscription(s), nil
+}
+
+func (p *StripeProvider) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	s, err := sub.Get(subscriptionID, &stripe.SubscriptionParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		return nil, err
+	}
+	return mapStripeSubscription(s), nil
+}
+
+// ListSubscriptions returns the customer's Stripe subscriptions in any status
+func (p *StripeProvider) ListSubscriptions(ctx context.Context, customerID string) ([]*models.Subscription, error) {
+	params := &stripe.SubscriptionListParams{
+		Customer: customerID,
+		Status:   "all",
+	}
+	params.Context = ctx
+
+	var subscriptions []*models.Subscription
+	iter := sub.List(params)
+	for iter.Next() {
+		subscriptions = append(subscriptions, mapStripeSubscription(iter.Subscription()))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// stripeSubscriptionMetadata keeps the string values of subscription
+// metadata, the only kind Stripe stores
+func stripeSubscriptionMetadata(metadata interface{}) map[string]string {
+	result := make(map[string]string)
+	var values map[string]interface{}
+	switch m := metadata.(type) {
+	case map[string]interface{}:
+		values = m
+	case models.JSON:
+		values = m
+	}
+	for k, v := range values {
+		if str, ok := v.(string); ok {
+			result[k] = str
+		}
+	}
+	return result
+}
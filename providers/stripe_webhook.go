@@ -0,0 +1,206 @@
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// ParseWebhook verifies the Stripe-Signature header and maps the event payload
+// onto gopay models. Event types we do not handle are returned without data.
+func (p *StripeProvider) ParseWebhook(payload []byte, header http.Header) (*WebhookEvent, error) {
+	if err := p.ValidateWebhookSignature(payload, header.Get("Stripe-Signature")); err != nil {
+		return nil, err
+	}
+
+	var event stripe.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("stripe: invalid webhook payload: %w", err)
+	}
+
+	result := &WebhookEvent{
+		ID:       event.ID,
+		Provider: p.Name(),
+		Type:     event.Type,
+	}
+	if event.Data == nil {
+		return result, nil
+	}
+
+	switch event.Type {
+	case "charge.succeeded", "charge.failed", "charge.refunded", "charge.captured", "charge.expired":
+		var ch stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &ch); err != nil {
+			return nil, fmt.Errorf("stripe: invalid charge in webhook: %w", err)
+		}
+		mapStripeCharge(result, &ch)
+
+	case "charge.dispute.created", "charge.dispute.updated", "charge.dispute.closed":
+		var dp stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dp); err != nil {
+			return nil, fmt.Errorf("stripe: invalid dispute in webhook: %w", err)
+		}
+		result.Dispute = mapStripeDispute(&dp)
+
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted",
+		"customer.subscription.paused", "customer.subscription.resumed", "customer.subscription.trial_will_end":
+		var sub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+			return nil, fmt.Errorf("stripe: invalid subscription in webhook: %w", err)
+		}
+		result.Subscription = mapStripeSubscription(&sub)
+	}
+
+	return result, nil
+}
+
+func mapStripeCharge(event *WebhookEvent, ch *stripe.Charge) {
+	update := &PaymentUpdate{
+		ProviderChargeIDs: stripeChargeIDs(ch),
+		ProviderStatus:    string(ch.Status),
+	}
+	switch {
+	case event.Type == "charge.refunded":
+		// A partial refund leaves the payment status as it is
+		if ch.Refunded {
+			update.Status = models.PaymentStatusRefunded
+		}
+	case event.Type == "charge.captured":
+		update.Status = models.PaymentStatusCaptured
+	case event.Type == "charge.expired":
+		// An uncaptured authorization was released by Stripe
+		update.Status = models.PaymentStatusVoided
+	case ch.Status == stripe.ChargeStatusSucceeded && !ch.Captured:
+		update.Status = models.PaymentStatusAuthorized
+	case ch.Status == stripe.ChargeStatusSucceeded:
+		update.Status = models.PaymentStatusSuccess
+	case ch.Status == stripe.ChargeStatusFailed:
+		update.Status = models.PaymentStatusFailed
+	}
+	event.Payment = update
+
+	if ch.Refunds == nil {
+		return
+	}
+	for _, ref := range ch.Refunds.Data {
+		event.Refunds = append(event.Refunds, &models.Refund{
+			Amount:           ref.Amount,
+			Reason:           string(ref.Reason),
+			Status:           string(ref.Status),
+			ProviderName:     "stripe",
+			ProviderRefundID: ref.ID,
+		})
+	}
+}
+
+func stripeChargeIDs(ch *stripe.Charge) []string {
+	ids := []string{ch.ID}
+	if ch.PaymentIntent != nil && ch.PaymentIntent.ID != "" {
+		ids = append(ids, ch.PaymentIntent.ID)
+	}
+	return ids
+}
+
+func mapStripeDispute(dp *stripe.Dispute) *models.Dispute {
+	money := stripeMoney(dp.Amount, string(dp.Currency))
+	dispute := &models.Dispute{
+		Amount:            money.Amount,
+		Currency:          money.Currency,
+		Reason:            string(dp.Reason),
+		Status:            mapStripeDisputeStatus(dp.Status),
+		ProviderName:      "stripe",
+		ProviderDisputeID: dp.ID,
+	}
+	if dp.Charge != nil {
+		dispute.TransactionID = dp.Charge.ID
+	} else if dp.PaymentIntent != nil {
+		dispute.TransactionID = dp.PaymentIntent.ID
+	}
+	if dp.EvidenceDetails != nil && dp.EvidenceDetails.DueBy > 0 {
+		dispute.DueBy = time.Unix(dp.EvidenceDetails.DueBy, 0)
+	}
+	if dispute.Status != models.DisputeStatusOpen {
+		closedAt := time.Now()
+		dispute.ClosedAt = &closedAt
+	}
+	return dispute
+}
+
+func mapStripeDisputeStatus(status stripe.DisputeStatus) models.DisputeStatus {
+	switch status {
+	case stripe.DisputeStatusWon:
+		return models.DisputeStatusWon
+	case stripe.DisputeStatusLost:
+		return models.DisputeStatusLost
+	case stripe.DisputeStatusWarningClosed, stripe.DisputeStatusChargeRefunded:
+		return models.DisputeStatusCanceled
+	default:
+		return models.DisputeStatusOpen
+	}
+}
+
+func mapStripeSubscription(sub *stripe.Subscription) *models.Subscription {
+	subscription := &models.Subscription{
+		Status:                 mapStripeSubscriptionStatus(sub.Status),
+		CurrentPeriodStart:     time.Unix(sub.CurrentPeriodStart, 0),
+		CurrentPeriodEnd:       time.Unix(sub.CurrentPeriodEnd, 0),
+		CancelAtPeriodEnd:      sub.CancelAtPeriodEnd,
+		Quantity:               int(sub.Quantity),
+		PlanID:                 sub.Metadata[stripePlanIDKey],
+		ProviderName:           "stripe",
+		ProviderSubscriptionID: sub.ID,
+	}
+	if sub.BillingCycleAnchor > 0 {
+		subscription.BillingCycleAnchor = time.Unix(sub.BillingCycleAnchor, 0)
+	}
+	if sub.Customer != nil {
+		subscription.CustomerID = sub.Customer.ID
+	}
+	if sub.DefaultPaymentMethod != nil {
+		subscription.PaymentMethodID = sub.DefaultPaymentMethod.ID
+	}
+	// Subscriptions with a single item report its quantity there
+	if sub.Quantity == 0 && sub.Items != nil && len(sub.Items.Data) == 1 {
+		subscription.Quantity = int(sub.Items.Data[0].Quantity)
+	}
+	if sub.CanceledAt > 0 {
+		canceledAt := time.Unix(sub.CanceledAt, 0)
+		subscription.CanceledAt = &canceledAt
+	}
+	if sub.TrialStart > 0 {
+		trialStart := time.Unix(sub.TrialStart, 0)
+		subscription.TrialStart = &trialStart
+	}
+	if sub.TrialEnd > 0 {
+		trialEnd := time.Unix(sub.TrialEnd, 0)
+		subscription.TrialEnd = &trialEnd
+	}
+	if sub.PauseCollection.Behavior != "" {
+		subscription.PauseMode = models.PauseModeCollection
+		if sub.PauseCollection.ResumesAt > 0 {
+			resumeAt := time.Unix(sub.PauseCollection.ResumesAt, 0)
+			subscription.ResumeAt = &resumeAt
+		}
+	}
+	return subscription
+}
+
+func mapStripeSubscriptionStatus(status stripe.SubscriptionStatus) models.SubscriptionStatus {
+	switch status {
+	case stripe.SubscriptionStatusActive:
+		return models.SubscriptionStatusActive
+	case stripe.SubscriptionStatusTrialing:
+		return models.SubscriptionStatusTrialing
+	case stripe.SubscriptionStatusCanceled, stripe.SubscriptionStatusIncompleteExpired:
+		return models.SubscriptionStatusCanceled
+	case stripe.SubscriptionStatusUnpaid:
+		return models.SubscriptionStatusUnpaid
+	default:
+		// past_due and incomplete both need a successful payment
+		return models.SubscriptionStatusPastDue
+	}
+}
@@ -0,0 +1,61 @@
+package providers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+)
+
+// ErrInvalidWebhookSignature is returned when a webhook cannot be authenticated
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// WebhookParser is implemented by providers that send us webhooks. ParseWebhook
+// authenticates the request and maps its payload onto gopay models.
+type WebhookParser interface {
+	Name() string
+	ParseWebhook(payload []byte, header http.Header) (*WebhookEvent, error)
+}
+
+// WebhookEvent is a verified provider event. Only the fields relevant to the
+// event type are set; records are matched on their provider IDs.
+type WebhookEvent struct {
+	ID       string
+	Provider string
+	Type     string
+
+	Payment      *PaymentUpdate
+	Refunds      []*models.Refund
+	Dispute      *models.Dispute
+	Subscription *models.Subscription
+	// SubscriptionUpdate is set instead of Subscription by providers whose
+	// events only report what changed
+	SubscriptionUpdate *SubscriptionUpdate
+}
+
+// PaymentUpdate changes the status of the payment whose provider charge ID is
+// one of ProviderChargeIDs. Stripe identifies the same payment by both its
+// charge and its PaymentIntent.
+type PaymentUpdate struct {
+	ProviderChargeIDs []string
+	Status            models.PaymentStatus
+	ProviderStatus    string
+}
+
+// SubscriptionUpdate reports a status change or renewal charge of the
+// subscription whose provider subscription ID is ProviderSubscriptionID.
+type SubscriptionUpdate struct {
+	ProviderSubscriptionID string
+	// Status is empty when the event leaves the status as it is
+	Status models.SubscriptionStatus
+	// PaymentEvent is the subscription event type of a renewal charge,
+	// SubscriptionEventPaymentSucceeded or SubscriptionEventPaymentFailed,
+	// and empty for events that are not about a charge
+	PaymentEvent string
+	// PeriodStart is the start of the period a successful charge paid for
+	PeriodStart time.Time
+	// Attempt counts the charges made for the period so far
+	Attempt int
+	Data    models.JSON
+}
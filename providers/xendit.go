@@ -3,31 +3,44 @@ package providers
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/malwarebo/gopay/models"
 	xendit "github.com/xendit/xendit-go/v6"
 	invoice "github.com/xendit/xendit-go/v6/invoice"
+	paymentrequest "github.com/xendit/xendit-go/v6/payment_request"
+	xenditrefund "github.com/xendit/xendit-go/v6/refund"
 )
 
 type XenditProvider struct {
-	apiKey string
-	client *xendit.APIClient
+	apiKey        string
+	callbackToken string
+	client        *xendit.APIClient
 }
 
-func NewXenditProvider(apiKey string) *XenditProvider {
+func NewXenditProvider(apiKey, callbackToken string) *XenditProvider {
 	client := xendit.NewClient(apiKey)
 
 	return &XenditProvider{
-		apiKey: apiKey,
-		client: client,
+		apiKey:        apiKey,
+		callbackToken: callbackToken,
+		client:        client,
 	}
 }
 
+// Charge creates an invoice that the customer pays on Xendit's hosted page,
+// so Xendit cannot charge off-session
 func (p *XenditProvider) Charge(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error) {
+	amount, currency, convErr := xenditAmount(req.Money())
+	if convErr != nil {
+		return nil, convErr
+	}
+
 	// Create invoice
 	payerEmail := "customer@example.com"
-	data := invoice.NewCreateInvoiceRequest(req.CustomerID, float64(req.Amount))
+	data := invoice.NewCreateInvoiceRequest(req.CustomerID, amount)
+	data.SetCurrency(currency)
 	data.PayerEmail = &payerEmail
 	data.Description = &req.Description
 
@@ -46,75 +59,274 @@ func (p *XenditProvider) Charge(ctx context.Context, req *models.ChargeRequest)
 		CustomerID:       req.CustomerID,
 		Amount:           req.Amount,
 		Currency:         req.Currency,
-		Status:           models.PaymentStatusPending,
+		Status:           models.PaymentStatusRequiresAction,
 		PaymentMethod:    req.PaymentMethod,
 		Description:      req.Description,
 		ProviderName:     "xendit",
 		ProviderChargeID: inv.GetId(),
-		Metadata:         metadata,
-		CreatedAt:        time.Now(),
+		ProviderStatus:   string(inv.GetStatus()),
+		ProviderResponse: responseSnapshot(nil, inv),
+		// The customer pays on the hosted invoice page
+		NextAction: models.JSON{
+			"type": "redirect_to_url",
+			"url":  inv.GetInvoiceUrl(),
+		},
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
 	}, nil
 }
 
+// Refund refunds part or all of a paid invoice or captured payment request.
+// Xendit settles refunds asynchronously, so the refund starts out pending
+// and is completed by the refund callback.
 func (p *XenditProvider) Refund(ctx context.Context, req *models.RefundRequest) (*models.RefundResponse, error) {
-	// Expire the invoice
-	_, _, err := p.client.InvoiceApi.ExpireInvoice(ctx, req.PaymentID).Execute()
+	data := xenditrefund.NewCreateRefund()
+	if req.CaptureMethod == models.CaptureMethodManual {
+		data.SetPaymentRequestId(req.ProviderChargeID)
+	} else {
+		data.SetInvoiceId(req.ProviderChargeID)
+	}
+	amount, currency, convErr := xenditAmount(req.Money())
+	if convErr != nil {
+		return nil, convErr
+	}
+	data.SetAmount(amount)
+	data.SetCurrency(currency)
+	reason := "OTHERS"
+	if req.Reason != "" {
+		reason = strings.ToUpper(req.Reason)
+	}
+	data.SetReason(reason)
+	if req.Metadata != nil {
+		data.SetMetadata(req.Metadata)
+	}
+
+	call := p.client.RefundApi.CreateRefund(ctx).CreateRefund(*data)
+	if key := IdempotencyKey(ctx, "refund"); key != "" {
+		call = call.IdempotencyKey(key)
+	}
+
+	ref, _, err := call.Execute()
 	if err != nil {
 		return nil, err
 	}
 
 	return &models.RefundResponse{
-		ID:               "ref_" + req.PaymentID,
+		ID:               ref.GetId(),
 		PaymentID:        req.PaymentID,
 		Amount:           req.Amount,
-		Currency:         req.Currency,
-		Status:           "succeeded",
+		Currency:         currency,
+		Status:           models.RefundStatusPending,
 		Reason:           req.Reason,
 		ProviderName:     "xendit",
-		ProviderRefundID: "ref_" + req.PaymentID,
+		ProviderRefundID: ref.GetId(),
+		ProviderResponse: responseSnapshot(nil, ref),
 		Metadata:         req.Metadata,
 		CreatedAt:        time.Now(),
 	}, nil
 }
 
-func (p *XenditProvider) CreateSubscription(ctx context.Context, req *models.CreateSubscriptionRequest) (*models.Subscription, error) {
-	return nil, fmt.Errorf("xendit: subscription creation not implemented")
-}
+// Confirm refreshes a charge once the customer is back from the invoice page
+// or from authenticating a payment request. Xendit completes the payment on
+// its side, so this only reads the current status.
+func (p *XenditProvider) Confirm(ctx context.Context, req *models.ConfirmRequest) (*models.ChargeResponse, error) {
+	if req.CaptureMethod == models.CaptureMethodManual {
+		pr, _, err := p.client.PaymentRequestApi.GetPaymentRequestByID(ctx, req.ProviderChargeID).Execute()
+		if err != nil {
+			return nil, err
+		}
+		return paymentRequestResponse(pr)
+	}
 
-func (p *XenditProvider) UpdateSubscription(ctx context.Context, subscriptionID string, req *models.UpdateSubscriptionRequest) (*models.Subscription, error) {
-	return nil, fmt.Errorf("xendit: subscription update not implemented")
-}
+	inv, _, err := p.client.InvoiceApi.GetInvoiceById(ctx, req.ProviderChargeID).Execute()
+	if err != nil {
+		return nil, err
+	}
 
-func (p *XenditProvider) CancelSubscription(ctx context.Context, subscriptionID string, req *models.CancelSubscriptionRequest) (*models.Subscription, error) {
-	return nil, fmt.Errorf("xendit: subscription cancellation not implemented")
-}
+	money, convErr := xenditMoney(inv.GetAmount(), string(inv.GetCurrency()))
+	if convErr != nil {
+		return nil, convErr
+	}
 
-func (p *XenditProvider) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
-	return nil, fmt.Errorf("xendit: get subscription not implemented")
+	status := mapXenditInvoiceStatus(string(inv.GetStatus()))
+	if status == "" {
+		status = models.PaymentStatusRequiresAction
+	}
+	resp := &models.ChargeResponse{
+		ID:               inv.GetId(),
+		Amount:           money.Amount,
+		Currency:         money.Currency,
+		Status:           status,
+		Description:      inv.GetDescription(),
+		ProviderName:     "xendit",
+		ProviderChargeID: inv.GetId(),
+		ProviderStatus:   string(inv.GetStatus()),
+		ProviderResponse: responseSnapshot(nil, inv),
+		CaptureMethod:    models.CaptureMethodAutomatic,
+		CreatedAt:        time.Now(),
+	}
+	if status == models.PaymentStatusRequiresAction {
+		resp.NextAction = models.JSON{
+			"type": "redirect_to_url",
+			"url":  inv.GetInvoiceUrl(),
+		}
+	}
+	return resp, nil
 }
 
-func (p *XenditProvider) ListSubscriptions(ctx context.Context, customerID string) ([]*models.Subscription, error) {
-	return nil, fmt.Errorf("xendit: list subscriptions not implemented")
-}
+// Authorize creates a manual-capture payment request against a saved
+// Xendit payment method. Only card payment methods support manual capture.
+func (p *XenditProvider) Authorize(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error) {
+	amount, currency, convErr := xenditAmount(req.Money())
+	if convErr != nil {
+		return nil, convErr
+	}
 
-func (p *XenditProvider) CreatePlan(ctx context.Context, plan *models.Plan) (*models.Plan, error) {
-	return nil, fmt.Errorf("xendit: create plan not implemented")
-}
+	params := paymentrequest.NewPaymentRequestParameters(paymentrequest.PaymentRequestCurrency(currency))
+	params.SetAmount(amount)
+	params.SetPaymentMethodId(req.PaymentMethod)
+	params.SetCaptureMethod(paymentrequest.PAYMENTREQUESTCAPTUREMETHOD_MANUAL)
+	if req.Description != "" {
+		params.SetDescription(req.Description)
+	}
+	if req.Metadata != nil {
+		params.SetMetadata(req.Metadata)
+	}
+
+	call := p.client.PaymentRequestApi.CreatePaymentRequest(ctx).PaymentRequestParameters(*params)
+	if key := IdempotencyKey(ctx, "payment_request"); key != "" {
+		call = call.IdempotencyKey(key)
+	}
+
+	pr, _, err := call.Execute()
+	if err != nil {
+		return nil, err
+	}
 
-func (p *XenditProvider) UpdatePlan(ctx context.Context, planID string, plan *models.Plan) (*models.Plan, error) {
-	return nil, fmt.Errorf("xendit: update plan not implemented")
+	resp, convErr := paymentRequestResponse(pr)
+	if convErr != nil {
+		return nil, convErr
+	}
+	resp.CustomerID = req.CustomerID
+	resp.PaymentMethod = req.PaymentMethod
+	return resp, nil
 }
 
-func (p *XenditProvider) DeletePlan(ctx context.Context, planID string) error {
-	return fmt.Errorf("xendit: delete plan not implemented")
+func (p *XenditProvider) Capture(ctx context.Context, req *models.CaptureRequest) (*models.ChargeResponse, error) {
+	amount, _, convErr := xenditAmount(req.Money())
+	if convErr != nil {
+		return nil, convErr
+	}
+
+	params := paymentrequest.NewCaptureParameters(amount)
+	capture, _, err := p.client.PaymentRequestApi.CapturePaymentRequest(ctx, req.ProviderChargeID).CaptureParameters(*params).Execute()
+	if err != nil {
+		return nil, err
+	}
+	if capture.GetStatus() == "FAILED" {
+		return nil, fmt.Errorf("xendit: capture of %s failed: %s", req.ProviderChargeID, capture.GetFailureCode())
+	}
+	captured, convErr := xenditMoney(capture.GetCapturedAmount(), capture.GetCurrency())
+	if convErr != nil {
+		return nil, convErr
+	}
+
+	return &models.ChargeResponse{
+		ID:               capture.GetPaymentRequestId(),
+		Currency:         captured.Currency,
+		Status:           models.PaymentStatusCaptured,
+		ProviderName:     "xendit",
+		ProviderChargeID: capture.GetPaymentRequestId(),
+		ProviderStatus:   capture.GetStatus(),
+		ProviderResponse: responseSnapshot(nil, capture),
+		CaptureMethod:    models.CaptureMethodManual,
+		CapturedAmount:   captured.Amount,
+		CreatedAt:        time.Now(),
+	}, nil
 }
 
-func (p *XenditProvider) GetPlan(ctx context.Context, planID string) (*models.Plan, error) {
-	return nil, fmt.Errorf("xendit: get plan not implemented")
+// Void has no direct Xendit equivalent: an uncaptured authorization is only
+// released when it expires. The payment request is looked up so that an
+// authorization Xendit has already voided or expired can be recorded as such.
+func (p *XenditProvider) Void(ctx context.Context, req *models.VoidRequest) (*models.ChargeResponse, error) {
+	pr, _, err := p.client.PaymentRequestApi.GetPaymentRequestByID(ctx, req.ProviderChargeID).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, convErr := paymentRequestResponse(pr)
+	if convErr != nil {
+		return nil, convErr
+	}
+	if resp.Status != models.PaymentStatusVoided {
+		return nil, fmt.Errorf("xendit: %w: authorization %s is %s and is released when it expires", ErrOperationNotSupported, req.ProviderChargeID, pr.GetStatus())
+	}
+	return resp, nil
 }
 
-func (p *XenditProvider) ListPlans(ctx context.Context) ([]*models.Plan, error) {
-	return nil, fmt.Errorf("xendit: list plans not implemented")
+func paymentRequestResponse(pr *paymentrequest.PaymentRequest) (*models.ChargeResponse, error) {
+	money, err := xenditMoney(pr.GetAmount(), string(pr.GetCurrency()))
+	if err != nil {
+		return nil, err
+	}
+
+	manual := pr.GetCaptureMethod() == paymentrequest.PAYMENTREQUESTCAPTUREMETHOD_MANUAL
+
+	var status models.PaymentStatus
+	switch pr.GetStatus() {
+	case paymentrequest.PAYMENTREQUESTSTATUS_AWAITING_CAPTURE:
+		status = models.PaymentStatusAuthorized
+	case paymentrequest.PAYMENTREQUESTSTATUS_REQUIRES_ACTION:
+		status = models.PaymentStatusRequiresAction
+	case paymentrequest.PAYMENTREQUESTSTATUS_SUCCEEDED:
+		status = models.PaymentStatusSuccess
+		if manual {
+			status = models.PaymentStatusCaptured
+		}
+	case paymentrequest.PAYMENTREQUESTSTATUS_VOIDED, paymentrequest.PAYMENTREQUESTSTATUS_CANCELED, paymentrequest.PAYMENTREQUESTSTATUS_EXPIRED:
+		status = models.PaymentStatusFailed
+		if manual {
+			status = models.PaymentStatusVoided
+		}
+	case paymentrequest.PAYMENTREQUESTSTATUS_FAILED:
+		status = models.PaymentStatusFailed
+	default:
+		status = models.PaymentStatusPending
+	}
+
+	captureMethod := models.CaptureMethodAutomatic
+	if manual {
+		captureMethod = models.CaptureMethodManual
+	}
+
+	resp := &models.ChargeResponse{
+		ID:               pr.GetId(),
+		CustomerID:       pr.GetCustomerId(),
+		Amount:           money.Amount,
+		Currency:         money.Currency,
+		Status:           status,
+		Description:      pr.GetDescription(),
+		ProviderName:     "xendit",
+		ProviderChargeID: pr.GetId(),
+		ProviderStatus:   string(pr.GetStatus()),
+		ProviderResponse: responseSnapshot(nil, pr),
+		CaptureMethod:    captureMethod,
+		Metadata:         pr.GetMetadata(),
+		CreatedAt:        time.Now(),
+	}
+	if status == models.PaymentStatusRequiresAction {
+		for _, action := range pr.GetActions() {
+			if action.GetUrl() != "" {
+				resp.NextAction = models.JSON{
+					"type":   "redirect_to_url",
+					"url":    action.GetUrl(),
+					"action": action.GetAction(),
+				}
+				break
+			}
+		}
+	}
+	return resp, nil
 }
 
 func (p *XenditProvider) CreateDispute(ctx context.Context, req *models.CreateDisputeRequest) (*models.Dispute, error) {
@@ -141,6 +353,20 @@ func (p *XenditProvider) GetDisputeStats(ctx context.Context) (*models.DisputeSt
 	return nil, fmt.Errorf("xendit: get dispute stats not implemented")
 }
 
+// IsAvailable is always true here; availability is decided by the circuit
+// breaker in MonitoredProvider, which wraps this provider.
 func (p *XenditProvider) IsAvailable(ctx context.Context) bool {
-	return true // Assume Xendit is always available
+	return true
+}
+
+// Ping retrieves the account balance as a cheap authenticated health check
+func (p *XenditProvider) Ping(ctx context.Context) error {
+	if _, _, err := p.client.BalanceApi.GetBalance(ctx).Execute(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *XenditProvider) Name() string {
+	return "xendit"
 }
@@ -0,0 +1,491 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+	"github.com/xendit/xendit-go/v6/common"
+)
+
+// The Xendit SDK has no client for the Recurring API, so these calls go
+// through the SDK's request helpers to keep its authentication and errors.
+//
+// Xendit has no plan catalogue: a Xendit recurring plan is one customer's
+// schedule of charges. A gopay plan billed by Xendit therefore lives in our
+// database only, and each subscription to it is a Xendit recurring plan
+// whose ID is the subscription's ProviderSubscriptionID.
+
+// xenditPlanIDKey and xenditQuantityKey are the metadata keys holding our
+// plan ID and the subscription quantity on Xendit recurring plans
+const (
+	xenditPlanIDKey   = "gopay_plan_id"
+	xenditQuantityKey = "gopay_quantity"
+)
+
+// xenditIntervals maps billing periods onto a Xendit schedule interval and
+// interval count. Xendit has no yearly interval.
+var xenditIntervals = map[models.BillingPeriod]struct {
+	Interval string
+	Count    int
+}{
+	models.BillingPeriodDaily:   {"DAY", 1},
+	models.BillingPeriodWeekly:  {"WEEK", 1},
+	models.BillingPeriodMonthly: {"MONTH", 1},
+	models.BillingPeriodYearly:  {"MONTH", 12},
+}
+
+type xenditRecurringSchedule struct {
+	ID            string     `json:"id,omitempty"`
+	ReferenceID   string     `json:"reference_id,omitempty"`
+	Interval      string     `json:"interval"`
+	IntervalCount int        `json:"interval_count"`
+	AnchorDate    *time.Time `json:"anchor_date,omitempty"`
+}
+
+type xenditRecurringPaymentMethod struct {
+	PaymentMethodID string `json:"payment_method_id"`
+	Rank            int    `json:"rank"`
+}
+
+type xenditRecurringItem struct {
+	Type          string  `json:"type"`
+	Name          string  `json:"name"`
+	NetUnitAmount float64 `json:"net_unit_amount"`
+	Quantity      int     `json:"quantity"`
+}
+
+// xenditRecurringPlan is both the request and the response body of the
+// recurring plans endpoints
+type xenditRecurringPlan struct {
+	ID                  string                         `json:"id,omitempty"`
+	ReferenceID         string                         `json:"reference_id,omitempty"`
+	CustomerID          string                         `json:"customer_id,omitempty"`
+	RecurringAction     string                         `json:"recurring_action,omitempty"`
+	Currency            string                         `json:"currency,omitempty"`
+	Amount              float64                        `json:"amount,omitempty"`
+	Status              string                         `json:"status,omitempty"`
+	PaymentMethods      []xenditRecurringPaymentMethod `json:"payment_methods,omitempty"`
+	Schedule            *xenditRecurringSchedule       `json:"schedule,omitempty"`
+	ImmediateActionType string                         `json:"immediate_action_type,omitempty"`
+	FailedCycleAction   string                         `json:"failed_cycle_action,omitempty"`
+	Description         string                         `json:"description,omitempty"`
+	Items               []xenditRecurringItem          `json:"items,omitempty"`
+	Metadata            map[string]interface{}         `json:"metadata,omitempty"`
+	Created             *time.Time                     `json:"created,omitempty"`
+}
+
+// CreatePlan checks that Xendit can bill the plan and gives it a reference,
+// used as the prefix of the reference IDs of its subscriptions
+func (p *XenditProvider) CreatePlan(ctx context.Context, plan *models.Plan) (*models.Plan, error) {
+	if err := xenditCheckPlan(plan); err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	created := *plan
+	created.ProviderName = p.Name()
+	created.ProviderPlanID = "gopay_plan_" + hex.EncodeToString(suffix)
+	return &created, nil
+}
+
+// UpdatePlan checks that Xendit can bill the changed plan. Subscriptions
+// already created keep their amount and schedule until they are updated.
+func (p *XenditProvider) UpdatePlan(ctx context.Context, planID string, plan *models.Plan) (*models.Plan, error) {
+	if err := xenditCheckPlan(plan); err != nil {
+		return nil, err
+	}
+	updated := *plan
+	updated.ProviderName = p.Name()
+	updated.ProviderPlanID = planID
+	return &updated, nil
+}
+
+// DeletePlan has nothing to remove at Xendit; subscriptions to the plan
+// keep running until they are canceled
+func (p *XenditProvider) DeletePlan(ctx context.Context, planID string) error {
+	return nil
+}
+
+func (p *XenditProvider) GetPlan(ctx context.Context, planID string) (*models.Plan, error) {
+	return nil, fmt.Errorf("xendit: %w: Xendit keeps no plan catalogue", ErrOperationNotSupported)
+}
+
+func (p *XenditProvider) ListPlans(ctx context.Context) ([]*models.Plan, error) {
+	return nil, fmt.Errorf("xendit: %w: Xendit keeps no plan catalogue", ErrOperationNotSupported)
+}
+
+func xenditCheckPlan(plan *models.Plan) error {
+	if _, ok := xenditIntervals[plan.BillingPeriod]; !ok {
+		return fmt.Errorf("xendit: %w: %q", models.ErrInvalidBillingPeriod, plan.BillingPeriod)
+	}
+	switch plan.PricingType {
+	case models.PricingTypeTiered, models.PricingTypeVolume:
+		return fmt.Errorf("xendit: %w: recurring plans cannot price %s plans", ErrOperationNotSupported, plan.PricingType)
+	}
+	if _, _, err := xenditAmount(plan.Price()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CreateSubscription creates a Xendit recurring plan charging the plan
+// price for the quantity to the payment method every period. Without a
+// trial the first period is charged straight away and the schedule starts
+// at the end of it; with a trial the schedule starts when the trial ends.
+func (p *XenditProvider) CreateSubscription(ctx context.Context, req *models.CreateSubscriptionRequest) (*models.Subscription, error) {
+	plan := req.Plan
+	if plan == nil {
+		return nil, fmt.Errorf("xendit: plan %s was not provided", req.PlanID)
+	}
+	if req.PaymentMethodID == "" {
+		return nil, fmt.Errorf("xendit: %w: recurring plans need a payment_method_id", ErrOperationNotSupported)
+	}
+	quantity := req.Quantity
+	if quantity < 1 {
+		quantity = 1
+	}
+	interval, ok := xenditIntervals[plan.BillingPeriod]
+	if !ok {
+		return nil, fmt.Errorf("xendit: %w: %q", models.ErrInvalidBillingPeriod, plan.BillingPeriod)
+	}
+
+	body, err := xenditRecurringBody(plan, quantity)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	anchor, err := plan.BillingPeriod.Advance(now, now)
+	if err != nil {
+		return nil, err
+	}
+	trial := req.TrialDays != nil && *req.TrialDays > 0
+	if trial {
+		anchor = now.AddDate(0, 0, *req.TrialDays)
+	} else {
+		body.ImmediateActionType = "FULL_AMOUNT"
+	}
+
+	reference := plan.ProviderPlanID + "_" + strconv.FormatInt(now.UnixNano(), 36)
+	body.ReferenceID = reference
+	body.CustomerID = req.CustomerID
+	body.RecurringAction = "PAYMENT"
+	body.PaymentMethods = []xenditRecurringPaymentMethod{{PaymentMethodID: req.PaymentMethodID, Rank: 1}}
+	body.Schedule = &xenditRecurringSchedule{
+		ReferenceID:   reference,
+		Interval:      interval.Interval,
+		IntervalCount: interval.Count,
+		AnchorDate:    &anchor,
+	}
+	// Xendit stops the plan when a cycle fails all its retries; the other
+	// dunning actions keep it running
+	body.FailedCycleAction = "STOP"
+	if plan.DunningAction == models.DunningActionPause || plan.DunningAction == models.DunningActionUnpaid {
+		body.FailedCycleAction = "RESUME"
+	}
+	body.Metadata = xenditSubscriptionMetadata(req.Metadata)
+	body.Metadata[xenditPlanIDKey] = plan.ID
+	body.Metadata[xenditQuantityKey] = quantity
+
+	var created xenditRecurringPlan
+	if err := p.recurringCall(ctx, http.MethodPost, "/recurring/plans", body, &created); err != nil {
+		return nil, err
+	}
+
+	subscription := mapXenditRecurringPlan(&created)
+	subscription.PlanID = plan.ID
+	subscription.CustomerID = req.CustomerID
+	subscription.Quantity = quantity
+	subscription.PaymentMethodID = req.PaymentMethodID
+	subscription.Metadata = req.Metadata
+	subscription.BillingCycleAnchor = now
+	subscription.CurrentPeriodStart = now
+	subscription.CurrentPeriodEnd = anchor
+	if trial && subscription.Status == models.SubscriptionStatusActive {
+		subscription.Status = models.SubscriptionStatusTrialing
+	}
+	if trial {
+		subscription.TrialStart = &now
+		subscription.TrialEnd = &anchor
+	}
+	return subscription, nil
+}
+
+// UpdateSubscription changes the amount, payment method or metadata of the
+// Xendit recurring plan, and its schedule when the billing period changes.
+// Changes apply from the next cycle; Xendit does not prorate.
+func (p *XenditProvider) UpdateSubscription(ctx context.Context, subscriptionID string, req *models.UpdateSubscriptionRequest) (*models.Subscription, error) {
+	if req.ProrationBehavior != "" && req.ProrationBehavior != models.ProrationBehaviorNone {
+		return nil, fmt.Errorf("xendit: %w: recurring plans are not prorated", ErrOperationNotSupported)
+	}
+	var current xenditRecurringPlan
+	if err := p.recurringCall(ctx, http.MethodGet, "/recurring/plans/"+url.PathEscape(subscriptionID), nil, &current); err != nil {
+		return nil, err
+	}
+
+	update := &xenditRecurringPlan{}
+	if req.Plan != nil && (req.PlanID != nil || req.Quantity != nil) {
+		quantity := xenditQuantity(&current)
+		if req.Quantity != nil {
+			quantity = *req.Quantity
+		}
+		body, err := xenditRecurringBody(req.Plan, quantity)
+		if err != nil {
+			return nil, err
+		}
+		update.Amount = body.Amount
+		update.Currency = body.Currency
+		update.Items = body.Items
+		update.Description = body.Description
+	}
+	if req.PaymentMethodID != nil {
+		update.PaymentMethods = []xenditRecurringPaymentMethod{{PaymentMethodID: *req.PaymentMethodID, Rank: 1}}
+	}
+	if req.Metadata != nil || req.PlanID != nil || req.Quantity != nil {
+		var metadata interface{} = current.Metadata
+		if req.Metadata != nil {
+			metadata = req.Metadata
+		}
+		update.Metadata = xenditSubscriptionMetadata(metadata)
+		for _, key := range []string{xenditPlanIDKey, xenditQuantityKey} {
+			if value, ok := current.Metadata[key]; ok {
+				update.Metadata[key] = value
+			}
+		}
+		if req.PlanID != nil {
+			update.Metadata[xenditPlanIDKey] = *req.PlanID
+		}
+		if req.Quantity != nil {
+			update.Metadata[xenditQuantityKey] = *req.Quantity
+		}
+	}
+
+	var updated xenditRecurringPlan
+	if err := p.recurringCall(ctx, http.MethodPatch, "/recurring/plans/"+url.PathEscape(subscriptionID), update, &updated); err != nil {
+		return nil, err
+	}
+
+	if req.PlanID != nil && req.Plan != nil && current.Schedule != nil {
+		interval, ok := xenditIntervals[req.Plan.BillingPeriod]
+		if !ok {
+			return nil, fmt.Errorf("xendit: %w: %q", models.ErrInvalidBillingPeriod, req.Plan.BillingPeriod)
+		}
+		if interval.Interval != current.Schedule.Interval || interval.Count != current.Schedule.IntervalCount {
+			schedule := &xenditRecurringSchedule{Interval: interval.Interval, IntervalCount: interval.Count}
+			if err := p.recurringCall(ctx, http.MethodPatch, "/recurring/schedules/"+url.PathEscape(current.Schedule.ID), schedule, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return mapXenditRecurringPlan(&updated), nil
+}
+
+// CancelSubscription deactivates the Xendit recurring plan. Xendit cannot
+// defer this to the end of the period.
+func (p *XenditProvider) CancelSubscription(ctx context.Context, subscriptionID string, req *models.CancelSubscriptionRequest) (*models.Subscription, error) {
+	if req.CancelAtPeriodEnd {
+		return nil, fmt.Errorf("xendit: %w: recurring plans can only be canceled immediately", ErrOperationNotSupported)
+	}
+
+	var plan xenditRecurringPlan
+	if err := p.recurringCall(ctx, http.MethodPost, "/recurring/plans/"+url.PathEscape(subscriptionID)+"/deactivate", nil, &plan); err != nil {
+		return nil, err
+	}
+	return mapXenditRecurringPlan(&plan), nil
+}
+
+// PauseSubscription is not supported: a deactivated Xendit recurring plan
+// cannot be reactivated
+func (p *XenditProvider) PauseSubscription(ctx context.Context, subscriptionID string, req *models.PauseSubscriptionRequest) (*models.Subscription, error) {
+	return nil, fmt.Errorf("xendit: %w: recurring plans cannot be paused", ErrOperationNotSupported)
+}
+
+func (p *XenditProvider) ResumeSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	return nil, fmt.Errorf("xendit: %w: recurring plans cannot be paused", ErrOperationNotSupported)
+}
+
+func (p *XenditProvider) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	var plan xenditRecurringPlan
+	if err := p.recurringCall(ctx, http.MethodGet, "/recurring/plans/"+url.PathEscape(subscriptionID), nil, &plan); err != nil {
+		return nil, err
+	}
+	return mapXenditRecurringPlan(&plan), nil
+}
+
+func (p *XenditProvider) ListSubscriptions(ctx context.Context, customerID string) ([]*models.Subscription, error) {
+	return nil, fmt.Errorf("xendit: %w: recurring plans cannot be listed by customer", ErrOperationNotSupported)
+}
+
+// xenditRecurringBody prices a recurring plan as one item of quantity units.
+// A fixed plan costs the same whatever the quantity, so its item is a
+// single unit.
+func xenditRecurringBody(plan *models.Plan, quantity int) (*xenditRecurringPlan, error) {
+	if err := xenditCheckPlan(plan); err != nil {
+		return nil, err
+	}
+	if plan.PricingType != models.PricingTypePerUnit {
+		quantity = 1
+	}
+	unit, currency, err := xenditAmount(plan.Price())
+	if err != nil {
+		return nil, err
+	}
+	total, err := plan.Price().Mul(int64(quantity))
+	if err != nil {
+		return nil, err
+	}
+	amount, _, err := xenditAmount(total)
+	if err != nil {
+		return nil, err
+	}
+
+	return &xenditRecurringPlan{
+		Currency:    currency,
+		Amount:      amount,
+		Description: plan.Name,
+		Items: []xenditRecurringItem{{
+			Type:          "DIGITAL_SERVICE",
+			Name:          plan.Name,
+			NetUnitAmount: unit,
+			Quantity:      quantity,
+		}},
+	}, nil
+}
+
+// xenditQuantity reads the subscription quantity back from a plan. The
+// item of a fixed plan always has a quantity of one, so the quantity is
+// kept in the metadata as well.
+func xenditQuantity(plan *xenditRecurringPlan) int {
+	if quantity, ok := plan.Metadata[xenditQuantityKey].(float64); ok && quantity >= 1 {
+		return int(quantity)
+	}
+	if len(plan.Items) == 1 && plan.Items[0].Quantity > 0 {
+		return plan.Items[0].Quantity
+	}
+	return 1
+}
+
+// mapXenditRecurringPlan maps a Xendit recurring plan onto a subscription.
+// Xendit does not report billing periods, so those are left unset.
+func mapXenditRecurringPlan(plan *xenditRecurringPlan) *models.Subscription {
+	subscription := &models.Subscription{
+		CustomerID:             plan.CustomerID,
+		Status:                 mapXenditPlanStatus(plan.Status),
+		Quantity:               xenditQuantity(plan),
+		ProviderName:           "xendit",
+		ProviderSubscriptionID: plan.ID,
+	}
+	if planID, ok := plan.Metadata[xenditPlanIDKey].(string); ok {
+		subscription.PlanID = planID
+	}
+	for _, method := range plan.PaymentMethods {
+		if method.Rank == 1 {
+			subscription.PaymentMethodID = method.PaymentMethodID
+		}
+	}
+	// A plan created without an immediate charge is in its trial until the
+	// schedule starts
+	if subscription.Status == models.SubscriptionStatusActive && plan.ImmediateActionType == "" &&
+		plan.Schedule != nil && plan.Schedule.AnchorDate != nil && time.Now().Before(*plan.Schedule.AnchorDate) {
+		subscription.Status = models.SubscriptionStatusTrialing
+		subscription.TrialStart = plan.Created
+		subscription.TrialEnd = plan.Schedule.AnchorDate
+	}
+	if subscription.Status == models.SubscriptionStatusCanceled {
+		canceledAt := time.Now()
+		subscription.CanceledAt = &canceledAt
+	}
+	return subscription
+}
+
+func mapXenditPlanStatus(status string) models.SubscriptionStatus {
+	switch status {
+	case "ACTIVE":
+		return models.SubscriptionStatusActive
+	case "INACTIVE":
+		return models.SubscriptionStatusCanceled
+	default:
+		// PENDING and REQUIRES_ACTION wait for the payment method to be linked
+		return models.SubscriptionStatusPastDue
+	}
+}
+
+// mapXenditCycleStatus returns an empty status for cycles that have not been
+// charged yet
+func mapXenditCycleStatus(status string) models.SubscriptionStatus {
+	switch status {
+	case "SUCCEEDED":
+		return models.SubscriptionStatusActive
+	case "RETRYING", "FAILED":
+		return models.SubscriptionStatusPastDue
+	}
+	return ""
+}
+
+// xenditSubscriptionMetadata copies subscription metadata into the map
+// Xendit stores
+func xenditSubscriptionMetadata(metadata interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	var values map[string]interface{}
+	switch m := metadata.(type) {
+	case map[string]interface{}:
+		values = m
+	case models.JSON:
+		values = m
+	}
+	for k, v := range values {
+		result[k] = v
+	}
+	return result
+}
+
+// recurringCall sends a Recurring API request and decodes the response into
+// out. Errors are returned as the SDK's XenditSdkError so that they are
+// classified like those of the other Xendit calls.
+func (p *XenditProvider) recurringCall(ctx context.Context, method, path string, body, out interface{}) error {
+	basePath, err := p.client.GetConfig().ServerURLWithContext(ctx, "RecurringApiService")
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"Accept": "application/json"}
+	if body != nil {
+		headers["Content-Type"] = "application/json"
+	}
+	if key := IdempotencyKey(ctx, method+" "+path); key != "" && method != http.MethodGet {
+		headers["Idempotency-key"] = key
+	}
+
+	req, err := p.client.PrepareRequest(ctx, basePath+path, method, body, headers, url.Values{}, url.Values{}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.CallAPI(req)
+	if err != nil {
+		return err
+	}
+	payload, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return common.NewXenditSdkError(&payload, strconv.Itoa(resp.StatusCode), resp.Status)
+	}
+	if out == nil || len(bytes.TrimSpace(payload)) == 0 {
+		return nil
+	}
+	return p.client.Decode(out, payload, resp.Header.Get("Content-Type"))
+}
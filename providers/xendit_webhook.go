@@ -0,0 +1,232 @@
+package providers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+)
+
+// xenditInvoiceCallback holds the invoice callback fields we act on
+type xenditInvoiceCallback struct {
+	ID         string   `json:"id"`
+	ExternalID string   `json:"external_id"`
+	Status     string   `json:"status"`
+	Amount     float64  `json:"amount"`
+	PaidAmount *float64 `json:"paid_amount,omitempty"`
+	Currency   string   `json:"currency"`
+}
+
+// xenditRefundCallback holds the refund callback fields we act on
+type xenditRefundCallback struct {
+	Event string `json:"event"`
+	Data  struct {
+		ID        string  `json:"id"`
+		PaymentID string  `json:"payment_id"`
+		InvoiceID string  `json:"invoice_id"`
+		Amount    float64 `json:"amount"`
+		Currency  string  `json:"currency"`
+		Status    string  `json:"status"`
+		Reason    string  `json:"reason"`
+	} `json:"data"`
+}
+
+// xenditRecurringCallback holds the fields we act on from recurring plan and
+// cycle callbacks. Plan callbacks carry the plan, so its ID is in ID; cycle
+// callbacks carry the cycle and reference the plan in PlanID.
+type xenditRecurringCallback struct {
+	Event string `json:"event"`
+	Data  struct {
+		ID                 string    `json:"id"`
+		PlanID             string    `json:"plan_id"`
+		Status             string    `json:"status"`
+		CycleNumber        int       `json:"cycle_number"`
+		AttemptCount       int       `json:"attempt_count"`
+		ScheduledTimestamp time.Time `json:"scheduled_timestamp"`
+		Currency           string    `json:"currency"`
+		Amount             float64   `json:"amount"`
+		AttemptDetails     []struct {
+			ActionID    string `json:"action_id"`
+			Status      string `json:"status"`
+			FailureCode string `json:"failure_code"`
+		} `json:"attempt_details"`
+	} `json:"data"`
+}
+
+// ValidateCallbackToken checks the x-callback-token header against the
+// verification token from the Xendit dashboard.
+func (p *XenditProvider) ValidateCallbackToken(token string) error {
+	if p.callbackToken == "" {
+		return fmt.Errorf("%w: xendit callback token is not configured", ErrInvalidWebhookSignature)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.callbackToken)) != 1 {
+		return fmt.Errorf("%w: callback token mismatch", ErrInvalidWebhookSignature)
+	}
+	return nil
+}
+
+// ParseWebhook verifies a callback and maps it onto the payment created for
+// an invoice, a refund, or a subscription billed by a recurring plan.
+func (p *XenditProvider) ParseWebhook(payload []byte, header http.Header) (*WebhookEvent, error) {
+	if err := p.ValidateCallbackToken(header.Get("x-callback-token")); err != nil {
+		return nil, err
+	}
+
+	// Refund and recurring callbacks are wrapped in an event envelope; invoice callbacks are not
+	var envelope struct {
+		Event string `json:"event"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err == nil {
+		switch {
+		case strings.HasPrefix(envelope.Event, "refund."):
+			return p.parseRefundCallback(payload)
+		case strings.HasPrefix(envelope.Event, "recurring."):
+			return p.parseRecurringCallback(payload)
+		}
+	}
+
+	var callback xenditInvoiceCallback
+	if err := json.Unmarshal(payload, &callback); err != nil {
+		return nil, fmt.Errorf("xendit: invalid callback payload: %w", err)
+	}
+	if callback.ID == "" || callback.Status == "" {
+		return nil, fmt.Errorf("xendit: callback is missing invoice id or status")
+	}
+
+	status := strings.ToUpper(callback.Status)
+	event := &WebhookEvent{
+		// Invoice callbacks carry no event ID; an invoice reaches each status once
+		ID:       callback.ID + ":" + status,
+		Provider: p.Name(),
+		Type:     "invoice." + strings.ToLower(status),
+	}
+
+	update := &PaymentUpdate{
+		ProviderChargeIDs: []string{callback.ID},
+		ProviderStatus:    status,
+	}
+	update.Status = mapXenditInvoiceStatus(status)
+	event.Payment = update
+
+	return event, nil
+}
+
+func (p *XenditProvider) parseRefundCallback(payload []byte) (*WebhookEvent, error) {
+	var callback xenditRefundCallback
+	if err := json.Unmarshal(payload, &callback); err != nil {
+		return nil, fmt.Errorf("xendit: invalid refund callback payload: %w", err)
+	}
+	if callback.Data.ID == "" || callback.Data.Status == "" {
+		return nil, fmt.Errorf("xendit: refund callback is missing refund id or status")
+	}
+
+	amount, err := xenditMoney(callback.Data.Amount, callback.Data.Currency)
+	if err != nil {
+		return nil, fmt.Errorf("xendit: invalid refund callback amount: %w", err)
+	}
+
+	status := strings.ToLower(callback.Data.Status)
+	event := &WebhookEvent{
+		ID:       callback.Data.ID + ":" + strings.ToUpper(status),
+		Provider: p.Name(),
+		Type:     callback.Event,
+	}
+
+	var chargeIDs []string
+	for _, id := range []string{callback.Data.InvoiceID, callback.Data.PaymentID} {
+		if id != "" {
+			chargeIDs = append(chargeIDs, id)
+		}
+	}
+	event.Payment = &PaymentUpdate{ProviderChargeIDs: chargeIDs}
+	event.Refunds = []*models.Refund{{
+		Amount:           amount.Amount,
+		Reason:           callback.Data.Reason,
+		Status:           status,
+		ProviderName:     "xendit",
+		ProviderRefundID: callback.Data.ID,
+	}}
+	return event, nil
+}
+
+// parseRecurringCallback maps plan activation and deactivation onto the
+// subscription status, and cycle outcomes onto renewal charges. Cycles that
+// were only created or scheduled are returned without data.
+func (p *XenditProvider) parseRecurringCallback(payload []byte) (*WebhookEvent, error) {
+	var callback xenditRecurringCallback
+	if err := json.Unmarshal(payload, &callback); err != nil {
+		return nil, fmt.Errorf("xendit: invalid recurring callback payload: %w", err)
+	}
+	if callback.Data.ID == "" {
+		return nil, fmt.Errorf("xendit: recurring callback is missing its id")
+	}
+
+	event := &WebhookEvent{
+		ID:       callback.Data.ID + ":" + callback.Event,
+		Provider: p.Name(),
+		Type:     callback.Event,
+	}
+
+	switch callback.Event {
+	case "recurring.plan.activated", "recurring.plan.inactivated":
+		event.SubscriptionUpdate = &SubscriptionUpdate{
+			ProviderSubscriptionID: callback.Data.ID,
+			Status:                 mapXenditPlanStatus(strings.ToUpper(callback.Data.Status)),
+		}
+
+	case "recurring.cycle.succeeded", "recurring.cycle.retrying", "recurring.cycle.failed":
+		if callback.Data.PlanID == "" {
+			return nil, fmt.Errorf("xendit: recurring cycle callback is missing its plan id")
+		}
+		// A cycle is retried several times, each with its own callback
+		event.ID += ":" + strconv.Itoa(callback.Data.AttemptCount)
+
+		status := strings.ToUpper(callback.Data.Status)
+		update := &SubscriptionUpdate{
+			ProviderSubscriptionID: callback.Data.PlanID,
+			Status:                 mapXenditCycleStatus(status),
+			PaymentEvent:           models.SubscriptionEventPaymentFailed,
+			PeriodStart:            callback.Data.ScheduledTimestamp,
+			Attempt:                callback.Data.AttemptCount,
+			Data: models.JSON{
+				"provider_cycle_id": callback.Data.ID,
+				"cycle_number":      callback.Data.CycleNumber,
+				"attempt":           callback.Data.AttemptCount,
+				"provider_status":   status,
+			},
+		}
+		if update.Status == models.SubscriptionStatusActive {
+			update.PaymentEvent = models.SubscriptionEventPaymentSucceeded
+		}
+		if amount, err := xenditMoney(callback.Data.Amount, callback.Data.Currency); err == nil {
+			update.Data["amount"] = amount.Amount
+			update.Data["currency"] = amount.Currency
+		}
+		if n := len(callback.Data.AttemptDetails); n > 0 {
+			last := callback.Data.AttemptDetails[n-1]
+			update.Data["provider_payment_id"] = last.ActionID
+			if last.FailureCode != "" {
+				update.Data["code"] = last.FailureCode
+			}
+		}
+		event.SubscriptionUpdate = update
+	}
+
+	return event, nil
+}
+
+// mapXenditInvoiceStatus returns an empty status while the invoice is unpaid
+func mapXenditInvoiceStatus(status string) models.PaymentStatus {
+	switch strings.ToUpper(status) {
+	case "PAID", "SETTLED":
+		return models.PaymentStatusSuccess
+	case "EXPIRED", "FAILED":
+		return models.PaymentStatusFailed
+	}
+	return ""
+}
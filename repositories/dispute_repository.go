@@ -3,15 +3,15 @@ package repositories
 import (
 	"context"
 
+	"github.com/malwarebo/gopay/db"
 	"github.com/malwarebo/gopay/models"
-	"gorm.io/gorm"
 )
 
 type DisputeRepository struct {
-	db *gorm.DB
+	db *db.DB
 }
 
-func NewDisputeRepository(db *gorm.DB) *DisputeRepository {
+func NewDisputeRepository(db *db.DB) *DisputeRepository {
 	return &DisputeRepository{db: db}
 }
 
@@ -28,6 +28,15 @@ func (r *DisputeRepository) GetByID(ctx context.Context, id string) (*models.Dis
 	return &dispute, nil
 }
 
+func (r *DisputeRepository) GetByProviderDisputeID(ctx context.Context, providerDisputeID string) (*models.Dispute, error) {
+	var dispute models.Dispute
+	err := r.db.WithContext(ctx).First(&dispute, "provider_dispute_id = ?", providerDisputeID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
 func (r *DisputeRepository) Update(ctx context.Context, dispute *models.Dispute) error {
 	return r.db.WithContext(ctx).Save(dispute).Error
 }
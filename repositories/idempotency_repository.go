@@ -0,0 +1,66 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"github.com/malwarebo/gopay/db"
+	"github.com/malwarebo/gopay/models"
+	"gorm.io/gorm/clause"
+)
+
+type IdempotencyRepository struct {
+	db *db.DB
+}
+
+func NewIdempotencyRepository(db *db.DB) *IdempotencyRepository {
+	return &IdempotencyRepository{db: db}
+}
+
+// Create inserts the key unless one already exists for the endpoint.
+// It reports whether this call created the record.
+func (r *IdempotencyRepository) Create(ctx context.Context, key *models.IdempotencyKey) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}, {Name: "endpoint"}},
+			DoNothing: true,
+		}).
+		Create(key)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *IdempotencyRepository) Get(ctx context.Context, key, endpoint string) (*models.IdempotencyKey, error) {
+	var record models.IdempotencyKey
+	if err := r.db.WithContext(ctx).First(&record, "key = ? AND endpoint = ?", key, endpoint).Error; err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Reclaim takes over an in-progress key whose lock has expired, e.g. after the
+// instance handling the first request crashed. It reports whether it succeeded.
+func (r *IdempotencyRepository) Reclaim(ctx context.Context, record *models.IdempotencyKey, lockedUntil time.Time) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.IdempotencyKey{}).
+		Where("id = ? AND status = ? AND locked_until < ?", record.ID, models.IdempotencyStatusInProgress, time.Now()).
+		Update("locked_until", lockedUntil)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *IdempotencyRepository) Complete(ctx context.Context, record *models.IdempotencyKey) error {
+	return r.db.WithContext(ctx).Model(record).Updates(map[string]interface{}{
+		"status":                record.Status,
+		"response_code":         record.ResponseCode,
+		"response_content_type": record.ResponseContentType,
+		"response_body":         record.ResponseBody,
+	}).Error
+}
+
+func (r *IdempotencyRepository) Delete(ctx context.Context, id string) error {
+	return r.db.WithContext(ctx).Delete(&models.IdempotencyKey{}, "id = ?", id).Error
+}
@@ -0,0 +1,71 @@
+package repositories
+
+import (
+	"context"
+
+	"github.com/malwarebo/gopay/db"
+	"github.com/malwarebo/gopay/models"
+)
+
+// OwnershipRepository resolves which provider created a stored record so that
+// follow-up operations are sent back to the same provider.
+type OwnershipRepository struct {
+	db *db.DB
+}
+
+func NewOwnershipRepository(db *db.DB) *OwnershipRepository {
+	return &OwnershipRepository{db: db}
+}
+
+// PaymentOwner accepts either our payment ID or the provider's charge ID
+func (r *OwnershipRepository) PaymentOwner(ctx context.Context, paymentID string) (string, error) {
+	var payment models.Payment
+	err := r.db.WithContext(ctx).Select("provider_name").
+		Where("id::text = ? OR provider_charge_id = ?", paymentID, paymentID).
+		Take(&payment).Error
+	if err != nil {
+		return "", err
+	}
+	return payment.ProviderName, nil
+}
+
+// SubscriptionOwner accepts either our subscription ID or the provider's
+func (r *OwnershipRepository) SubscriptionOwner(ctx context.Context, subscriptionID string) (string, error) {
+	var subscription models.Subscription
+	err := r.db.WithContext(ctx).Select("provider_name").
+		Where("id::text = ? OR provider_subscription_id = ?", subscriptionID, subscriptionID).
+		Take(&subscription).Error
+	if err != nil {
+		return "", err
+	}
+	return subscription.ProviderName, nil
+}
+
+// PlanOwner accepts either our plan ID or the provider's
+func (r *OwnershipRepository) PlanOwner(ctx context.Context, planID string) (string, error) {
+	var plan models.Plan
+	err := r.db.WithContext(ctx).Select("provider_name").
+		Where("id::text = ? OR provider_plan_id = ?", planID, planID).
+		Take(&plan).Error
+	if err != nil {
+		return "", err
+	}
+	return plan.ProviderName, nil
+}
+
+// DisputeOwner falls back to the disputed payment when the dispute itself
+// was recorded without a provider.
+func (r *OwnershipRepository) DisputeOwner(ctx context.Context, disputeID string) (string, error) {
+	var owner string
+	err := r.db.WithContext(ctx).Raw(`
+		SELECT COALESCE(NULLIF(d.provider_name, ''), p.provider_name, '')
+		FROM disputes d
+		LEFT JOIN payments p ON p.id::text = d.transaction_id OR p.provider_charge_id = d.transaction_id
+		WHERE d.id::text = ?
+		LIMIT 1
+	`, disputeID).Row().Scan(&owner)
+	if err != nil {
+		return "", err
+	}
+	return owner, nil
+}
@@ -2,11 +2,22 @@ package repositories
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/malwarebo/gopay/db"
 	"github.com/malwarebo/gopay/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrStatusChanged is returned by Transition when the payment is no longer
+// in the status the change was made from
+var ErrStatusChanged = errors.New("payment status changed concurrently")
+
 type PaymentRepository struct {
 	db *db.DB
 }
@@ -19,8 +30,36 @@ func (r *PaymentRepository) Create(ctx context.Context, payment *models.Payment)
 	return r.db.WithContext(ctx).Create(payment).Error
 }
 
+// Update saves the payment row only; attempts and refunds are stored
+// separately and status changes go through Transition
 func (r *PaymentRepository) Update(ctx context.Context, payment *models.Payment) error {
-	return r.db.WithContext(ctx).Save(payment).Error
+	return r.db.WithContext(ctx).Omit(clause.Associations, "status").Save(payment).Error
+}
+
+// Transition saves a status change from event.FromStatus to payment.Status
+// together with its audit record. It fails with ErrStatusChanged, saving
+// nothing, if the stored status is no longer event.FromStatus.
+func (r *PaymentRepository) Transition(ctx context.Context, payment *models.Payment, event *models.PaymentEvent) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		event.PaymentID = payment.ID
+		event.ToStatus = payment.Status
+		result := tx.Model(payment).Where("status = ?", event.FromStatus).Update("status", payment.Status)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrStatusChanged
+		}
+		return tx.Create(event).Error
+	})
+}
+
+func (r *PaymentRepository) ListEvents(ctx context.Context, paymentID string) ([]*models.PaymentEvent, error) {
+	var events []*models.PaymentEvent
+	if err := r.db.WithContext(ctx).Where("payment_id = ?", paymentID).Order("created_at").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
 }
 
 func (r *PaymentRepository) GetByID(ctx context.Context, id string) (*models.Payment, error) {
@@ -31,6 +70,74 @@ func (r *PaymentRepository) GetByID(ctx context.Context, id string) (*models.Pay
 	return &payment, nil
 }
 
+// Search returns a page of payments matching filter using keyset pagination
+// on the sort column and ID, along with the cursor for the next page.
+func (r *PaymentRepository) Search(ctx context.Context, filter *models.PaymentFilter) (*models.PaymentPage, error) {
+	query := r.db.WithContext(ctx).Model(&models.Payment{})
+
+	if filter.CustomerID != "" {
+		query = query.Where("customer_id = ?", filter.CustomerID)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.ProviderName != "" {
+		query = query.Where("provider_name = ?", filter.ProviderName)
+	}
+	if filter.Currency != "" {
+		query = query.Where("UPPER(currency) = UPPER(?)", filter.Currency)
+	}
+	if filter.MinAmount != nil {
+		query = query.Where("amount >= ?", *filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		query = query.Where("amount <= ?", *filter.MaxAmount)
+	}
+	if filter.CreatedFrom != nil {
+		query = query.Where("created_at >= ?", *filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		query = query.Where("created_at < ?", *filter.CreatedTo)
+	}
+
+	column := models.PaymentSortCreatedAt
+	if filter.SortBy == models.PaymentSortAmount {
+		column = models.PaymentSortAmount
+	}
+	direction, op := "DESC", "<"
+	if filter.Ascending {
+		direction, op = "ASC", ">"
+	}
+
+	if filter.Cursor != "" {
+		cursor, err := decodePaymentCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{} = cursor.CreatedAt
+		if column == models.PaymentSortAmount {
+			value = cursor.Amount
+		}
+		query = query.Where(fmt.Sprintf("(%s, id) %s (?, ?)", column, op), value, cursor.ID)
+	}
+
+	var payments []*models.Payment
+	err := query.
+		Order(fmt.Sprintf("%s %s, id %s", column, direction, direction)).
+		Limit(filter.Limit + 1).
+		Find(&payments).Error
+	if err != nil {
+		return nil, err
+	}
+
+	page := &models.PaymentPage{Payments: payments}
+	if len(payments) > filter.Limit {
+		page.Payments = payments[:filter.Limit]
+		page.NextCursor = encodePaymentCursor(page.Payments[filter.Limit-1])
+	}
+	return page, nil
+}
+
 func (r *PaymentRepository) ListByCustomer(ctx context.Context, customerID string) ([]*models.Payment, error) {
 	var payments []*models.Payment
 	if err := r.db.WithContext(ctx).Preload("Refunds").Where("customer_id = ?", customerID).Find(&payments).Error; err != nil {
@@ -39,8 +146,133 @@ func (r *PaymentRepository) ListByCustomer(ctx context.Context, customerID strin
 	return payments, nil
 }
 
-func (r *PaymentRepository) CreateRefund(ctx context.Context, refund *models.Refund) error {
-	return r.db.WithContext(ctx).Create(refund).Error
+// GetByProviderChargeID finds the payment whose provider charge ID is any of ids
+func (r *PaymentRepository) GetByProviderChargeID(ctx context.Context, ids ...string) (*models.Payment, error) {
+	var payment models.Payment
+	if err := r.db.WithContext(ctx).First(&payment, "provider_charge_id IN ?", ids).Error; err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// ReserveRefund stores refund as pending while holding a row lock on its
+// payment. check is called under the lock with the payment and the amount
+// already refunded or in flight, so concurrent refunds cannot overdraw it.
+func (r *PaymentRepository) ReserveRefund(ctx context.Context, refund *models.Refund, check func(payment *models.Payment, reserved int64) error) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var payment models.Payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, "id = ?", refund.PaymentID).Error; err != nil {
+			return err
+		}
+
+		reserved, err := sumRefunds(tx, payment.ID, models.RefundStatusPending, models.RefundStatusSucceeded)
+		if err != nil {
+			return err
+		}
+		if err := check(&payment, reserved); err != nil {
+			return err
+		}
+		return tx.Create(refund).Error
+	})
+}
+
+// RefundedAmount sums the refunds of a payment that are in one of statuses
+func (r *PaymentRepository) RefundedAmount(ctx context.Context, paymentID string, statuses ...string) (int64, error) {
+	return sumRefunds(r.db.WithContext(ctx), paymentID, statuses...)
+}
+
+// RefundSummaries totals the refunds of each payment in paymentIDs. Payments
+// without refunds get an empty summary.
+func (r *PaymentRepository) RefundSummaries(ctx context.Context, paymentIDs ...string) (map[string]models.RefundSummary, error) {
+	summaries := make(map[string]models.RefundSummary, len(paymentIDs))
+	if len(paymentIDs) == 0 {
+		return summaries, nil
+	}
+
+	var rows []struct {
+		PaymentID      string
+		Count          int
+		RefundedAmount int64
+		PendingAmount  int64
+	}
+	err := r.db.WithContext(ctx).Model(&models.Refund{}).
+		Select("payment_id, COUNT(*) AS count, "+
+			"COALESCE(SUM(amount) FILTER (WHERE status = ?), 0) AS refunded_amount, "+
+			"COALESCE(SUM(amount) FILTER (WHERE status = ?), 0) AS pending_amount",
+			models.RefundStatusSucceeded, models.RefundStatusPending).
+		Where("payment_id IN ?", paymentIDs).
+		Group("payment_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range paymentIDs {
+		summaries[id] = models.RefundSummary{}
+	}
+	for _, row := range rows {
+		summaries[row.PaymentID] = models.RefundSummary{
+			Count:          row.Count,
+			RefundedAmount: row.RefundedAmount,
+			PendingAmount:  row.PendingAmount,
+		}
+	}
+	return summaries, nil
+}
+
+func sumRefunds(tx *gorm.DB, paymentID string, statuses ...string) (int64, error) {
+	var total int64
+	err := tx.Model(&models.Refund{}).
+		Select("COALESCE(SUM(amount), 0)").
+		Where("payment_id = ? AND status IN ?", paymentID, statuses).
+		Scan(&total).Error
+	return total, err
+}
+
+// UpsertProviderRefund stores a refund reported by a provider, or updates
+// the status of the refund already stored under its provider refund ID
+func (r *PaymentRepository) UpsertProviderRefund(ctx context.Context, refund *models.Refund) error {
+	return r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:     []clause.Column{{Name: "provider_refund_id"}},
+			TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "provider_refund_id <> ''"}}},
+			DoUpdates:   clause.AssignmentColumns([]string{"status", "updated_at"}),
+		}).
+		Create(refund).Error
+}
+
+// AttachProviderRefund saves a refund created through gopay once the provider
+// has assigned it an ID. A webhook for the refund may have arrived first and
+// stored it on its own; that copy is folded into this one, keeping its
+// status if this refund is still pending.
+func (r *PaymentRepository) AttachProviderRefund(ctx context.Context, refund *models.Refund) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if refund.ProviderRefundID != "" {
+			var stored []*models.Refund
+			err := tx.Clauses(clause.Returning{}).
+				Where("provider_refund_id = ? AND id <> ?", refund.ProviderRefundID, refund.ID).
+				Delete(&stored).Error
+			if err != nil {
+				return err
+			}
+			if len(stored) > 0 && refund.Status == models.RefundStatusPending {
+				refund.Status = stored[0].Status
+			}
+		}
+		return tx.Save(refund).Error
+	})
+}
+
+func (r *PaymentRepository) UpdateRefund(ctx context.Context, refund *models.Refund) error {
+	return r.db.WithContext(ctx).Save(refund).Error
+}
+
+func (r *PaymentRepository) GetRefundByProviderRefundID(ctx context.Context, providerRefundID string) (*models.Refund, error) {
+	var refund models.Refund
+	if err := r.db.WithContext(ctx).First(&refund, "provider_refund_id = ?", providerRefundID).Error; err != nil {
+		return nil, err
+	}
+	return &refund, nil
 }
 
 func (r *PaymentRepository) GetRefundByID(ctx context.Context, id string) (*models.Refund, error) {
@@ -53,8 +285,39 @@ func (r *PaymentRepository) GetRefundByID(ctx context.Context, id string) (*mode
 
 func (r *PaymentRepository) ListRefundsByPayment(ctx context.Context, paymentID string) ([]*models.Refund, error) {
 	var refunds []*models.Refund
-	if err := r.db.WithContext(ctx).Where("payment_id = ?", paymentID).Find(&refunds).Error; err != nil {
+	if err := r.db.WithContext(ctx).Where("payment_id = ?", paymentID).Order("created_at").Find(&refunds).Error; err != nil {
 		return nil, err
 	}
 	return refunds, nil
 }
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// paymentCursor holds the sort keys of the last payment on a page
+type paymentCursor struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Amount    int64     `json:"amount"`
+}
+
+func encodePaymentCursor(payment *models.Payment) string {
+	data, _ := json.Marshal(paymentCursor{
+		ID:        payment.ID,
+		CreatedAt: payment.CreatedAt,
+		Amount:    payment.Amount,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePaymentCursor(value string) (*paymentCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor paymentCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
@@ -2,11 +2,32 @@ package repositories
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/malwarebo/gopay/db"
 	"github.com/malwarebo/gopay/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var (
+	// ErrLeaseLost is returned when saving a leased subscription whose lease
+	// has expired and been taken by another worker.
+	ErrLeaseLost = errors.New("subscription lease lost")
+	// ErrSubscriptionChanged is returned when updating a subscription that a
+	// billing worker is renewing or that was changed since it was read
+	ErrSubscriptionChanged = errors.New("subscription is being renewed or was changed; retry the request")
+)
+
+// leasedColumns are the columns a billing worker changes when it renews or
+// resumes a subscription it holds
+var leasedColumns = []string{
+	"status", "current_period_start", "current_period_end", "billing_cycle_anchor", "canceled_at", "trial_end",
+	"balance", "latest_payment_id", "dunning_attempts", "next_retry_at", "pause_mode", "paused_at", "resume_at",
+	"lease_owner", "lease_expires_at", "version", "updated_at",
+}
+
 type SubscriptionRepository struct {
 	db *db.DB
 }
@@ -19,8 +40,38 @@ func (r *SubscriptionRepository) Create(ctx context.Context, subscription *model
 	return r.db.WithContext(ctx).Create(subscription).Error
 }
 
-func (r *SubscriptionRepository) Update(ctx context.Context, subscription *models.Subscription) error {
-	return r.db.WithContext(ctx).Save(subscription).Error
+// Update saves the subscription row, together with any events, in one
+// transaction. The renewal lease columns are left to the billing worker that
+// may hold them, and trial_ending_notified to MarkTrialsEnding. It fails
+// with ErrSubscriptionChanged, saving nothing, while a billing worker holds
+// the lease or if the row changed since subscription was read, since saving
+// it would undo those changes.
+func (r *SubscriptionRepository) Update(ctx context.Context, subscription *models.Subscription, events ...*models.SubscriptionEvent) error {
+	version := subscription.Version
+	subscription.Version++
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(subscription).
+			Where("version = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?)", version, time.Now()).
+			Select("*").Omit(clause.Associations, "created_at", "lease_owner", "lease_expires_at", "trial_ending_notified").
+			Updates(subscription)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrSubscriptionChanged
+		}
+		for _, event := range events {
+			event.SubscriptionID = subscription.ID
+			if err := tx.Create(event).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		subscription.Version = version
+	}
+	return err
 }
 
 func (r *SubscriptionRepository) GetByID(ctx context.Context, id string) (*models.Subscription, error) {
@@ -31,6 +82,14 @@ func (r *SubscriptionRepository) GetByID(ctx context.Context, id string) (*model
 	return &subscription, nil
 }
 
+func (r *SubscriptionRepository) GetByProviderSubscriptionID(ctx context.Context, providerSubscriptionID string) (*models.Subscription, error) {
+	var subscription models.Subscription
+	if err := r.db.WithContext(ctx).Preload("Plan").First(&subscription, "provider_subscription_id = ?", providerSubscriptionID).Error; err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
 func (r *SubscriptionRepository) ListByCustomer(ctx context.Context, customerID string) ([]*models.Subscription, error) {
 	var subscriptions []*models.Subscription
 	if err := r.db.WithContext(ctx).Preload("Plan").Where("customer_id = ?", customerID).Find(&subscriptions).Error; err != nil {
@@ -47,6 +106,144 @@ func (r *SubscriptionRepository) ListActive(ctx context.Context) ([]*models.Subs
 	return subscriptions, nil
 }
 
+// LeaseDue claims up to limit subscriptions in status whose current period
+// ended by now and that no other worker holds. Subscriptions billed by a
+// provider (those with a provider subscription ID) are never returned. SKIP
+// LOCKED lets workers on other replicas claim the next rows instead of
+// waiting on these.
+func (r *SubscriptionRepository) LeaseDue(ctx context.Context, status models.SubscriptionStatus, owner string, now time.Time, ttl time.Duration, limit int) ([]*models.Subscription, error) {
+	return r.lease(ctx, "current_period_end", status, owner, now, ttl, limit)
+}
+
+// LeaseRetries claims up to limit past_due subscriptions whose next dunning
+// retry is due, in the same way as LeaseDue.
+func (r *SubscriptionRepository) LeaseRetries(ctx context.Context, owner string, now time.Time, ttl time.Duration, limit int) ([]*models.Subscription, error) {
+	return r.lease(ctx, "next_retry_at", models.SubscriptionStatusPastDue, owner, now, ttl, limit)
+}
+
+// LeaseResumes claims up to limit subscriptions in status whose pause is due
+// to end, in the same way as LeaseDue.
+func (r *SubscriptionRepository) LeaseResumes(ctx context.Context, status models.SubscriptionStatus, owner string, now time.Time, ttl time.Duration, limit int) ([]*models.Subscription, error) {
+	return r.lease(ctx, "resume_at", status, owner, now, ttl, limit)
+}
+
+// lease claims subscriptions in status whose dueColumn is at or before now
+func (r *SubscriptionRepository) lease(ctx context.Context, dueColumn string, status models.SubscriptionStatus, owner string, now time.Time, ttl time.Duration, limit int) ([]*models.Subscription, error) {
+	var ids []string
+	err := r.db.WithContext(ctx).Raw(`
+		UPDATE subscriptions SET lease_owner = ?, lease_expires_at = ?
+		WHERE id IN (
+			SELECT id FROM subscriptions
+			WHERE status = ? AND `+dueColumn+` <= ?
+				AND COALESCE(provider_subscription_id, '') = ''
+				AND (lease_expires_at IS NULL OR lease_expires_at < ?)
+			ORDER BY `+dueColumn+`
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id
+	`, owner, now.Add(ttl), status, now, now, limit).Scan(&ids).Error
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	var subscriptions []*models.Subscription
+	err = r.db.WithContext(ctx).Preload("Plan").
+		Where("id IN ? AND lease_owner = ?", ids, owner).
+		Order(dueColumn).
+		Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// SaveLeased saves the renewal state of a subscription claimed with
+// LeaseDue, LeaseRetries or LeaseResumes together with its events and
+// releases the lease. Only leasedColumns are written. It fails with
+// ErrLeaseLost, saving nothing, if owner no longer holds the lease.
+func (r *SubscriptionRepository) SaveLeased(ctx context.Context, subscription *models.Subscription, owner string, events ...*models.SubscriptionEvent) error {
+	subscription.LeaseOwner = ""
+	subscription.LeaseExpiresAt = nil
+	subscription.Version++
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(subscription).
+			Where("lease_owner = ?", owner).
+			Select(leasedColumns).
+			Updates(subscription)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLeaseLost
+		}
+		for _, event := range events {
+			event.SubscriptionID = subscription.ID
+			if err := tx.Create(event).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MarkTrialsEnding records a trial_ending event for up to limit trialing
+// native subscriptions whose trial ends after now and by before and that
+// have none yet. The subscriptions are flagged in the same transaction, so
+// each trial gets one event however many workers run. It returns the
+// recorded events.
+func (r *SubscriptionRepository) MarkTrialsEnding(ctx context.Context, now, before time.Time, limit int) ([]*models.SubscriptionEvent, error) {
+	var events []*models.SubscriptionEvent
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var rows []struct {
+			ID       string
+			TrialEnd time.Time
+		}
+		err := tx.Raw(`
+			UPDATE subscriptions SET trial_ending_notified = true
+			WHERE id IN (
+				SELECT id FROM subscriptions
+				WHERE status = ? AND trial_end > ? AND trial_end <= ?
+					AND NOT trial_ending_notified
+					AND COALESCE(provider_subscription_id, '') = ''
+				ORDER BY trial_end
+				LIMIT ?
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, trial_end
+		`, models.SubscriptionStatusTrialing, now, before, limit).Scan(&rows).Error
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			event := &models.SubscriptionEvent{
+				SubscriptionID: row.ID,
+				Type:           models.SubscriptionEventTrialEnding,
+				Data:           models.JSON{"trial_end": row.TrialEnd.UTC().Format(time.RFC3339)},
+			}
+			if err := tx.Create(event).Error; err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ListEvents returns the events of a subscription, oldest first
+func (r *SubscriptionRepository) ListEvents(ctx context.Context, subscriptionID string) ([]*models.SubscriptionEvent, error) {
+	var events []*models.SubscriptionEvent
+	if err := r.db.WithContext(ctx).Where("subscription_id = ?", subscriptionID).Order("created_at").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
 func (r *SubscriptionRepository) Delete(ctx context.Context, id string) error {
 	return r.db.WithContext(ctx).Delete(&models.Subscription{}, "id = ?", id).Error
 }
@@ -0,0 +1,84 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/malwarebo/gopay/db"
+	"github.com/malwarebo/gopay/models"
+	"gorm.io/gorm/clause"
+)
+
+type UsageRepository struct {
+	db *db.DB
+}
+
+func NewUsageRepository(db *db.DB) *UsageRepository {
+	return &UsageRepository{db: db}
+}
+
+// Create inserts the record unless the subscription already has one with
+// the same idempotency key. It reports whether this call created the record.
+func (r *UsageRepository) Create(ctx context.Context, record *models.UsageRecord) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "subscription_id"}, {Name: "idempotency_key"}},
+			DoNothing: true,
+		}).
+		Create(record)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *UsageRepository) GetByIdempotencyKey(ctx context.Context, subscriptionID, key string) (*models.UsageRecord, error) {
+	var record models.UsageRecord
+	if err := r.db.WithContext(ctx).First(&record, "subscription_id = ? AND idempotency_key = ?", subscriptionID, key).Error; err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// List returns the records of a subscription timestamped in [from, to),
+// oldest first
+func (r *UsageRepository) List(ctx context.Context, subscriptionID string, from, to time.Time) ([]*models.UsageRecord, error) {
+	var records []*models.UsageRecord
+	err := r.db.WithContext(ctx).
+		Where("subscription_id = ? AND timestamp >= ? AND timestamp < ?", subscriptionID, from, to).
+		Order("timestamp, created_at").
+		Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Aggregate combines the quantities of the records timestamped in [from, to)
+// the way aggregation says. A period without records aggregates to zero.
+func (r *UsageRepository) Aggregate(ctx context.Context, subscriptionID string, aggregation models.UsageAggregation, from, to time.Time) (int64, error) {
+	query := r.db.WithContext(ctx).Model(&models.UsageRecord{}).
+		Where("subscription_id = ? AND timestamp >= ? AND timestamp < ?", subscriptionID, from, to)
+
+	var quantity int64
+	var err error
+	switch aggregation {
+	case models.UsageAggregationSum:
+		err = query.Select("COALESCE(SUM(quantity), 0)").Scan(&quantity).Error
+	case models.UsageAggregationMax:
+		err = query.Select("COALESCE(MAX(quantity), 0)").Scan(&quantity).Error
+	case models.UsageAggregationLast:
+		var quantities []int64
+		err = query.Order("timestamp DESC, created_at DESC").Limit(1).Pluck("quantity", &quantities).Error
+		if len(quantities) > 0 {
+			quantity = quantities[0]
+		}
+	default:
+		err = fmt.Errorf("unknown usage aggregation %q", aggregation)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return quantity, nil
+}
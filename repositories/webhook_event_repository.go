@@ -0,0 +1,41 @@
+package repositories
+
+import (
+	"context"
+
+	"github.com/malwarebo/gopay/db"
+	"github.com/malwarebo/gopay/models"
+	"gorm.io/gorm/clause"
+)
+
+type WebhookEventRepository struct {
+	db *db.DB
+}
+
+func NewWebhookEventRepository(db *db.DB) *WebhookEventRepository {
+	return &WebhookEventRepository{db: db}
+}
+
+// RecordOnce records the event and runs apply in the same transaction, so
+// the event is applied exactly once however many deliveries of it arrive at
+// the same time. A concurrent delivery waits on the event's unique key until
+// the first commits. applied is false when the event was already recorded.
+func (r *WebhookEventRepository) RecordOnce(ctx context.Context, event *models.WebhookEvent, apply func(ctx context.Context) error) (applied bool, err error) {
+	err = r.db.InTransaction(ctx, func(ctx context.Context) error {
+		result := r.db.WithContext(ctx).
+			Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "provider_name"}, {Name: "event_id"}},
+				DoNothing: true,
+			}).
+			Create(event)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		applied = true
+		return apply(ctx)
+	})
+	if err != nil {
+		return false, err
+	}
+	return applied, nil
+}
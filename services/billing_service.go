@@ -0,0 +1,465 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/malwarebo/gopay/config"
+	"github.com/malwarebo/gopay/models"
+	"github.com/malwarebo/gopay/providers"
+	"github.com/malwarebo/gopay/repositories"
+)
+
+// BillingService renews subscriptions whose current period has ended by
+// charging the stored payment method through the payment service. Every
+// replica runs it; subscriptions are leased in the database so that each
+// renewal is handled by exactly one worker. Failed renewals are retried on
+// the dunning schedule before the plan's final dunning action is applied.
+type BillingService struct {
+	subRepo   *repositories.SubscriptionRepository
+	usageRepo *repositories.UsageRepository
+	payments  *PaymentService
+	cfg       config.BillingConfig
+	workerID  string
+	now       func() time.Time
+}
+
+func NewBillingService(subRepo *repositories.SubscriptionRepository, usageRepo *repositories.UsageRepository, payments *PaymentService, cfg config.BillingConfig) *BillingService {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return &BillingService{
+		subRepo:   subRepo,
+		usageRepo: usageRepo,
+		payments:  payments,
+		cfg:       cfg,
+		workerID:  hostname + ":" + strconv.Itoa(os.Getpid()) + ":" + hex.EncodeToString(suffix),
+		now:       time.Now,
+	}
+}
+
+// Run records trial_ending events and renews due subscriptions on every tick
+// until ctx is canceled
+func (s *BillingService) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.cfg.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.NotifyTrialsEnding(ctx); err != nil {
+				log.Printf("Trial ending notices: %v", err)
+			}
+			if _, err := s.RenewDue(ctx); err != nil {
+				log.Printf("Subscription renewal: %v", err)
+			}
+		}
+	}
+}
+
+// NotifyTrialsEnding records a trial_ending event for every native trial
+// that ends within billing.trial_ending_days and has none yet. It returns how
+// many were recorded.
+func (s *BillingService) NotifyTrialsEnding(ctx context.Context) (int, error) {
+	notified := 0
+	for ctx.Err() == nil {
+		now := s.now()
+		events, err := s.subRepo.MarkTrialsEnding(ctx, now, now.AddDate(0, 0, s.cfg.TrialEndingDays), s.cfg.BatchSize)
+		if err != nil {
+			return notified, fmt.Errorf("failed to record trial ending events: %w", err)
+		}
+		if len(events) == 0 {
+			return notified, nil
+		}
+		notified += len(events)
+	}
+	return notified, ctx.Err()
+}
+
+// RenewDue first resumes the subscriptions whose pause is due to end. It
+// then leases batches of due subscriptions and trials that have ended and
+// renews them until none are left, and does the same for past_due
+// subscriptions whose dunning retry is due. It returns how many were
+// processed.
+func (s *BillingService) RenewDue(ctx context.Context) (int, error) {
+	lease := time.Duration(s.cfg.LeaseSeconds) * time.Second
+	processed := 0
+	for _, status := range []models.SubscriptionStatus{models.SubscriptionStatusPaused, models.SubscriptionStatusActive, models.SubscriptionStatusTrialing} {
+		resumed, err := s.drain(ctx, "resume", s.resume, func() ([]*models.Subscription, error) {
+			return s.subRepo.LeaseResumes(ctx, status, s.workerID, s.now(), lease, s.cfg.BatchSize)
+		})
+		processed += resumed
+		if err != nil {
+			return processed, fmt.Errorf("failed to lease %s subscriptions to resume: %w", status, err)
+		}
+	}
+	for _, status := range []models.SubscriptionStatus{models.SubscriptionStatusActive, models.SubscriptionStatusTrialing} {
+		renewed, err := s.drain(ctx, "renewal", s.renew, func() ([]*models.Subscription, error) {
+			return s.subRepo.LeaseDue(ctx, status, s.workerID, s.now(), lease, s.cfg.BatchSize)
+		})
+		processed += renewed
+		if err != nil {
+			return processed, fmt.Errorf("failed to lease due %s subscriptions: %w", status, err)
+		}
+	}
+	retried, err := s.drain(ctx, "renewal", s.renew, func() ([]*models.Subscription, error) {
+		return s.subRepo.LeaseRetries(ctx, s.workerID, s.now(), lease, s.cfg.BatchSize)
+	})
+	if err != nil {
+		return processed + retried, fmt.Errorf("failed to lease subscriptions to retry: %w", err)
+	}
+	return processed + retried, nil
+}
+
+// drain leases batches with next and hands each subscription to process
+// until none are left
+func (s *BillingService) drain(ctx context.Context, label string, process func(context.Context, *models.Subscription) error, next func() ([]*models.Subscription, error)) (int, error) {
+	processed := 0
+	for ctx.Err() == nil {
+		due, err := next()
+		if err != nil {
+			return processed, err
+		}
+		if len(due) == 0 {
+			return processed, nil
+		}
+		for _, subscription := range due {
+			if err := process(ctx, subscription); err != nil {
+				// The lease expires on its own and the subscription is retried then
+				log.Printf("Subscription %s: %s failed: %v", subscription.ID, label, err)
+			}
+			processed++
+		}
+	}
+	return processed, ctx.Err()
+}
+
+// resume ends the pause of a leased subscription whose resume_at has passed
+func (s *BillingService) resume(ctx context.Context, subscription *models.Subscription) error {
+	resumeSubscription(subscription, s.now())
+	return s.subRepo.SaveLeased(ctx, subscription, s.workerID, &models.SubscriptionEvent{
+		Type: models.SubscriptionEventResumed,
+		Data: models.JSON{"automatic": true},
+	})
+}
+
+// renew charges one period of a leased subscription. Licensed plans are
+// charged in advance for the next period and metered plans in arrears for the
+// usage of the period that ended; either way the subscription's balance is
+// added. A successful charge moves the subscription into the next period; a
+// failed one leaves the period unchanged and hands the subscription to
+// dunning. A trial, which is the first period of a native subscription that
+// has one, is free and converts in the same way at its end. While payment
+// collection is paused, periods go by without being charged.
+func (s *BillingService) renew(ctx context.Context, subscription *models.Subscription) error {
+	plan := subscription.Plan
+	if plan == nil {
+		return ErrPlanNotFound
+	}
+	if subscription.CurrentPeriodEnd.IsZero() {
+		return fmt.Errorf("subscription has no current period")
+	}
+
+	// Every outcome of a trial's conversion is recorded with the status the
+	// subscription ends up in
+	trialing := subscription.Status == models.SubscriptionStatusTrialing
+	save := func(events ...*models.SubscriptionEvent) error {
+		if trialing {
+			events = append(events, &models.SubscriptionEvent{
+				Type: models.SubscriptionEventTrialEnded,
+				Data: models.JSON{"status": string(subscription.Status)},
+			})
+		}
+		return s.subRepo.SaveLeased(ctx, subscription, s.workerID, events...)
+	}
+
+	periodStart := subscription.CurrentPeriodEnd
+	periodEnd, err := plan.BillingPeriod.Advance(periodStart, billingCycleAnchor(subscription))
+	if err != nil {
+		return err
+	}
+
+	if subscription.PauseMode == models.PauseModeCollection {
+		// The usage of the period, if any, is forgiven and the balance waits
+		// for the pause to end
+		if subscription.CancelAtPeriodEnd {
+			cancelAtPeriodEnd(subscription)
+			return save()
+		}
+		subscription.CurrentPeriodStart = periodStart
+		subscription.CurrentPeriodEnd = periodEnd
+		subscription.Status = models.SubscriptionStatusActive
+		return save()
+	}
+
+	// A subscription canceled at the end of the period still pays the usage
+	// and balance of the period that ended
+	billedStart, billedEnd := periodStart, periodEnd
+	if plan.IsMetered() || subscription.CancelAtPeriodEnd {
+		billedStart, billedEnd = subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd
+	}
+	var usage *int64
+	amount := models.Money{Currency: plan.Currency}
+	switch {
+	case plan.IsMetered() && trialing:
+		// Usage during the trial is free
+	case plan.IsMetered():
+		quantity, err := s.usageRepo.Aggregate(ctx, subscription.ID, plan.UsageAggregation, billedStart, billedEnd)
+		if err != nil {
+			return fmt.Errorf("failed to aggregate usage: %w", err)
+		}
+		quote, err := QuotePlan(plan, quantity)
+		if err != nil {
+			return err
+		}
+		usage = &quantity
+		amount.Amount = quote.Total
+	case !subscription.CancelAtPeriodEnd:
+		if amount, err = periodAmount(plan, subscription.Quantity); err != nil {
+			return err
+		}
+	}
+	if amount, err = amount.Add(models.Money{Amount: subscription.Balance, Currency: plan.Currency}); err != nil {
+		return err
+	}
+
+	// A trial that ends without a way to pay for what follows is canceled
+	// rather than dunned
+	if trialing && (amount.IsPositive() || plan.IsMetered()) && subscription.PaymentMethodID == "" {
+		canceledAt := subscription.CurrentPeriodEnd
+		subscription.Status = models.SubscriptionStatusCanceled
+		subscription.CanceledAt = &canceledAt
+		return save()
+	}
+
+	var events []*models.SubscriptionEvent
+	if amount.IsPositive() {
+		result, err := s.charge(ctx, subscription, amount, billedStart, billedEnd)
+		if err != nil {
+			return err
+		}
+		result.usage = usage
+		if !result.paid {
+			return save(s.dun(subscription, result)...)
+		}
+		events = append(events, &models.SubscriptionEvent{
+			Type: models.SubscriptionEventPaymentSucceeded,
+			Data: result.data(subscription.DunningAttempts + 1),
+		})
+	}
+
+	// A credit larger than the charge is carried into the next renewal
+	subscription.Balance = 0
+	if amount.IsNegative() {
+		subscription.Balance = amount.Amount
+	}
+	if subscription.CancelAtPeriodEnd {
+		cancelAtPeriodEnd(subscription)
+		return save(events...)
+	}
+
+	subscription.CurrentPeriodStart = periodStart
+	subscription.CurrentPeriodEnd = periodEnd
+	subscription.Status = models.SubscriptionStatusActive
+	subscription.DunningAttempts = 0
+	subscription.NextRetryAt = nil
+	return save(events...)
+}
+
+// cancelAtPeriodEnd cancels a subscription that was set to cancel at the end
+// of its current period
+func cancelAtPeriodEnd(subscription *models.Subscription) {
+	canceledAt := subscription.CurrentPeriodEnd
+	subscription.Status = models.SubscriptionStatusCanceled
+	subscription.CanceledAt = &canceledAt
+	subscription.DunningAttempts = 0
+	subscription.NextRetryAt = nil
+}
+
+// billingCycleAnchor returns the time the subscription's periods are
+// counted from
+func billingCycleAnchor(subscription *models.Subscription) time.Time {
+	if subscription.BillingCycleAnchor.IsZero() {
+		return subscription.CurrentPeriodStart
+	}
+	return subscription.BillingCycleAnchor
+}
+
+// chargeResult is the outcome of a renewal charge that reached a verdict
+type chargeResult struct {
+	paid      bool
+	hard      bool
+	paymentID string
+	code      string
+	message   string
+	// usage is the aggregated usage charged for by metered plans
+	usage *int64
+}
+
+func (r chargeResult) data(attempt int) models.JSON {
+	data := models.JSON{"attempt": attempt}
+	if r.paymentID != "" {
+		data["payment_id"] = r.paymentID
+	}
+	if r.usage != nil {
+		data["usage"] = *r.usage
+	}
+	if !r.paid {
+		data["decline"] = "soft"
+		if r.hard {
+			data["decline"] = "hard"
+		}
+		if r.code != "" {
+			data["code"] = r.code
+		}
+		data["message"] = r.message
+	}
+	return data
+}
+
+// charge attempts one renewal charge for the period from periodStart to
+// periodEnd. Declines and charges that need customer action, which cannot
+// complete off-session, come back unpaid. An error means the outcome is
+// unknown or transient, e.g. the provider was unreachable, and the renewal
+// should be retried once the lease expires.
+func (s *BillingService) charge(ctx context.Context, subscription *models.Subscription, amount models.Money, periodStart, periodEnd time.Time) (chargeResult, error) {
+	// Keyed on the period and dunning attempt so that a renewal retried after
+	// an error is deduplicated by providers that support idempotency keys,
+	// while each dunning retry is a new charge
+	key := fmt.Sprintf("renewal:%s:%d:%d", subscription.ID, periodStart.Unix(), subscription.DunningAttempts+1)
+	ctx = providers.WithIdempotencyKey(ctx, key)
+
+	resp, err := s.payments.CreateCharge(ctx, &models.ChargeRequest{
+		CustomerID:    subscription.CustomerID,
+		Amount:        amount.Amount,
+		Currency:      amount.Currency,
+		PaymentMethod: subscription.PaymentMethodID,
+		OffSession:    true,
+		Description:   fmt.Sprintf("Renewal of subscription %s", subscription.ID),
+		Metadata: models.JSON{
+			"subscription_id": subscription.ID,
+			"period_start":    periodStart.UTC().Format(time.RFC3339),
+			"period_end":      periodEnd.UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		// A charge cut short by shutdown says nothing about the payment method
+		if ctx.Err() != nil || !isRenewalDecline(err) {
+			return chargeResult{}, err
+		}
+		log.Printf("Subscription %s: renewal charge declined: %v", subscription.ID, err)
+		return chargeResult{
+			hard:    isHardRenewalDecline(err),
+			code:    renewalDeclineCode(err),
+			message: err.Error(),
+		}, nil
+	}
+
+	subscription.LatestPaymentID = &resp.ID
+	if resp.Status != models.PaymentStatusSuccess {
+		return chargeResult{
+			paymentID: resp.ID,
+			code:      string(resp.Status),
+			message:   fmt.Sprintf("renewal payment is %s", resp.Status),
+		}, nil
+	}
+	return chargeResult{paid: true, paymentID: resp.ID}, nil
+}
+
+// dun records a failed renewal charge. Soft declines are retried on the
+// configured schedule; a hard decline or the last failed retry applies the
+// plan's final dunning action.
+func (s *BillingService) dun(subscription *models.Subscription, result chargeResult) []*models.SubscriptionEvent {
+	subscription.DunningAttempts++
+	failed := &models.SubscriptionEvent{
+		Type: models.SubscriptionEventPaymentFailed,
+		Data: result.data(subscription.DunningAttempts),
+	}
+
+	retryDays := s.cfg.Dunning.RetryDays
+	if !result.hard && subscription.DunningAttempts <= len(retryDays) {
+		next := subscription.CurrentPeriodEnd.AddDate(0, 0, retryDays[subscription.DunningAttempts-1])
+		subscription.Status = models.SubscriptionStatusPastDue
+		subscription.NextRetryAt = &next
+		failed.Data["next_retry_at"] = next.UTC().Format(time.RFC3339)
+		return []*models.SubscriptionEvent{failed}
+	}
+
+	action := subscription.Plan.DunningAction
+	if action == "" {
+		action = models.DunningAction(s.cfg.Dunning.FinalAction)
+	}
+	subscription.NextRetryAt = nil
+	switch action {
+	case models.DunningActionCancel:
+		now := s.now()
+		subscription.Status = models.SubscriptionStatusCanceled
+		subscription.CanceledAt = &now
+	case models.DunningActionPause:
+		now := s.now()
+		subscription.Status = models.SubscriptionStatusPaused
+		subscription.PauseMode = models.PauseModeFull
+		subscription.PausedAt = &now
+	default:
+		subscription.Status = models.SubscriptionStatusUnpaid
+	}
+	log.Printf("Subscription %s: dunning exhausted after %d attempt(s), status %s", subscription.ID, subscription.DunningAttempts, subscription.Status)
+
+	return []*models.SubscriptionEvent{failed, {
+		Type: models.SubscriptionEventDunningExhausted,
+		Data: models.JSON{
+			"action":   string(action),
+			"attempts": subscription.DunningAttempts,
+			"status":   string(subscription.Status),
+		},
+	}}
+}
+
+// isRenewalDecline reports whether a failed renewal charge will not succeed
+// by simply retrying it: the provider rejected it or the subscription has no
+// usable payment details.
+func isRenewalDecline(err error) bool {
+	if errors.Is(err, ErrInvalidPaymentMethod) || errors.Is(err, ErrInvalidAmount) || errors.Is(err, ErrInvalidCurrency) {
+		return true
+	}
+	var chargeErr *providers.ChargeError
+	if !errors.As(err, &chargeErr) {
+		return false
+	}
+	// A timed out charge may have gone through, so it is retried on a later
+	// run with the same idempotency key rather than treated as a decline
+	class := providers.ClassifyError(chargeErr.Err)
+	return class != providers.ErrorClassRetryable && class != providers.ErrorClassAmbiguous
+}
+
+// isHardRenewalDecline reports whether a renewal decline will not succeed
+// on a later dunning retry either, so the schedule is skipped
+func isHardRenewalDecline(err error) bool {
+	if errors.Is(err, ErrInvalidPaymentMethod) || errors.Is(err, ErrInvalidAmount) || errors.Is(err, ErrInvalidCurrency) {
+		return true
+	}
+	var chargeErr *providers.ChargeError
+	if !errors.As(err, &chargeErr) {
+		return false
+	}
+	// Terminal errors, such as an invalid request, fail the same way every time
+	return providers.ClassifyError(chargeErr.Err) == providers.ErrorClassTerminal || providers.IsHardDecline(chargeErr.Err)
+}
+
+// renewalDeclineCode returns the provider's decline code, if any
+func renewalDeclineCode(err error) string {
+	var providerErr *providers.ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.Code
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+	"github.com/malwarebo/gopay/repositories"
+)
+
+var (
+	// ErrIdempotencyKeyInUse is returned when another request with the same key is still running
+	ErrIdempotencyKeyInUse = errors.New("a request with this idempotency key is already in progress")
+	// ErrIdempotencyKeyMismatch is returned when a key is reused with a different request body
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key was already used with a different request")
+)
+
+const (
+	// idempotencyWait is how long a duplicate waits for the first request to finish
+	idempotencyWait = 5 * time.Second
+	// idempotencyPollInterval is how often a waiting duplicate checks the stored key
+	idempotencyPollInterval = 100 * time.Millisecond
+	// idempotencyLockTTL bounds how long a crashed request can hold a key
+	idempotencyLockTTL = time.Minute
+)
+
+type IdempotencyService struct {
+	repo *repositories.IdempotencyRepository
+}
+
+func NewIdempotencyService(repo *repositories.IdempotencyRepository) *IdempotencyService {
+	return &IdempotencyService{repo: repo}
+}
+
+// Begin claims key for endpoint. When the key was already completed with the
+// same request the stored record is returned with replay set to true. A
+// concurrent duplicate waits for the first request for a short while before
+// giving up with ErrIdempotencyKeyInUse.
+func (s *IdempotencyService) Begin(ctx context.Context, key, endpoint string, body []byte) (record *models.IdempotencyKey, replay bool, err error) {
+	hash := requestHash(endpoint, body)
+	deadline := time.Now().Add(idempotencyWait)
+
+	for {
+		record = &models.IdempotencyKey{
+			Key:         key,
+			Endpoint:    endpoint,
+			RequestHash: hash,
+			Status:      models.IdempotencyStatusInProgress,
+			LockedUntil: time.Now().Add(idempotencyLockTTL),
+		}
+		created, err := s.repo.Create(ctx, record)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to store idempotency key: %w", err)
+		}
+		if created {
+			return record, false, nil
+		}
+
+		existing, err := s.repo.Get(ctx, key, endpoint)
+		if err != nil {
+			// The first request may have released the key between our insert and lookup
+			if time.Now().Before(deadline) {
+				continue
+			}
+			return nil, false, fmt.Errorf("failed to get idempotency key: %w", err)
+		}
+		if existing.RequestHash != hash {
+			return nil, false, ErrIdempotencyKeyMismatch
+		}
+		if existing.Status == models.IdempotencyStatusCompleted {
+			return existing, true, nil
+		}
+
+		reclaimed, err := s.repo.Reclaim(ctx, existing, time.Now().Add(idempotencyLockTTL))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to reclaim idempotency key: %w", err)
+		}
+		if reclaimed {
+			return existing, false, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, false, ErrIdempotencyKeyInUse
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+}
+
+// Complete stores the response so that retries replay it
+func (s *IdempotencyService) Complete(ctx context.Context, record *models.IdempotencyKey, code int, contentType string, body []byte) error {
+	record.Status = models.IdempotencyStatusCompleted
+	record.ResponseCode = code
+	record.ResponseContentType = contentType
+	record.ResponseBody = body
+	if err := s.repo.Complete(ctx, record); err != nil {
+		return fmt.Errorf("failed to complete idempotency key: %w", err)
+	}
+	return nil
+}
+
+// Release drops the key so that the request can be retried, used when the
+// first attempt failed with a server error.
+func (s *IdempotencyService) Release(ctx context.Context, record *models.IdempotencyKey) error {
+	if err := s.repo.Delete(ctx, record.ID); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+func requestHash(endpoint string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(endpoint))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+	"github.com/malwarebo/gopay/providers"
+)
+
+// PauseSubscription pauses an active or trialing subscription. A collection
+// pause keeps the subscription running without charging it; a full pause
+// stops it until it is resumed, either explicitly or at req.ResumeAt.
+// Native subscriptions are paused fully by default. Providers can only pause
+// collection, so that is the default for provider-billed subscriptions and
+// a full pause of one is rejected.
+func (s *SubscriptionService) PauseSubscription(ctx context.Context, subscriptionID string, req *models.PauseSubscriptionRequest) (*models.Subscription, error) {
+	if !req.Mode.Valid() {
+		return nil, fmt.Errorf("%w: unknown mode %q", ErrInvalidPause, req.Mode)
+	}
+	now := time.Now()
+	if req.ResumeAt != nil && !req.ResumeAt.After(now) {
+		return nil, fmt.Errorf("%w: resume_at must be in the future", ErrInvalidPause)
+	}
+
+	existing, err := s.getSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case existing.Status == models.SubscriptionStatusCanceled:
+		return nil, ErrSubscriptionCanceled
+	case existing.IsPaused():
+		return nil, fmt.Errorf("%w: it is already paused", ErrCannotPause)
+	case existing.Status != models.SubscriptionStatusActive && existing.Status != models.SubscriptionStatusTrialing:
+		return nil, fmt.Errorf("%w: it is %s", ErrCannotPause, existing.Status)
+	}
+
+	switch {
+	case req.Mode == "" && existing.IsNative():
+		req.Mode = models.PauseModeFull
+	case req.Mode == "":
+		req.Mode = models.PauseModeCollection
+	case req.Mode == models.PauseModeFull && !existing.IsNative():
+		return nil, fmt.Errorf("%w: provider-billed subscriptions can only pause payment collection", providers.ErrOperationNotSupported)
+	}
+
+	if existing.IsNative() {
+		existing.PauseMode = req.Mode
+		existing.ResumeAt = req.ResumeAt
+		if req.Mode == models.PauseModeFull {
+			existing.Status = models.SubscriptionStatusPaused
+		}
+	} else {
+		provider := s.getAvailableProvider(ctx)
+		if provider == nil {
+			return nil, ErrNoAvailableProvider
+		}
+
+		// Pause subscription in payment provider
+		paused, err := provider.PauseSubscription(ctx, existing.ProviderSubscriptionID, req)
+		if err != nil {
+			return nil, err
+		}
+		existing.ApplyProviderState(paused)
+	}
+	existing.PausedAt = &now
+
+	data := models.JSON{"mode": string(req.Mode)}
+	if req.ResumeAt != nil {
+		data["resume_at"] = req.ResumeAt.UTC().Format(time.RFC3339)
+	}
+	event := &models.SubscriptionEvent{Type: models.SubscriptionEventPaused, Data: data}
+	if err := s.subRepo.Update(ctx, existing, event); err != nil {
+		return nil, fmt.Errorf("failed to pause subscription: %w", err)
+	}
+	return existing, nil
+}
+
+// ResumeSubscription ends the pause of a subscription. A native subscription
+// that was paused fully has its current period extended by the time it
+// spent paused.
+func (s *SubscriptionService) ResumeSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	existing, err := s.getSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if existing.Status == models.SubscriptionStatusCanceled {
+		return nil, ErrSubscriptionCanceled
+	}
+	if !existing.IsPaused() {
+		return nil, ErrSubscriptionNotPaused
+	}
+
+	if existing.IsNative() {
+		resumeSubscription(existing, time.Now())
+	} else {
+		provider := s.getAvailableProvider(ctx)
+		if provider == nil {
+			return nil, ErrNoAvailableProvider
+		}
+
+		// Resume subscription in payment provider
+		resumed, err := provider.ResumeSubscription(ctx, existing.ProviderSubscriptionID)
+		if err != nil {
+			return nil, err
+		}
+		existing.ApplyProviderState(resumed)
+	}
+
+	event := &models.SubscriptionEvent{Type: models.SubscriptionEventResumed, Data: models.JSON{}}
+	if err := s.subRepo.Update(ctx, existing, event); err != nil {
+		return nil, fmt.Errorf("failed to resume subscription: %w", err)
+	}
+	return existing, nil
+}
+
+// resumeSubscription ends the pause of a native subscription at now. A full
+// pause, including one applied by dunning, pushes the end of the current
+// period back by the time spent paused, but never into the past, so a
+// subscription paused past its period end renews straight away. A trial
+// that was paused resumes as a trial.
+func resumeSubscription(subscription *models.Subscription, now time.Time) {
+	if subscription.Status == models.SubscriptionStatusPaused {
+		end := subscription.CurrentPeriodEnd
+		if subscription.PausedAt != nil {
+			end = end.Add(now.Sub(*subscription.PausedAt))
+		}
+		if end.Before(now) {
+			end = now
+		}
+
+		trial := subscription.TrialEnd != nil && !subscription.TrialEnd.Before(subscription.CurrentPeriodEnd)
+		if trial && end.After(now) {
+			subscription.Status = models.SubscriptionStatusTrialing
+			subscription.TrialEnd = &end
+		} else {
+			subscription.Status = models.SubscriptionStatusActive
+		}
+		subscription.CurrentPeriodEnd = end
+		subscription.BillingCycleAnchor = end
+		subscription.DunningAttempts = 0
+		subscription.NextRetryAt = nil
+	}
+	subscription.PauseMode = ""
+	subscription.PausedAt = nil
+	subscription.ResumeAt = nil
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+
 	"github.com/malwarebo/gopay/models"
 	"github.com/malwarebo/gopay/providers"
 	"github.com/malwarebo/gopay/repositories"
+	"gorm.io/gorm"
 )
 
 var (
@@ -16,6 +19,31 @@ var (
 	ErrInvalidCurrency = errors.New("invalid currency")
 	// ErrInvalidPaymentMethod is returned when the payment method is invalid
 	ErrInvalidPaymentMethod = errors.New("invalid payment method")
+	// ErrInvalidCaptureMethod is returned when the capture method is not automatic or manual
+	ErrInvalidCaptureMethod = errors.New("invalid capture method")
+	// ErrPaymentIDRequired is returned when a refund does not name its payment
+	ErrPaymentIDRequired = errors.New("payment ID is required")
+	// ErrPaymentNotFound is returned when the payment does not exist
+	ErrPaymentNotFound = errors.New("payment not found")
+	// ErrPaymentNotAuthorized is returned when capturing or voiding a payment that holds no authorization
+	ErrPaymentNotAuthorized = errors.New("payment is not authorized")
+	// ErrCaptureAmountExceeded is returned when capturing more than was authorized
+	ErrCaptureAmountExceeded = errors.New("capture amount exceeds authorized amount")
+	// ErrPaymentNotAwaitingAction is returned when confirming a payment that needs no customer action
+	ErrPaymentNotAwaitingAction = errors.New("payment does not require customer action")
+	// ErrPaymentNotRefundable is returned when refunding a payment that has not been collected
+	ErrPaymentNotRefundable = errors.New("payment cannot be refunded in its current status")
+	// ErrRefundCurrencyMismatch is returned when the refund currency differs from the payment's
+	ErrRefundCurrencyMismatch = errors.New("refund currency does not match payment currency")
+	// ErrRefundExceedsBalance is returned when the refund is larger than the refundable balance
+	ErrRefundExceedsBalance = errors.New("refund amount exceeds refundable balance")
+	// ErrInvalidPaymentFilter is returned when a payment search has invalid parameters
+	ErrInvalidPaymentFilter = errors.New("invalid payment filter")
+)
+
+const (
+	defaultPaymentPageSize = 20
+	maxPaymentPageSize     = 100
 )
 
 type PaymentService struct {
@@ -30,21 +58,54 @@ func NewPaymentService(paymentRepo *repositories.PaymentRepository, provider pro
 	}
 }
 
+// CheckOffSession fails with providers.ErrOperationNotSupported if charges
+// in currency could go to a provider that cannot charge off-session, as
+// subscription renewals must
+func (s *PaymentService) CheckOffSession(currency string) error {
+	if checker, ok := s.provider.(providers.OffSessionChecker); ok {
+		return checker.CheckOffSession(currency)
+	}
+	if charger, ok := s.provider.(providers.OffSessionCharger); !ok || !charger.ChargesOffSession() {
+		return fmt.Errorf("%w: %s cannot charge off-session", providers.ErrOperationNotSupported, s.provider.Name())
+	}
+	return nil
+}
+
 func (s *PaymentService) CreateCharge(ctx context.Context, req *models.ChargeRequest) (*models.ChargeResponse, error) {
 	// Validate request
 	if req.Amount <= 0 {
 		return nil, ErrInvalidAmount
 	}
-	if req.Currency == "" {
-		return nil, ErrInvalidCurrency
+	currency, err := normalizeCurrency(req.Currency)
+	if err != nil {
+		return nil, err
 	}
+	req.Currency = currency
 	if req.PaymentMethod == "" {
 		return nil, ErrInvalidPaymentMethod
 	}
+	switch req.CaptureMethod {
+	case "":
+		req.CaptureMethod = models.CaptureMethodAutomatic
+	case models.CaptureMethodAutomatic, models.CaptureMethodManual:
+	default:
+		return nil, ErrInvalidCaptureMethod
+	}
 
-	// Create charge using provider
-	chargeResp, err := s.provider.Charge(ctx, req)
+	// Create charge using provider, only holding the funds for manual capture
+	var chargeResp *models.ChargeResponse
+	if req.CaptureMethod == models.CaptureMethodManual {
+		chargeResp, err = s.provider.Authorize(ctx, req)
+	} else {
+		chargeResp, err = s.provider.Charge(ctx, req)
+	}
 	if err != nil {
+		var chargeErr *providers.ChargeError
+		if errors.As(err, &chargeErr) && len(chargeErr.Attempts) > 0 {
+			if storeErr := s.recordFailedCharge(ctx, req, chargeErr); storeErr != nil {
+				return nil, fmt.Errorf("failed to create charge: %w (storing attempts: %v)", err, storeErr)
+			}
+		}
 		return nil, fmt.Errorf("failed to create charge: %w", err)
 	}
 
@@ -53,11 +114,18 @@ func (s *PaymentService) CreateCharge(ctx context.Context, req *models.ChargeReq
 		CustomerID:       req.CustomerID,
 		Amount:          req.Amount,
 		Currency:        req.Currency,
-		Status:          models.PaymentStatusSuccess,
+		Status:          chargeResp.Status,
 		PaymentMethod:   req.PaymentMethod,
 		Description:     req.Description,
-		ProviderName:    "stripe",
-		ProviderChargeID: chargeResp.ID,
+		ProviderName:    chargeResp.ProviderName,
+		ProviderChargeID: chargeResp.ProviderChargeID,
+		ProviderStatus:  chargeResp.ProviderStatus,
+		ProviderResponse: chargeResp.ProviderResponse,
+		CaptureMethod:   req.CaptureMethod,
+		CapturedAmount:  chargeResp.CapturedAmount,
+		NextAction:      providers.StorableNextAction(chargeResp.NextAction),
+		RoutingRule:     chargeResp.RoutingRule,
+		Attempts:        chargeResp.Attempts,
 		Metadata:        req.Metadata,
 	}
 
@@ -65,6 +133,186 @@ func (s *PaymentService) CreateCharge(ctx context.Context, req *models.ChargeReq
 		return nil, fmt.Errorf("failed to store payment: %w", err)
 	}
 
+	// The client secret needed to complete the action is only handed out here
+	resp := paymentResponse(payment)
+	resp.NextAction = chargeResp.NextAction
+	return resp, nil
+}
+
+// recordFailedCharge stores a failed payment together with every provider
+// attempt so that failed charges can be traced as well as successful ones.
+func (s *PaymentService) recordFailedCharge(ctx context.Context, req *models.ChargeRequest, chargeErr *providers.ChargeError) error {
+	last := chargeErr.Attempts[len(chargeErr.Attempts)-1]
+	payment := &models.Payment{
+		CustomerID:    req.CustomerID,
+		Amount:        req.Amount,
+		Currency:      req.Currency,
+		Status:        models.PaymentStatusFailed,
+		PaymentMethod: req.PaymentMethod,
+		Description:   req.Description,
+		ProviderName:  last.ProviderName,
+		CaptureMethod: req.CaptureMethod,
+		RoutingRule:   chargeErr.RoutingRule,
+		Attempts:      chargeErr.Attempts,
+		Metadata:      req.Metadata,
+	}
+	return s.paymentRepo.Create(ctx, payment)
+}
+
+// ConfirmPayment completes a requires_action payment after the customer has
+// authenticated and stores the outcome reported by the provider.
+func (s *PaymentService) ConfirmPayment(ctx context.Context, paymentID string, req *models.ConfirmRequest) (*models.ChargeResponse, error) {
+	payment, err := s.getPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if payment.Status != models.PaymentStatusRequiresAction {
+		return nil, ErrPaymentNotAwaitingAction
+	}
+
+	req.PaymentID = payment.ID
+	req.ProviderChargeID = payment.ProviderChargeID
+	req.CaptureMethod = payment.CaptureMethod
+	confirmResp, err := s.provider.Confirm(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to confirm payment: %w", err)
+	}
+
+	if confirmResp.CapturedAmount > 0 {
+		payment.CapturedAmount = confirmResp.CapturedAmount
+	}
+	if err := s.applyProviderResult(ctx, payment, confirmResp, "confirm"); err != nil {
+		return nil, err
+	}
+	resp := paymentResponse(payment)
+	resp.NextAction = confirmResp.NextAction
+	return resp, nil
+}
+
+// CapturePayment captures an authorized payment, in full or in part. Any
+// uncaptured remainder is released by the provider.
+func (s *PaymentService) CapturePayment(ctx context.Context, paymentID string, req *models.CaptureRequest) (*models.ChargeResponse, error) {
+	payment, err := s.getPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if payment.Status != models.PaymentStatusAuthorized {
+		return nil, ErrPaymentNotAuthorized
+	}
+	if req.Amount < 0 {
+		return nil, ErrInvalidAmount
+	}
+	if req.Amount > payment.Amount {
+		return nil, ErrCaptureAmountExceeded
+	}
+	if req.Amount == 0 {
+		req.Amount = payment.Amount
+	}
+
+	req.PaymentID = payment.ID
+	req.ProviderChargeID = payment.ProviderChargeID
+	req.Currency = payment.Currency
+	captureResp, err := s.provider.Capture(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture payment: %w", err)
+	}
+
+	payment.CapturedAmount = captureResp.CapturedAmount
+	if payment.CapturedAmount == 0 {
+		payment.CapturedAmount = req.Amount
+	}
+	if err := s.applyProviderResult(ctx, payment, captureResp, "capture"); err != nil {
+		return nil, err
+	}
+	return paymentResponse(payment), nil
+}
+
+// VoidPayment releases the funds held by an authorized payment
+func (s *PaymentService) VoidPayment(ctx context.Context, paymentID string, req *models.VoidRequest) (*models.ChargeResponse, error) {
+	payment, err := s.getPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if payment.Status != models.PaymentStatusAuthorized {
+		return nil, ErrPaymentNotAuthorized
+	}
+
+	req.PaymentID = payment.ID
+	req.ProviderChargeID = payment.ProviderChargeID
+	voidResp, err := s.provider.Void(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to void payment: %w", err)
+	}
+
+	if err := s.applyProviderResult(ctx, payment, voidResp, "void"); err != nil {
+		return nil, err
+	}
+	return paymentResponse(payment), nil
+}
+
+// applyProviderResult stores the provider's view of a payment after a
+// follow-up call and records the status change in the audit trail.
+func (s *PaymentService) applyProviderResult(ctx context.Context, payment *models.Payment, resp *models.ChargeResponse, source string) error {
+	payment.ProviderStatus = resp.ProviderStatus
+	payment.ProviderResponse = resp.ProviderResponse
+	payment.NextAction = providers.StorableNextAction(resp.NextAction)
+
+	if err := s.paymentRepo.Update(ctx, payment); err != nil {
+		return fmt.Errorf("failed to update payment: %w", err)
+	}
+
+	audit := &models.PaymentEvent{
+		Source: source,
+		Data: models.JSON{
+			"provider_status": resp.ProviderStatus,
+		},
+	}
+	if err := transitionPayment(ctx, s.paymentRepo, payment, resp.Status, audit); err != nil {
+		return fmt.Errorf("failed to update payment: %w", err)
+	}
+	return nil
+}
+
+// transitionPayment moves payment to next if its status allows it. When the
+// stored status changed after payment was read, e.g. because a webhook for
+// the same payment was applied at the same time, it re-reads the status and
+// checks the transition again, so a stale read never moves a payment
+// backwards. audit only needs its source and event details filled in.
+func transitionPayment(ctx context.Context, repo *repositories.PaymentRepository, payment *models.Payment, next models.PaymentStatus, audit *models.PaymentEvent) error {
+	for payment.Status.CanTransitionTo(next) {
+		current := payment.Status
+		audit.FromStatus = current
+		payment.Status = next
+		err := repo.Transition(ctx, payment, audit)
+		if !errors.Is(err, repositories.ErrStatusChanged) {
+			if err != nil {
+				payment.Status = current
+			}
+			return err
+		}
+
+		stored, err := repo.GetByID(ctx, payment.ID)
+		if err != nil {
+			payment.Status = current
+			return err
+		}
+		payment.Status = stored.Status
+	}
+	return nil
+}
+
+func (s *PaymentService) getPayment(ctx context.Context, id string) (*models.Payment, error) {
+	payment, err := s.paymentRepo.GetByID(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+	return payment, nil
+}
+
+func paymentResponse(payment *models.Payment) *models.ChargeResponse {
 	return &models.ChargeResponse{
 		ID:              payment.ID,
 		CustomerID:      payment.CustomerID,
@@ -75,9 +323,15 @@ func (s *PaymentService) CreateCharge(ctx context.Context, req *models.ChargeReq
 		Description:     payment.Description,
 		ProviderName:    payment.ProviderName,
 		ProviderChargeID: payment.ProviderChargeID,
+		ProviderStatus:  payment.ProviderStatus,
+		CaptureMethod:   payment.CaptureMethod,
+		CapturedAmount:  payment.CapturedAmount,
+		NextAction:      payment.NextAction,
+		RoutingRule:     payment.RoutingRule,
+		Attempts:        payment.Attempts,
 		Metadata:        payment.Metadata,
 		CreatedAt:       payment.CreatedAt,
-	}, nil
+	}
 }
 
 func (s *PaymentService) CreateRefund(ctx context.Context, req *models.RefundRequest) (*models.RefundResponse, error) {
@@ -85,46 +339,89 @@ func (s *PaymentService) CreateRefund(ctx context.Context, req *models.RefundReq
 	if req.Amount <= 0 {
 		return nil, ErrInvalidAmount
 	}
-	if req.Currency == "" {
-		return nil, ErrInvalidCurrency
+	currency, err := normalizeCurrency(req.Currency)
+	if err != nil {
+		return nil, err
 	}
+	req.Currency = currency
 	if req.PaymentID == "" {
-		return nil, errors.New("payment ID is required")
+		return nil, ErrPaymentIDRequired
 	}
 
-	// Get the payment
-	payment, err := s.paymentRepo.GetByID(ctx, req.PaymentID)
+	// Reserve the amount under a lock on the payment so that concurrent
+	// refunds cannot exceed what is left to refund
+	refund := &models.Refund{
+		PaymentID: req.PaymentID,
+		Amount:    req.Amount,
+		Reason:    req.Reason,
+		Status:    models.RefundStatusPending,
+		Metadata:  req.Metadata,
+	}
+	var payment *models.Payment
+	err = s.paymentRepo.ReserveRefund(ctx, refund, func(p *models.Payment, reserved int64) error {
+		if !p.Status.IsRefundable() {
+			return ErrPaymentNotRefundable
+		}
+		if !strings.EqualFold(p.Currency, req.Currency) {
+			return ErrRefundCurrencyMismatch
+		}
+		if req.Amount > p.SettledAmount()-reserved {
+			return ErrRefundExceedsBalance
+		}
+		refund.ProviderName = p.ProviderName
+		payment = p
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPaymentNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get payment: %w", err)
+		return nil, fmt.Errorf("failed to create refund: %w", err)
 	}
 
 	// Create refund using provider
+	req.ProviderChargeID = payment.ProviderChargeID
+	req.CaptureMethod = payment.CaptureMethod
 	refundResp, err := s.provider.Refund(ctx, req)
 	if err != nil {
+		// Release the reserved amount
+		refund.Status = models.RefundStatusFailed
+		if storeErr := s.paymentRepo.UpdateRefund(ctx, refund); storeErr != nil {
+			return nil, fmt.Errorf("failed to create refund: %w (releasing refund: %v)", err, storeErr)
+		}
 		return nil, fmt.Errorf("failed to create refund: %w", err)
 	}
 
-	// Update payment status
-	payment.Status = models.PaymentStatusRefunded
-	if err := s.paymentRepo.Update(ctx, payment); err != nil {
-		return nil, fmt.Errorf("failed to update payment: %w", err)
+	refund.Status = refundResp.Status
+	if refund.Status == "" {
+		refund.Status = models.RefundStatusPending
+	}
+	refund.ProviderName = refundResp.ProviderName
+	refund.ProviderRefundID = refundResp.ProviderRefundID
+	refund.ProviderResponse = refundResp.ProviderResponse
+	if err := s.paymentRepo.AttachProviderRefund(ctx, refund); err != nil {
+		return nil, fmt.Errorf("failed to store refund: %w", err)
 	}
 
-	refund := &models.Refund{
-		PaymentID:       req.PaymentID,
-		Amount:          req.Amount,
-		Reason:          req.Reason,
-		Status:          "succeeded",
-		ProviderName:    "stripe",
-		ProviderRefundID: refundResp.ID,
-		Metadata:        req.Metadata,
+	// Pending refunds are settled later by the provider's webhook
+	if refund.Status == models.RefundStatusSucceeded {
+		audit := &models.PaymentEvent{
+			Source:  "refund",
+			EventID: refund.ID,
+			Data: models.JSON{
+				"provider_refund_id": refund.ProviderRefundID,
+			},
+		}
+		if err := syncRefundedStatus(ctx, s.paymentRepo, payment, audit); err != nil {
+			return nil, err
+		}
 	}
 
 	return &models.RefundResponse{
 		ID:              refund.ID,
 		PaymentID:       refund.PaymentID,
 		Amount:          refund.Amount,
-		Currency:        req.Currency,
+		Currency:        payment.Currency,
 		Status:          refund.Status,
 		Reason:          refund.Reason,
 		ProviderName:    refund.ProviderName,
@@ -134,18 +431,132 @@ func (s *PaymentService) CreateRefund(ctx context.Context, req *models.RefundReq
 	}, nil
 }
 
+// GetPayment returns a payment with its refunds and their totals
 func (s *PaymentService) GetPayment(ctx context.Context, id string) (*models.Payment, error) {
-	payment, err := s.paymentRepo.GetByID(ctx, id)
+	payment, err := s.getPayment(ctx, id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get payment: %w", err)
+		return nil, err
+	}
+	if err := s.summarizeRefunds(ctx, payment); err != nil {
+		return nil, err
 	}
 	return payment, nil
 }
 
+// ListRefunds returns the refunds of a payment, oldest first
+func (s *PaymentService) ListRefunds(ctx context.Context, paymentID string) (*models.RefundList, error) {
+	payment, err := s.getPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.summarizeRefunds(ctx, payment); err != nil {
+		return nil, err
+	}
+
+	refunds, err := s.paymentRepo.ListRefundsByPayment(ctx, payment.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refunds: %w", err)
+	}
+	return &models.RefundList{
+		PaymentID: payment.ID,
+		Refunds:   refunds,
+		Summary:   *payment.RefundSummary,
+	}, nil
+}
+
+// summarizeRefunds fills in the refund summary of each payment
+func (s *PaymentService) summarizeRefunds(ctx context.Context, payments ...*models.Payment) error {
+	ids := make([]string, len(payments))
+	for i, payment := range payments {
+		ids[i] = payment.ID
+	}
+
+	summaries, err := s.paymentRepo.RefundSummaries(ctx, ids...)
+	if err != nil {
+		return fmt.Errorf("failed to summarize refunds: %w", err)
+	}
+	for _, payment := range payments {
+		payment.SummarizeRefunds(summaries[payment.ID])
+	}
+	return nil
+}
+
 func (s *PaymentService) ListPayments(ctx context.Context, customerID string) ([]*models.Payment, error) {
 	payments, err := s.paymentRepo.ListByCustomer(ctx, customerID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list payments: %w", err)
 	}
+	if err := s.summarizeRefunds(ctx, payments...); err != nil {
+		return nil, err
+	}
 	return payments, nil
 }
+
+// SearchPayments returns one page of payments matching filter, newest first
+// unless another order is requested.
+func (s *PaymentService) SearchPayments(ctx context.Context, filter *models.PaymentFilter) (*models.PaymentPage, error) {
+	switch filter.SortBy {
+	case "":
+		filter.SortBy = models.PaymentSortCreatedAt
+	case models.PaymentSortCreatedAt, models.PaymentSortAmount:
+	default:
+		return nil, fmt.Errorf("%w: unknown sort field %q", ErrInvalidPaymentFilter, filter.SortBy)
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultPaymentPageSize
+	}
+	if filter.Limit < 0 || filter.Limit > maxPaymentPageSize {
+		return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidPaymentFilter, maxPaymentPageSize)
+	}
+	if filter.MinAmount != nil && filter.MaxAmount != nil && *filter.MinAmount > *filter.MaxAmount {
+		return nil, fmt.Errorf("%w: min_amount is greater than max_amount", ErrInvalidPaymentFilter)
+	}
+
+	page, err := s.paymentRepo.Search(ctx, filter)
+	if errors.Is(err, repositories.ErrInvalidCursor) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPaymentFilter, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to search payments: %w", err)
+	}
+	if err := s.summarizeRefunds(ctx, page.Payments...); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// syncRefundedStatus moves a payment to partially_refunded or refunded from
+// the total of its succeeded refunds. audit only needs its source and event
+// details filled in.
+func syncRefundedStatus(ctx context.Context, repo *repositories.PaymentRepository, payment *models.Payment, audit *models.PaymentEvent) error {
+	refunded, err := repo.RefundedAmount(ctx, payment.ID, models.RefundStatusSucceeded)
+	if err != nil {
+		return fmt.Errorf("failed to sum refunds: %w", err)
+	}
+	if refunded == 0 {
+		return nil
+	}
+
+	next := models.PaymentStatusPartiallyRefunded
+	if refunded >= payment.SettledAmount() {
+		next = models.PaymentStatusRefunded
+	}
+	if audit.Data == nil {
+		audit.Data = models.JSON{}
+	}
+	audit.Data["refunded_amount"] = refunded
+	if err := transitionPayment(ctx, repo, payment, next, audit); err != nil {
+		return fmt.Errorf("failed to update payment: %w", err)
+	}
+	return nil
+}
+
+// normalizeCurrency checks the code against the ISO 4217 table and returns
+// it in upper case, the form payments are stored and compared in.
+func normalizeCurrency(code string) (string, error) {
+	currency, err := models.LookupCurrency(code)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidCurrency, err)
+	}
+	return currency.Code, nil
+}
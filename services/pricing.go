@@ -0,0 +1,195 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/malwarebo/gopay/models"
+)
+
+// QuotePlan prices one billing period of plan for quantity units:
+//
+//   - fixed charges the plan amount whatever the quantity
+//   - per_unit charges the plan amount for each unit
+//   - tiered charges each unit at the tier it falls in, plus the flat fee
+//     of every tier reached
+//   - volume charges every unit at the tier the whole quantity falls in,
+//     plus that tier's flat fee
+//
+// A quantity of zero is priced at nothing for all but fixed plans.
+func QuotePlan(plan *models.Plan, quantity int64) (*models.Quote, error) {
+	if quantity < 0 {
+		return nil, ErrInvalidQuantity
+	}
+	quote := &models.Quote{
+		PlanID:      plan.ID,
+		PricingType: plan.PricingType,
+		Quantity:    quantity,
+		Currency:    plan.Currency,
+		LineItems:   []models.QuoteLineItem{},
+	}
+
+	var err error
+	switch plan.PricingType {
+	case models.PricingTypeFixed, "":
+		err = addQuoteLine(quote, plan.Name, 1, plan.Amount)
+	case models.PricingTypePerUnit:
+		err = addQuoteLine(quote, plan.Name, quantity, plan.Amount)
+	case models.PricingTypeTiered:
+		err = quoteTiered(quote, plan.Tiers, quantity)
+	case models.PricingTypeVolume:
+		err = quoteVolume(quote, plan.Tiers, quantity)
+	default:
+		err = fmt.Errorf("%w: unsupported pricing type %q", ErrInvalidPlan, plan.PricingType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+// periodAmount is the price of one billing period of plan for a
+// subscription's quantity
+func periodAmount(plan *models.Plan, quantity int) (models.Money, error) {
+	if quantity < 1 {
+		quantity = 1
+	}
+	quote, err := QuotePlan(plan, int64(quantity))
+	if err != nil {
+		return models.Money{}, err
+	}
+	return models.Money{Amount: quote.Total, Currency: quote.Currency}, nil
+}
+
+func quoteTiered(quote *models.Quote, tiers []models.PlanTier, quantity int64) error {
+	var below int64
+	for i, tier := range tiers {
+		if quantity <= below {
+			break
+		}
+		units := quantity - below
+		if tier.UpTo != nil && *tier.UpTo < quantity {
+			units = *tier.UpTo - below
+		}
+		if err := quoteTier(quote, i, tier, units); err != nil {
+			return err
+		}
+		if tier.UpTo == nil {
+			break
+		}
+		below = *tier.UpTo
+	}
+	return nil
+}
+
+func quoteVolume(quote *models.Quote, tiers []models.PlanTier, quantity int64) error {
+	if quantity == 0 {
+		return nil
+	}
+	for i, tier := range tiers {
+		if tier.UpTo == nil || quantity <= *tier.UpTo {
+			return quoteTier(quote, i, tier, quantity)
+		}
+	}
+	return fmt.Errorf("%w: quantity %d is above the last tier", ErrInvalidPlan, quantity)
+}
+
+// quoteTier adds the unit and flat lines of one tier
+func quoteTier(quote *models.Quote, index int, tier models.PlanTier, units int64) error {
+	name := "Tier " + strconv.Itoa(index+1)
+	if tier.UnitAmount != 0 || tier.FlatAmount == 0 {
+		if err := addQuoteLine(quote, name, units, tier.UnitAmount); err != nil {
+			return err
+		}
+	}
+	if tier.FlatAmount != 0 {
+		return addQuoteLine(quote, name+" flat fee", 1, tier.FlatAmount)
+	}
+	return nil
+}
+
+// validateTiers checks the tier table of tiered and volume plans: at least
+// one tier, UpTo strictly increasing, only the last tier open-ended and no
+// negative amounts. Other pricing types must not have tiers.
+func validateTiers(plan *models.Plan) error {
+	if plan.PricingType != models.PricingTypeTiered && plan.PricingType != models.PricingTypeVolume {
+		if len(plan.Tiers) > 0 {
+			return fmt.Errorf("%w: tiers are only used by tiered and volume pricing", ErrInvalidPlan)
+		}
+		return nil
+	}
+	if len(plan.Tiers) == 0 {
+		return fmt.Errorf("%w: %s pricing needs tiers", ErrInvalidPlan, plan.PricingType)
+	}
+
+	var below int64
+	for i, tier := range plan.Tiers {
+		if tier.UnitAmount < 0 || tier.FlatAmount < 0 {
+			return ErrInvalidAmount
+		}
+		last := i == len(plan.Tiers)-1
+		switch {
+		case tier.UpTo == nil && !last:
+			return fmt.Errorf("%w: only the last tier can be without up_to", ErrInvalidPlan)
+		case tier.UpTo == nil:
+		case last:
+			return fmt.Errorf("%w: the last tier must be without up_to", ErrInvalidPlan)
+		case *tier.UpTo <= below:
+			return fmt.Errorf("%w: tier up_to values must be positive and increasing", ErrInvalidPlan)
+		default:
+			below = *tier.UpTo
+		}
+	}
+	return nil
+}
+
+// addQuoteLine adds quantity units at unitAmount to the quote and its total
+func addQuoteLine(quote *models.Quote, description string, quantity, unitAmount int64) error {
+	amount, err := models.Money{Amount: unitAmount, Currency: quote.Currency}.Mul(quantity)
+	if err != nil {
+		return err
+	}
+	total, err := models.Money{Amount: quote.Total, Currency: quote.Currency}.Add(amount)
+	if err != nil {
+		return err
+	}
+	quote.LineItems = append(quote.LineItems, models.QuoteLineItem{
+		Description: description,
+		Quantity:    quantity,
+		UnitAmount:  unitAmount,
+		Amount:      amount.Amount,
+	})
+	quote.Total = total.Amount
+	return nil
+}
+
+// validateUsage defaults the usage type to licensed and the aggregation of
+// metered plans to sum. Metered plans price the aggregated usage, so they
+// cannot have fixed pricing.
+func validateUsage(plan *models.Plan) error {
+	switch plan.UsageType {
+	case "":
+		plan.UsageType = models.UsageTypeLicensed
+	case models.UsageTypeLicensed, models.UsageTypeMetered:
+	default:
+		return fmt.Errorf("%w: unsupported usage type %q", ErrInvalidPlan, plan.UsageType)
+	}
+
+	if !plan.IsMetered() {
+		if plan.UsageAggregation != "" {
+			return fmt.Errorf("%w: usage aggregation is only used by metered plans", ErrInvalidPlan)
+		}
+		return nil
+	}
+	if plan.PricingType == models.PricingTypeFixed {
+		return fmt.Errorf("%w: metered plans need per_unit, tiered or volume pricing", ErrInvalidPlan)
+	}
+	switch plan.UsageAggregation {
+	case "":
+		plan.UsageAggregation = models.UsageAggregationSum
+	case models.UsageAggregationSum, models.UsageAggregationMax, models.UsageAggregationLast:
+	default:
+		return fmt.Errorf("%w: unsupported usage aggregation %q", ErrInvalidPlan, plan.UsageAggregation)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/malwarebo/gopay/models"
+)
+
+func upTo(v int64) *int64 {
+	return &v
+}
+
+// testTiers charges 100 per unit and a flat 500 for the first 10 units, 80
+// per unit for the next 10 and 50 per unit above that
+var testTiers = []models.PlanTier{
+	{UpTo: upTo(10), UnitAmount: 100, FlatAmount: 500},
+	{UpTo: upTo(20), UnitAmount: 80},
+	{UnitAmount: 50},
+}
+
+func TestQuotePlan(t *testing.T) {
+	fixed := &models.Plan{Name: "Basic", Amount: 999, Currency: "USD", PricingType: models.PricingTypeFixed}
+	perUnit := &models.Plan{Name: "Seats", Amount: 999, Currency: "USD", PricingType: models.PricingTypePerUnit}
+	tiered := &models.Plan{Currency: "USD", PricingType: models.PricingTypeTiered, Tiers: testTiers}
+	volume := &models.Plan{Currency: "USD", PricingType: models.PricingTypeVolume, Tiers: testTiers}
+	capped := &models.Plan{Currency: "USD", PricingType: models.PricingTypeVolume, Tiers: testTiers[:2]}
+
+	tests := []struct {
+		name      string
+		plan      *models.Plan
+		quantity  int64
+		wantTotal int64
+		wantLines int
+		wantErr   error
+	}{
+		{"fixed", fixed, 3, 999, 1, nil},
+		{"fixed at zero quantity", fixed, 0, 999, 1, nil},
+		{"fixed by default", &models.Plan{Amount: 500, Currency: "USD"}, 2, 500, 1, nil},
+		{"per unit", perUnit, 3, 2997, 1, nil},
+		{"per unit at zero quantity", perUnit, 0, 0, 1, nil},
+		{"tiered at zero quantity", tiered, 0, 0, 0, nil},
+		{"tiered within the first tier", tiered, 5, 1000, 2, nil},
+		{"tiered at a tier boundary", tiered, 10, 1500, 2, nil},
+		{"tiered past a tier boundary", tiered, 11, 1580, 3, nil},
+		{"tiered in the open tier", tiered, 25, 2550, 4, nil},
+		{"volume at zero quantity", volume, 0, 0, 0, nil},
+		{"volume in the first tier", volume, 10, 1500, 2, nil},
+		{"volume in the second tier", volume, 15, 1200, 1, nil},
+		{"volume in the open tier", volume, 25, 1250, 1, nil},
+		{"volume above the last tier", capped, 21, 0, 0, ErrInvalidPlan},
+		{"negative quantity", perUnit, -1, 0, 0, ErrInvalidQuantity},
+		{"unknown pricing type", &models.Plan{Currency: "USD", PricingType: "graduated"}, 1, 0, 0, ErrInvalidPlan},
+		{"overflow", &models.Plan{Amount: math.MaxInt64, Currency: "USD", PricingType: models.PricingTypePerUnit}, 2, 0, 0, models.ErrAmountOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote, err := QuotePlan(tt.plan, tt.quantity)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("QuotePlan() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if quote.Total != tt.wantTotal {
+				t.Errorf("QuotePlan().Total = %d, want %d", quote.Total, tt.wantTotal)
+			}
+			if len(quote.LineItems) != tt.wantLines {
+				t.Errorf("QuotePlan() has %d line items, want %d: %+v", len(quote.LineItems), tt.wantLines, quote.LineItems)
+			}
+			var sum int64
+			for _, line := range quote.LineItems {
+				if line.Amount != line.Quantity*line.UnitAmount {
+					t.Errorf("line %q: amount %d is not %d x %d", line.Description, line.Amount, line.Quantity, line.UnitAmount)
+				}
+				sum += line.Amount
+			}
+			if sum != quote.Total {
+				t.Errorf("line items add up to %d, total is %d", sum, quote.Total)
+			}
+		})
+	}
+}
+
+func TestPeriodAmount(t *testing.T) {
+	perUnit := &models.Plan{Amount: 999, Currency: "USD", PricingType: models.PricingTypePerUnit}
+
+	tests := []struct {
+		name     string
+		quantity int
+		want     models.Money
+	}{
+		{"one unit", 1, models.Money{Amount: 999, Currency: "USD"}},
+		{"several units", 4, models.Money{Amount: 3996, Currency: "USD"}},
+		{"no quantity is one unit", 0, models.Money{Amount: 999, Currency: "USD"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := periodAmount(perUnit, tt.quantity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("periodAmount() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		plan    *models.Plan
+		wantErr error
+	}{
+		{"tiered", &models.Plan{PricingType: models.PricingTypeTiered, Tiers: testTiers}, nil},
+		{"single open tier", &models.Plan{PricingType: models.PricingTypeVolume, Tiers: []models.PlanTier{{UnitAmount: 10}}}, nil},
+		{"fixed without tiers", &models.Plan{PricingType: models.PricingTypeFixed}, nil},
+		{"fixed with tiers", &models.Plan{PricingType: models.PricingTypeFixed, Tiers: testTiers}, ErrInvalidPlan},
+		{"tiered without tiers", &models.Plan{PricingType: models.PricingTypeTiered}, ErrInvalidPlan},
+		{"open tier before the last", &models.Plan{PricingType: models.PricingTypeTiered, Tiers: []models.PlanTier{{UnitAmount: 10}, {UnitAmount: 5}}}, ErrInvalidPlan},
+		{"last tier closed", &models.Plan{PricingType: models.PricingTypeTiered, Tiers: []models.PlanTier{{UpTo: upTo(10), UnitAmount: 10}}}, ErrInvalidPlan},
+		{"decreasing up_to", &models.Plan{PricingType: models.PricingTypeTiered, Tiers: []models.PlanTier{{UpTo: upTo(10)}, {UpTo: upTo(10)}, {}}}, ErrInvalidPlan},
+		{"zero up_to", &models.Plan{PricingType: models.PricingTypeTiered, Tiers: []models.PlanTier{{UpTo: upTo(0)}, {}}}, ErrInvalidPlan},
+		{"negative amount", &models.Plan{PricingType: models.PricingTypeTiered, Tiers: []models.PlanTier{{FlatAmount: -1}}}, ErrInvalidAmount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateTiers(tt.plan); !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateTiers() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
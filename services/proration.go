@@ -0,0 +1,100 @@
+package services
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+)
+
+// prorate works out what moving subscription to quantity units of plan at
+// now costs under behavior. Only active subscriptions to licensed plans have
+// paid for the rest of their period, so other changes are not prorated and
+// simply take effect from the next renewal.
+func prorate(subscription *models.Subscription, plan *models.Plan, quantity int, behavior models.ProrationBehavior, now time.Time) (*models.Proration, error) {
+	current := subscription.Plan
+	if current == nil {
+		return nil, ErrPlanNotFound
+	}
+	// The balance is kept in the plan currency
+	if subscription.Balance != 0 && plan.Currency != current.Currency {
+		return nil, fmt.Errorf("%w: the subscription has a balance in %s", ErrInvalidCurrency, current.Currency)
+	}
+
+	proration := &models.Proration{
+		SubscriptionID: subscription.ID,
+		Behavior:       behavior,
+		ProrationDate:  now,
+		PeriodEnd:      subscription.CurrentPeriodEnd,
+		Currency:       plan.Currency,
+		LineItems:      []models.ProrationLineItem{},
+		Balance:        subscription.Balance,
+	}
+	unchanged := plan.ID == current.ID && quantity == subscription.Quantity
+	if behavior == models.ProrationBehaviorNone || unchanged || plan.IsMetered() ||
+		subscription.Status != models.SubscriptionStatusActive ||
+		now.Before(subscription.CurrentPeriodStart) || !now.Before(subscription.CurrentPeriodEnd) {
+		return proration, nil
+	}
+	if plan.Currency != current.Currency {
+		return nil, fmt.Errorf("%w: cannot prorate from %s to %s", ErrInvalidCurrency, current.Currency, plan.Currency)
+	}
+
+	paid, err := periodAmount(current, subscription.Quantity)
+	if err != nil {
+		return nil, err
+	}
+	price, err := periodAmount(plan, quantity)
+	if err != nil {
+		return nil, err
+	}
+	remaining := subscription.CurrentPeriodEnd.Sub(now)
+	length := subscription.CurrentPeriodEnd.Sub(subscription.CurrentPeriodStart)
+	proration.LineItems = append(proration.LineItems,
+		models.ProrationLineItem{
+			Description: "Unused time on " + current.Name,
+			PlanID:      current.ID,
+			Quantity:    subscription.Quantity,
+			Amount:      -prorateAmount(paid.Amount, remaining, length),
+		},
+		models.ProrationLineItem{
+			Description: "Remaining time on " + plan.Name,
+			PlanID:      plan.ID,
+			Quantity:    quantity,
+			Amount:      prorateAmount(price.Amount, remaining, length),
+		},
+	)
+
+	total := models.Money{Currency: plan.Currency}
+	for _, item := range proration.LineItems {
+		if total, err = total.Add(models.Money{Amount: item.Amount, Currency: plan.Currency}); err != nil {
+			return nil, err
+		}
+	}
+	proration.Total = total.Amount
+
+	// Credits are never paid out, only carried into the next renewal
+	if behavior == models.ProrationBehaviorImmediately && total.IsPositive() {
+		proration.AmountDue = total.Amount
+		return proration, nil
+	}
+	balance, err := models.Money{Amount: subscription.Balance, Currency: plan.Currency}.Add(total)
+	if err != nil {
+		return nil, err
+	}
+	proration.Balance = balance.Amount
+	return proration, nil
+}
+
+// prorateAmount is the share of amount for the remaining part of a period of
+// length, to the nearest minor unit. It works in whole seconds.
+func prorateAmount(amount int64, remaining, length time.Duration) int64 {
+	seconds := int64(length / time.Second)
+	if seconds <= 0 {
+		return 0
+	}
+	share := new(big.Int).Mul(big.NewInt(amount), big.NewInt(int64(remaining/time.Second)))
+	share.Add(share, big.NewInt(seconds/2))
+	return share.Quo(share, big.NewInt(seconds)).Int64()
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+)
+
+func TestProrate(t *testing.T) {
+	start := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 30)
+	halfway := start.AddDate(0, 0, 15)
+
+	basic := &models.Plan{ID: "basic", Name: "Basic", Amount: 1000, Currency: "USD", PricingType: models.PricingTypePerUnit}
+	pro := &models.Plan{ID: "pro", Name: "Pro", Amount: 3000, Currency: "USD", PricingType: models.PricingTypePerUnit}
+	lite := &models.Plan{ID: "lite", Name: "Lite", Amount: 400, Currency: "USD", PricingType: models.PricingTypePerUnit}
+	euro := &models.Plan{ID: "euro", Name: "Euro", Amount: 900, Currency: "EUR", PricingType: models.PricingTypePerUnit}
+	metered := &models.Plan{ID: "metered", Name: "Metered", Amount: 10, Currency: "USD", PricingType: models.PricingTypePerUnit,
+		UsageType: models.UsageTypeMetered}
+
+	subscription := func(modify func(*models.Subscription)) *models.Subscription {
+		s := &models.Subscription{
+			ID:                 "sub_1",
+			Plan:               basic,
+			Quantity:           1,
+			Status:             models.SubscriptionStatusActive,
+			CurrentPeriodStart: start,
+			CurrentPeriodEnd:   end,
+		}
+		if modify != nil {
+			modify(s)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name         string
+		subscription *models.Subscription
+		plan         *models.Plan
+		quantity     int
+		behavior     models.ProrationBehavior
+		now          time.Time
+		wantLines    int
+		wantTotal    int64
+		wantDue      int64
+		wantBalance  int64
+		wantErr      error
+	}{
+		{
+			name:         "upgrade charged immediately",
+			subscription: subscription(nil),
+			plan:         pro, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: halfway,
+			wantLines: 2, wantTotal: 1000, wantDue: 1000,
+		},
+		{
+			name:         "upgrade carried to the next renewal",
+			subscription: subscription(nil),
+			plan:         pro, quantity: 1, behavior: models.ProrationBehaviorNextRenewal, now: halfway,
+			wantLines: 2, wantTotal: 1000, wantBalance: 1000,
+		},
+		{
+			name:         "downgrade credits the balance",
+			subscription: subscription(nil),
+			plan:         lite, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: halfway,
+			wantLines: 2, wantTotal: -300, wantBalance: -300,
+		},
+		{
+			name:         "quantity change",
+			subscription: subscription(nil),
+			plan:         basic, quantity: 3, behavior: models.ProrationBehaviorImmediately, now: halfway,
+			wantLines: 2, wantTotal: 1000, wantDue: 1000,
+		},
+		{
+			name:         "existing balance is kept when charging immediately",
+			subscription: subscription(func(s *models.Subscription) { s.Balance = 200 }),
+			plan:         pro, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: halfway,
+			wantLines: 2, wantTotal: 1000, wantDue: 1000, wantBalance: 200,
+		},
+		{
+			name:         "existing balance is added to",
+			subscription: subscription(func(s *models.Subscription) { s.Balance = 200 }),
+			plan:         lite, quantity: 1, behavior: models.ProrationBehaviorNextRenewal, now: halfway,
+			wantLines: 2, wantTotal: -300, wantBalance: -100,
+		},
+		{
+			name:         "no proration",
+			subscription: subscription(func(s *models.Subscription) { s.Balance = 200 }),
+			plan:         pro, quantity: 1, behavior: models.ProrationBehaviorNone, now: halfway,
+			wantBalance: 200,
+		},
+		{
+			name:         "unchanged",
+			subscription: subscription(nil),
+			plan:         basic, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: halfway,
+		},
+		{
+			name:         "trial",
+			subscription: subscription(func(s *models.Subscription) { s.Status = models.SubscriptionStatusTrialing }),
+			plan:         pro, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: halfway,
+		},
+		{
+			name:         "metered plan",
+			subscription: subscription(nil),
+			plan:         metered, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: halfway,
+		},
+		{
+			name:         "at the end of the period",
+			subscription: subscription(nil),
+			plan:         pro, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: end,
+		},
+		{
+			name:         "at the start of the period",
+			subscription: subscription(nil),
+			plan:         pro, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: start,
+			wantLines: 2, wantTotal: 2000, wantDue: 2000,
+		},
+		{
+			name:         "currency change without proration",
+			subscription: subscription(nil),
+			plan:         euro, quantity: 1, behavior: models.ProrationBehaviorNone, now: halfway,
+		},
+		{
+			name:         "currency change with proration",
+			subscription: subscription(nil),
+			plan:         euro, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: halfway,
+			wantErr: ErrInvalidCurrency,
+		},
+		{
+			name:         "currency change with a balance",
+			subscription: subscription(func(s *models.Subscription) { s.Balance = 200 }),
+			plan:         euro, quantity: 1, behavior: models.ProrationBehaviorNone, now: halfway,
+			wantErr: ErrInvalidCurrency,
+		},
+		{
+			name:         "current plan not loaded",
+			subscription: subscription(func(s *models.Subscription) { s.Plan = nil }),
+			plan:         pro, quantity: 1, behavior: models.ProrationBehaviorImmediately, now: halfway,
+			wantErr: ErrPlanNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proration, err := prorate(tt.subscription, tt.plan, tt.quantity, tt.behavior, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("prorate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(proration.LineItems) != tt.wantLines {
+				t.Errorf("prorate() has %d line items, want %d", len(proration.LineItems), tt.wantLines)
+			}
+			if proration.Total != tt.wantTotal || proration.AmountDue != tt.wantDue || proration.Balance != tt.wantBalance {
+				t.Errorf("prorate() total, due, balance = %d, %d, %d, want %d, %d, %d",
+					proration.Total, proration.AmountDue, proration.Balance, tt.wantTotal, tt.wantDue, tt.wantBalance)
+			}
+		})
+	}
+}
+
+func TestProrateAmount(t *testing.T) {
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name      string
+		amount    int64
+		remaining time.Duration
+		length    time.Duration
+		want      int64
+	}{
+		{"whole period", 1000, 30 * day, 30 * day, 1000},
+		{"half period", 1000, 15 * day, 30 * day, 500},
+		{"rounds down", 1000, 10 * day, 30 * day, 333},
+		{"rounds half up", 999, 15 * day, 30 * day, 500},
+		{"nothing remaining", 1000, 0, 30 * day, 0},
+		{"empty period", 1000, 0, 0, 0},
+		{"large amount", 1 << 62, 15 * day, 30 * day, 1 << 61},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prorateAmount(tt.amount, tt.remaining, tt.length); got != tt.want {
+				t.Errorf("prorateAmount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,31 +3,90 @@ package services
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/malwarebo/gopay/config"
 	"github.com/malwarebo/gopay/models"
 	"github.com/malwarebo/gopay/providers"
 	"github.com/malwarebo/gopay/repositories"
+	"gorm.io/gorm"
 )
 
 var (
 	ErrPlanNotFound = errors.New("plan not found")
 	ErrNoAvailableProvider = errors.New("no available payment provider")
+	// ErrSubscriptionNotFound is returned when the subscription does not exist
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	// ErrInvalidPlan is returned when a plan is missing a name or has an unsupported pricing type
+	ErrInvalidPlan = errors.New("invalid plan")
+	// ErrPlanInactive is returned when subscribing to a deleted plan
+	ErrPlanInactive = errors.New("plan is no longer active")
+	// ErrPlanBillingMismatch is returned when moving a subscription between a
+	// native plan and a provider-billed one, and when moving a native
+	// subscription to a plan with a different billing period
+	ErrPlanBillingMismatch = errors.New("plan is billed differently from the subscription")
+	// ErrInvalidQuantity is returned for subscription quantities below one
+	// and negative usage quantities
+	ErrInvalidQuantity = errors.New("invalid quantity")
+	// ErrPlanNotMetered is returned when recording or querying usage of a
+	// subscription whose plan is not metered
+	ErrPlanNotMetered = errors.New("plan is not metered")
+	// ErrInvalidUsage is returned for usage records outside the period that
+	// is open for usage, for unknown usage periods and for paused subscriptions
+	ErrInvalidUsage = errors.New("invalid usage")
+	// ErrSubscriptionCanceled is returned when changing a canceled subscription
+	ErrSubscriptionCanceled = errors.New("subscription is canceled")
+	// ErrFirstPaymentIncomplete is returned when the first charge of a native
+	// subscription did not succeed straight away, e.g. because it needs
+	// customer action
+	ErrFirstPaymentIncomplete = errors.New("first subscription payment did not complete")
+	// ErrInvalidTrial is returned for negative trial lengths
+	ErrInvalidTrial = errors.New("invalid trial")
+	// ErrProrationPaymentIncomplete is returned when the immediate proration
+	// charge of a plan or quantity change did not succeed straight away
+	ErrProrationPaymentIncomplete = errors.New("proration payment did not complete")
+	// ErrInvalidPause is returned for unknown pause modes and resume dates
+	// that are not in the future
+	ErrInvalidPause = errors.New("invalid pause")
+	// ErrCannotPause is returned when pausing a subscription that is already
+	// paused or is not active or trialing
+	ErrCannotPause = errors.New("subscription cannot be paused")
+	// ErrSubscriptionNotPaused is returned when resuming a subscription that
+	// is not paused
+	ErrSubscriptionNotPaused = errors.New("subscription is not paused")
+	// ErrSubscriptionChanged is returned when a change would overwrite a
+	// renewal in progress or a change made since the subscription was read;
+	// the request can be retried
+	ErrSubscriptionChanged = repositories.ErrSubscriptionChanged
 )
 
+// refundTimeout bounds the refund of a charge made for a subscription, or a
+// change to one, that could not be stored
+const refundTimeout = 30 * time.Second
+
+// SubscriptionService manages plans and subscriptions. Native plans live only
+// in our database and their subscriptions are charged by the billing engine;
+// provider-billed plans are created with and managed by their provider.
 type SubscriptionService struct {
 	providers    []providers.PaymentProvider
 	planRepo     *repositories.PlanRepository
 	subRepo      *repositories.SubscriptionRepository
+	usageRepo    *repositories.UsageRepository
+	payments     *PaymentService
+	cfg          config.BillingConfig
 	mu           sync.RWMutex
 }
 
-func NewSubscriptionService(planRepo *repositories.PlanRepository, subRepo *repositories.SubscriptionRepository, providers ...providers.PaymentProvider) *SubscriptionService {
+func NewSubscriptionService(planRepo *repositories.PlanRepository, subRepo *repositories.SubscriptionRepository, usageRepo *repositories.UsageRepository, payments *PaymentService, cfg config.BillingConfig, providers ...providers.PaymentProvider) *SubscriptionService {
 	return &SubscriptionService{
 		providers: providers,
 		planRepo:  planRepo,
 		subRepo:   subRepo,
+		usageRepo: usageRepo,
+		payments:  payments,
+		cfg:       cfg,
 	}
 }
 
@@ -50,55 +109,112 @@ func (s *SubscriptionService) getAvailableProvider(ctx context.Context) provider
 }
 
 // Plan Management
+
+// CreatePlan stores a new plan. The billing config decides from the plan
+// name whether it is native or created with a provider.
 func (s *SubscriptionService) CreatePlan(ctx context.Context, plan *models.Plan) (*models.Plan, error) {
-	provider := s.getAvailableProvider(ctx)
-	if provider == nil {
-		return nil, ErrNoAvailableProvider
+	if err := validatePlan(plan); err != nil {
+		return nil, err
+	}
+	plan.ProviderName = s.cfg.ProviderForPlan(plan.Name)
+	plan.ProviderPlanID = ""
+	if plan.IsMetered() && !plan.IsNative() {
+		return nil, fmt.Errorf("%w: metered plans can only be billed natively, not by %s", ErrInvalidPlan, plan.ProviderName)
+	}
+	// Native plans are renewed by charging the stored payment method
+	if plan.IsNative() {
+		if err := s.payments.CheckOffSession(plan.Currency); err != nil {
+			return nil, err
+		}
 	}
 
-	// Create plan in payment provider
-	providerPlan, err := provider.CreatePlan(ctx, plan)
-	if err != nil {
-		return nil, err
+	if !plan.IsNative() {
+		provider := s.getAvailableProvider(ctx)
+		if provider == nil {
+			return nil, ErrNoAvailableProvider
+		}
+
+		// Create plan in payment provider
+		providerPlan, err := provider.CreatePlan(ctx, plan)
+		if err != nil {
+			return nil, err
+		}
+		plan = providerPlan
 	}
 
 	// Store plan in database
-	if err := s.planRepo.Create(ctx, providerPlan); err != nil {
+	if err := s.planRepo.Create(ctx, plan); err != nil {
 		return nil, err
 	}
 
-	return providerPlan, nil
+	return plan, nil
 }
 
+// UpdatePlan applies the non-empty fields of plan to a stored plan. Changes
+// to the price take effect from the next renewal.
 func (s *SubscriptionService) UpdatePlan(ctx context.Context, planID string, plan *models.Plan) (*models.Plan, error) {
-	provider := s.getAvailableProvider(ctx)
-	if provider == nil {
-		return nil, ErrNoAvailableProvider
+	if !plan.DunningAction.Valid() {
+		return nil, models.ErrInvalidDunningAction
 	}
-
-	// Update plan in payment provider
-	updatedPlan, err := provider.UpdatePlan(ctx, planID, plan)
+	existing, err := s.getPlan(ctx, planID)
 	if err != nil {
 		return nil, err
 	}
+	// Switching between charging in advance and in arrears would bill the
+	// current period of existing subscriptions twice or not at all
+	if plan.UsageType != "" && plan.UsageType != existing.UsageType {
+		return nil, fmt.Errorf("%w: the usage type of a plan cannot change", ErrInvalidPlan)
+	}
 
-	// Update plan in database
-	if err := s.planRepo.Update(ctx, updatedPlan); err != nil {
+	mergePlan(existing, plan)
+	if err := validatePlan(existing); err != nil {
 		return nil, err
 	}
+	if existing.IsNative() {
+		if err := s.payments.CheckOffSession(existing.Currency); err != nil {
+			return nil, err
+		}
+	}
+
+	if !existing.IsNative() {
+		provider := s.getAvailableProvider(ctx)
+		if provider == nil {
+			return nil, ErrNoAvailableProvider
+		}
 
-	return updatedPlan, nil
+		// Update plan in payment provider, which may give it a new provider ID
+		updatedPlan, err := provider.UpdatePlan(ctx, existing.ProviderPlanID, existing)
+		if err != nil {
+			return nil, err
+		}
+		existing.ProviderPlanID = updatedPlan.ProviderPlanID
+	}
+
+	// Update plan in database
+	if err := s.planRepo.Update(ctx, existing); err != nil {
+		return nil, err
+	}
+	return existing, nil
 }
 
+// DeletePlan deactivates a plan so that no new subscriptions can be created
+// for it. Existing subscriptions keep renewing.
 func (s *SubscriptionService) DeletePlan(ctx context.Context, planID string) error {
-	provider := s.getAvailableProvider(ctx)
-	if provider == nil {
-		return ErrNoAvailableProvider
+	plan, err := s.getPlan(ctx, planID)
+	if err != nil {
+		return err
 	}
 
-	// Delete plan from payment provider
-	if err := provider.DeletePlan(ctx, planID); err != nil {
-		return err
+	if !plan.IsNative() {
+		provider := s.getAvailableProvider(ctx)
+		if provider == nil {
+			return ErrNoAvailableProvider
+		}
+
+		// Delete plan from payment provider
+		if err := provider.DeletePlan(ctx, plan.ProviderPlanID); err != nil {
+			return err
+		}
 	}
 
 	// Delete plan from database
@@ -107,7 +223,7 @@ func (s *SubscriptionService) DeletePlan(ctx context.Context, planID string) err
 
 func (s *SubscriptionService) GetPlan(ctx context.Context, planID string) (*models.Plan, error) {
 	// Get plan from database
-	return s.planRepo.GetByID(ctx, planID)
+	return s.getPlan(ctx, planID)
 }
 
 func (s *SubscriptionService) ListPlans(ctx context.Context) ([]*models.Plan, error) {
@@ -115,17 +231,117 @@ func (s *SubscriptionService) ListPlans(ctx context.Context) ([]*models.Plan, er
 	return s.planRepo.List(ctx)
 }
 
-// Subscription Management
-func (s *SubscriptionService) CreateSubscription(ctx context.Context, req *models.CreateSubscriptionRequest) (*models.Subscription, error) {
-	provider := s.getAvailableProvider(ctx)
-	if provider == nil {
-		return nil, ErrNoAvailableProvider
+// QuotePlan prices one billing period of the plan for quantity units, line
+// by line
+func (s *SubscriptionService) QuotePlan(ctx context.Context, planID string, quantity int64) (*models.Quote, error) {
+	plan, err := s.getPlan(ctx, planID)
+	if err != nil {
+		return nil, err
+	}
+	return QuotePlan(plan, quantity)
+}
+
+func (s *SubscriptionService) getPlan(ctx context.Context, planID string) (*models.Plan, error) {
+	plan, err := s.planRepo.GetByID(ctx, planID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPlanNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get plan: %w", err)
+	}
+	return plan, nil
+}
+
+// validatePlan normalizes the currency and pricing type of a plan and checks
+// that its billing period is one we can renew
+func validatePlan(plan *models.Plan) error {
+	if plan.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidPlan)
+	}
+	if plan.Amount < 0 {
+		return ErrInvalidAmount
+	}
+	price, err := models.NewMoney(plan.Amount, plan.Currency)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCurrency, err)
+	}
+	plan.Currency = price.Currency
+	if _, err := plan.BillingPeriod.Advance(time.Now(), time.Now()); err != nil {
+		return fmt.Errorf("%w: %q", err, plan.BillingPeriod)
+	}
+	switch plan.PricingType {
+	case "":
+		plan.PricingType = models.PricingTypeFixed
+	case models.PricingTypeFixed, models.PricingTypePerUnit, models.PricingTypeTiered, models.PricingTypeVolume:
+	default:
+		return fmt.Errorf("%w: unsupported pricing type %q", ErrInvalidPlan, plan.PricingType)
+	}
+	if err := validateTiers(plan); err != nil {
+		return err
+	}
+	if err := validateUsage(plan); err != nil {
+		return err
+	}
+	if !plan.DunningAction.Valid() {
+		return models.ErrInvalidDunningAction
+	}
+	return nil
+}
+
+// mergePlan copies the fields set in update onto plan. The billing provider
+// of a plan never changes.
+func mergePlan(plan *models.Plan, update *models.Plan) {
+	if update.Name != "" {
+		plan.Name = update.Name
+	}
+	if update.Description != "" {
+		plan.Description = update.Description
+	}
+	if update.Amount != 0 {
+		plan.Amount = update.Amount
 	}
+	if update.Currency != "" {
+		plan.Currency = update.Currency
+	}
+	if update.BillingPeriod != "" {
+		plan.BillingPeriod = update.BillingPeriod
+	}
+	if update.PricingType != "" {
+		plan.PricingType = update.PricingType
+		// Tiers belong to the pricing type they were set for
+		if update.PricingType != models.PricingTypeTiered && update.PricingType != models.PricingTypeVolume {
+			plan.Tiers = nil
+		}
+	}
+	if update.Tiers != nil {
+		plan.Tiers = update.Tiers
+	}
+	if update.UsageAggregation != "" {
+		plan.UsageAggregation = update.UsageAggregation
+	}
+	if update.TrialDays != 0 {
+		plan.TrialDays = update.TrialDays
+	}
+	if update.DunningAction != "" {
+		plan.DunningAction = update.DunningAction
+	}
+	if update.Features != nil {
+		plan.Features = update.Features
+	}
+	if update.Metadata != nil {
+		plan.Metadata = update.Metadata
+	}
+}
 
+// Subscription Management
+func (s *SubscriptionService) CreateSubscription(ctx context.Context, req *models.CreateSubscriptionRequest) (*models.Subscription, error) {
 	// Validate plan exists
-	plan, err := s.planRepo.GetByID(ctx, req.PlanID)
+	plan, err := s.getPlan(ctx, req.PlanID)
 	if err != nil {
-		return nil, ErrPlanNotFound
+		return nil, err
+	}
+	if !plan.Active {
+		return nil, ErrPlanInactive
 	}
 
 	// If trial days not specified, use plan's trial days
@@ -134,11 +350,28 @@ func (s *SubscriptionService) CreateSubscription(ctx context.Context, req *model
 		req.TrialDays = &trialDays
 	}
 
+	if plan.IsNative() {
+		return s.createNativeSubscription(ctx, plan, req)
+	}
+
+	provider := s.getAvailableProvider(ctx)
+	if provider == nil {
+		return nil, ErrNoAvailableProvider
+	}
+
 	// Create subscription in payment provider
+	req.ProviderPlanID = plan.ProviderPlanID
+	req.Plan = plan
 	subscription, err := provider.CreateSubscription(ctx, req)
 	if err != nil {
 		return nil, err
 	}
+	subscription.PlanID = plan.ID
+
+	// Renewals keep falling on the day of the month the subscription started
+	if subscription.BillingCycleAnchor.IsZero() {
+		subscription.BillingCycleAnchor = subscription.CurrentPeriodStart
+	}
 
 	// Store subscription in database
 	if err := s.subRepo.Create(ctx, subscription); err != nil {
@@ -148,61 +381,430 @@ func (s *SubscriptionService) CreateSubscription(ctx context.Context, req *model
 	return subscription, nil
 }
 
+// createNativeSubscription charges the first period to the request's payment
+// method and stores the subscription once the charge succeeds, refunding the
+// charge if it cannot be stored, or starts the trial if the subscription has
+// one. Later periods are charged by the billing
+// engine.
+func (s *SubscriptionService) createNativeSubscription(ctx context.Context, plan *models.Plan, req *models.CreateSubscriptionRequest) (*models.Subscription, error) {
+	quantity := req.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	if quantity < 1 {
+		return nil, ErrInvalidQuantity
+	}
+	trialDays := 0
+	if req.TrialDays != nil {
+		trialDays = *req.TrialDays
+	}
+	if trialDays < 0 {
+		return nil, fmt.Errorf("%w: trial_days cannot be negative", ErrInvalidTrial)
+	}
+	// The routing rules may have changed since the plan was created
+	if err := s.payments.CheckOffSession(plan.Currency); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	periodEnd, err := plan.BillingPeriod.Advance(now, now)
+	if err != nil {
+		return nil, err
+	}
+	// Metered plans charge nothing up front; each period's usage is charged
+	// when the period ends
+	var amount models.Money
+	if !plan.IsMetered() {
+		if amount, err = periodAmount(plan, quantity); err != nil {
+			return nil, err
+		}
+	}
+
+	subscription := &models.Subscription{
+		CustomerID:         req.CustomerID,
+		PlanID:             plan.ID,
+		Status:             models.SubscriptionStatusActive,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   periodEnd,
+		BillingCycleAnchor: now,
+		Quantity:           quantity,
+		PaymentMethodID:    req.PaymentMethodID,
+		Metadata:           req.Metadata,
+	}
+
+	if trialDays > 0 {
+		// The trial is a free first period that the billing engine converts
+		// when it ends, so the payment method can still be added until then.
+		// Later periods are counted from the end of the trial.
+		trialStart, trialEnd := now, now.AddDate(0, 0, trialDays)
+		subscription.Status = models.SubscriptionStatusTrialing
+		subscription.CurrentPeriodEnd = trialEnd
+		subscription.BillingCycleAnchor = trialEnd
+		subscription.TrialStart = &trialStart
+		subscription.TrialEnd = &trialEnd
+		amount = models.Money{}
+	} else if (amount.IsPositive() || plan.IsMetered()) && req.PaymentMethodID == "" {
+		return nil, ErrInvalidPaymentMethod
+	}
+
+	if amount.IsPositive() {
+		resp, err := s.payments.CreateCharge(ctx, &models.ChargeRequest{
+			CustomerID:    req.CustomerID,
+			Amount:        amount.Amount,
+			Currency:      amount.Currency,
+			PaymentMethod: req.PaymentMethodID,
+			OffSession:    true,
+			Description:   fmt.Sprintf("Subscription to plan %s", plan.Name),
+			Metadata: models.JSON{
+				"plan_id":      plan.ID,
+				"period_start": now.UTC().Format(time.RFC3339),
+				"period_end":   periodEnd.UTC().Format(time.RFC3339),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status != models.PaymentStatusSuccess {
+			return nil, fmt.Errorf("%w: payment %s is %s", ErrFirstPaymentIncomplete, resp.ID, resp.Status)
+		}
+		subscription.LatestPaymentID = &resp.ID
+	}
+
+	if err := s.subRepo.Create(ctx, subscription); err != nil {
+		if subscription.LatestPaymentID != nil {
+			paymentID := *subscription.LatestPaymentID
+			if refundErr := s.refundCharge(paymentID, amount, models.JSON{"plan_id": plan.ID}); refundErr != nil {
+				return nil, fmt.Errorf("failed to store subscription: %w (refunding payment %s: %v)", err, paymentID, refundErr)
+			}
+		}
+		return nil, fmt.Errorf("failed to store subscription: %w", err)
+	}
+	subscription.Plan = plan
+	return subscription, nil
+}
+
 func (s *SubscriptionService) UpdateSubscription(ctx context.Context, subscriptionID string, req *models.UpdateSubscriptionRequest) (*models.Subscription, error) {
+	if !req.ProrationBehavior.Valid() {
+		return nil, models.ErrInvalidProrationBehavior
+	}
+	existing, err := s.getSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := s.planForUpdate(ctx, existing, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.IsNative() {
+		return s.updateNativeSubscription(ctx, existing, plan, req)
+	}
+
 	provider := s.getAvailableProvider(ctx)
 	if provider == nil {
 		return nil, ErrNoAvailableProvider
 	}
 
-	// If changing plans, validate new plan exists
-	if req.PlanID != nil {
-		if _, err := s.planRepo.GetByID(ctx, *req.PlanID); err != nil {
-			return nil, ErrPlanNotFound
-		}
-	}
-
 	// Update subscription in payment provider
-	subscription, err := provider.UpdateSubscription(ctx, subscriptionID, req)
+	if plan != nil {
+		req.ProviderPlanID = plan.ProviderPlanID
+		req.Plan = plan
+	} else {
+		req.Plan = existing.Plan
+	}
+	updated, err := provider.UpdateSubscription(ctx, existing.ProviderSubscriptionID, req)
 	if err != nil {
 		return nil, err
 	}
+	existing.ApplyProviderState(updated)
+	if plan != nil {
+		existing.PlanID = plan.ID
+		existing.Plan = plan
+	}
+	if req.Metadata != nil {
+		existing.Metadata = req.Metadata
+	}
 
 	// Update subscription in database
-	if err := s.subRepo.Update(ctx, subscription); err != nil {
+	if err := s.subRepo.Update(ctx, existing); err != nil {
 		return nil, err
 	}
 
+	return existing, nil
+}
+
+// PreviewUpdate returns the proration UpdateSubscription would apply to req
+// right now, without changing anything. Only native subscriptions are
+// prorated by gopay.
+func (s *SubscriptionService) PreviewUpdate(ctx context.Context, subscriptionID string, req *models.UpdateSubscriptionRequest) (*models.Proration, error) {
+	if !req.ProrationBehavior.Valid() {
+		return nil, models.ErrInvalidProrationBehavior
+	}
+	existing, err := s.getSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if !existing.IsNative() {
+		return nil, fmt.Errorf("%w: proration previews are only available for native subscriptions", providers.ErrOperationNotSupported)
+	}
+	if existing.Status == models.SubscriptionStatusCanceled {
+		return nil, ErrSubscriptionCanceled
+	}
+	plan, err := s.planForUpdate(ctx, existing, req)
+	if err != nil {
+		return nil, err
+	}
+	return s.prorateUpdate(existing, plan, req, time.Now())
+}
+
+// planForUpdate returns the plan an update moves the subscription to, or nil
+// if it keeps its plan
+func (s *SubscriptionService) planForUpdate(ctx context.Context, subscription *models.Subscription, req *models.UpdateSubscriptionRequest) (*models.Plan, error) {
+	if req.PlanID == nil {
+		return nil, nil
+	}
+	plan, err := s.getPlan(ctx, *req.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	if plan.IsNative() != subscription.IsNative() {
+		return nil, ErrPlanBillingMismatch
+	}
+	if subscription.Plan != nil && plan.IsMetered() != subscription.Plan.IsMetered() {
+		return nil, fmt.Errorf("%w: cannot move between metered and licensed plans", ErrPlanBillingMismatch)
+	}
+	// Proration credits and charges the rest of the current period, which
+	// only works if the new plan bills periods of the same length
+	if subscription.IsNative() && subscription.Plan != nil && plan.BillingPeriod != subscription.Plan.BillingPeriod {
+		return nil, fmt.Errorf("%w: cannot move from a %s plan to a %s one", ErrPlanBillingMismatch, subscription.Plan.BillingPeriod, plan.BillingPeriod)
+	}
+	return plan, nil
+}
+
+// prorateUpdate works out the proration of a native subscription update,
+// falling back to the configured proration behavior
+func (s *SubscriptionService) prorateUpdate(subscription *models.Subscription, plan *models.Plan, req *models.UpdateSubscriptionRequest, now time.Time) (*models.Proration, error) {
+	if plan == nil {
+		plan = subscription.Plan
+	}
+	quantity := subscription.Quantity
+	if req.Quantity != nil {
+		if *req.Quantity < 1 {
+			return nil, ErrInvalidQuantity
+		}
+		quantity = *req.Quantity
+	}
+	behavior := req.ProrationBehavior
+	if behavior == "" {
+		behavior = models.ProrationBehavior(s.cfg.ProrationBehavior)
+	}
+	return prorate(subscription, plan, quantity, behavior, now)
+}
+
+// updateNativeSubscription applies the change to the stored subscription and
+// prorates it. An immediate proration charge must succeed for the change to
+// be made, and is refunded if the change cannot be stored; otherwise the
+// proration is carried in the subscription's balance and the new plan or
+// quantity is charged in full from the next renewal.
+func (s *SubscriptionService) updateNativeSubscription(ctx context.Context, subscription *models.Subscription, plan *models.Plan, req *models.UpdateSubscriptionRequest) (*models.Subscription, error) {
+	if subscription.Status == models.SubscriptionStatusCanceled {
+		return nil, ErrSubscriptionCanceled
+	}
+	// A renewal in progress would refuse the change, so fail before the
+	// proration is charged
+	now := time.Now()
+	if subscription.LeaseExpiresAt != nil && subscription.LeaseExpiresAt.After(now) {
+		return nil, ErrSubscriptionChanged
+	}
+	proration, err := s.prorateUpdate(subscription, plan, req, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if plan != nil {
+		subscription.PlanID = plan.ID
+		subscription.Plan = plan
+	}
+	if req.Quantity != nil {
+		subscription.Quantity = *req.Quantity
+	}
+	if req.PaymentMethodID != nil {
+		subscription.PaymentMethodID = *req.PaymentMethodID
+	}
+	if req.Metadata != nil {
+		subscription.Metadata = req.Metadata
+	}
+	subscription.Balance = proration.Balance
+
+	var events []*models.SubscriptionEvent
+	var paymentID string
+	if len(proration.LineItems) > 0 {
+		event := &models.SubscriptionEvent{
+			Type: models.SubscriptionEventProrated,
+			Data: models.JSON{
+				"behavior":   string(proration.Behavior),
+				"total":      proration.Total,
+				"amount_due": proration.AmountDue,
+				"balance":    proration.Balance,
+			},
+		}
+		if proration.AmountDue > 0 {
+			if paymentID, err = s.chargeProration(ctx, subscription, proration); err != nil {
+				return nil, err
+			}
+			subscription.LatestPaymentID = &paymentID
+			event.Data["payment_id"] = paymentID
+		}
+		events = append(events, event)
+	}
+
+	if err := s.subRepo.Update(ctx, subscription, events...); err != nil {
+		if paymentID != "" {
+			amount := models.Money{Amount: proration.AmountDue, Currency: proration.Currency}
+			if refundErr := s.refundCharge(paymentID, amount, models.JSON{"subscription_id": subscription.ID}); refundErr != nil {
+				return nil, fmt.Errorf("failed to update subscription: %w (refunding proration payment %s: %v)", err, paymentID, refundErr)
+			}
+		}
+		return nil, fmt.Errorf("failed to update subscription: %w", err)
+	}
 	return subscription, nil
 }
 
+// refundCharge refunds a charge made for a subscription or a change to one
+// that could not be stored. It runs on a context of its own, since the
+// request's may be what cut the write short.
+func (s *SubscriptionService) refundCharge(paymentID string, amount models.Money, metadata models.JSON) error {
+	ctx, cancel := context.WithTimeout(context.Background(), refundTimeout)
+	defer cancel()
+	ctx = providers.WithIdempotencyKey(ctx, "subscription_refund:"+paymentID)
+
+	_, err := s.payments.CreateRefund(ctx, &models.RefundRequest{
+		PaymentID: paymentID,
+		Amount:    amount.Amount,
+		Currency:  amount.Currency,
+		Reason:    "requested_by_customer",
+		Metadata:  metadata,
+	})
+	return err
+}
+
+// chargeProration charges the amount due on a change to the subscription's
+// payment method and returns the payment ID
+func (s *SubscriptionService) chargeProration(ctx context.Context, subscription *models.Subscription, proration *models.Proration) (string, error) {
+	if subscription.PaymentMethodID == "" {
+		return "", ErrInvalidPaymentMethod
+	}
+	resp, err := s.payments.CreateCharge(ctx, &models.ChargeRequest{
+		CustomerID:    subscription.CustomerID,
+		Amount:        proration.AmountDue,
+		Currency:      proration.Currency,
+		PaymentMethod: subscription.PaymentMethodID,
+		OffSession:    true,
+		Description:   fmt.Sprintf("Proration of subscription %s", subscription.ID),
+		Metadata: models.JSON{
+			"subscription_id": subscription.ID,
+			"proration_date":  proration.ProrationDate.UTC().Format(time.RFC3339),
+			"period_end":      proration.PeriodEnd.UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Status != models.PaymentStatusSuccess {
+		return "", fmt.Errorf("%w: payment %s is %s", ErrProrationPaymentIncomplete, resp.ID, resp.Status)
+	}
+	return resp.ID, nil
+}
+
 func (s *SubscriptionService) CancelSubscription(ctx context.Context, subscriptionID string, req *models.CancelSubscriptionRequest) (*models.Subscription, error) {
+	existing, err := s.getSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.IsNative() {
+		return s.cancelNativeSubscription(ctx, existing, req)
+	}
+
 	provider := s.getAvailableProvider(ctx)
 	if provider == nil {
 		return nil, ErrNoAvailableProvider
 	}
 
 	// Cancel subscription in payment provider
-	subscription, err := provider.CancelSubscription(ctx, subscriptionID, req)
+	canceled, err := provider.CancelSubscription(ctx, existing.ProviderSubscriptionID, req)
 	if err != nil {
 		return nil, err
 	}
+	existing.ApplyProviderState(canceled)
+	if existing.Status == models.SubscriptionStatusCanceled && existing.CanceledAt == nil {
+		now := time.Now()
+		existing.CanceledAt = &now
+	}
 
 	// Update subscription in database
-	now := time.Now()
-	subscription.CanceledAt = &now
-	if err := s.subRepo.Update(ctx, subscription); err != nil {
+	if err := s.subRepo.Update(ctx, existing); err != nil {
 		return nil, err
 	}
 
+	return existing, nil
+}
+
+// cancelNativeSubscription cancels immediately or leaves the billing engine
+// to cancel the subscription instead of renewing it at the end of the period
+func (s *SubscriptionService) cancelNativeSubscription(ctx context.Context, subscription *models.Subscription, req *models.CancelSubscriptionRequest) (*models.Subscription, error) {
+	if subscription.Status == models.SubscriptionStatusCanceled {
+		return subscription, nil
+	}
+
+	if req.CancelAtPeriodEnd {
+		subscription.CancelAtPeriodEnd = true
+	} else {
+		now := time.Now()
+		subscription.Status = models.SubscriptionStatusCanceled
+		subscription.CanceledAt = &now
+		subscription.NextRetryAt = nil
+		subscription.PauseMode = ""
+		subscription.ResumeAt = nil
+	}
+
+	if err := s.subRepo.Update(ctx, subscription); err != nil {
+		return nil, fmt.Errorf("failed to cancel subscription: %w", err)
+	}
 	return subscription, nil
 }
 
 func (s *SubscriptionService) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
 	// Get subscription from database
-	return s.subRepo.GetByID(ctx, subscriptionID)
+	return s.getSubscription(ctx, subscriptionID)
 }
 
 func (s *SubscriptionService) ListSubscriptions(ctx context.Context, customerID string) ([]*models.Subscription, error) {
 	// Get subscriptions from database
 	return s.subRepo.ListByCustomer(ctx, customerID)
 }
+
+// ListEvents returns the renewal attempts and other events of a
+// subscription, oldest first
+func (s *SubscriptionService) ListEvents(ctx context.Context, subscriptionID string) ([]*models.SubscriptionEvent, error) {
+	if _, err := s.getSubscription(ctx, subscriptionID); err != nil {
+		return nil, err
+	}
+
+	events, err := s.subRepo.ListEvents(ctx, subscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscription events: %w", err)
+	}
+	return events, nil
+}
+
+func (s *SubscriptionService) getSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	subscription, err := s.subRepo.GetByID(ctx, subscriptionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	return subscription, nil
+}
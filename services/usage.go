@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+	"github.com/malwarebo/gopay/providers"
+)
+
+// usageClockSkew is how far in the future a usage timestamp may be, to allow
+// for clients whose clocks run slightly ahead of ours
+const usageClockSkew = 5 * time.Minute
+
+// RecordUsage stores a usage record for a subscription to a metered plan.
+// Usage can only be recorded for the open period: the current period until
+// it ends, and the next one while the ended period waits to be billed.
+// Recording again with the same idempotency key returns the first record.
+func (s *SubscriptionService) RecordUsage(ctx context.Context, subscriptionID string, req *models.RecordUsageRequest) (*models.UsageRecord, error) {
+	subscription, err := s.getSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if subscription.Plan == nil || !subscription.Plan.IsMetered() {
+		return nil, ErrPlanNotMetered
+	}
+	if subscription.Status == models.SubscriptionStatusCanceled {
+		return nil, ErrSubscriptionCanceled
+	}
+	if subscription.Status == models.SubscriptionStatusPaused {
+		return nil, fmt.Errorf("%w: subscription is paused", ErrInvalidUsage)
+	}
+	if req.Quantity < 0 {
+		return nil, ErrInvalidQuantity
+	}
+
+	now := time.Now()
+	timestamp := now
+	if req.Timestamp != nil {
+		timestamp = *req.Timestamp
+	}
+	opensAt := subscription.CurrentPeriodStart
+	if !now.Before(subscription.CurrentPeriodEnd) {
+		opensAt = subscription.CurrentPeriodEnd
+	}
+	if timestamp.Before(opensAt) {
+		return nil, fmt.Errorf("%w: timestamp is before the open period, which started at %s", ErrInvalidUsage, opensAt.UTC().Format(time.RFC3339))
+	}
+	if timestamp.After(now.Add(usageClockSkew)) {
+		return nil, fmt.Errorf("%w: timestamp is in the future", ErrInvalidUsage)
+	}
+
+	record := &models.UsageRecord{
+		SubscriptionID: subscription.ID,
+		Quantity:       req.Quantity,
+		Timestamp:      timestamp,
+	}
+	key := providers.IdempotencyKeyFromContext(ctx)
+	if key != "" {
+		record.IdempotencyKey = &key
+	}
+
+	created, err := s.usageRepo.Create(ctx, record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record usage: %w", err)
+	}
+	if !created {
+		record, err = s.usageRepo.GetByIdempotencyKey(ctx, subscription.ID, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get usage record: %w", err)
+		}
+	}
+	return record, nil
+}
+
+// GetUsage summarizes the usage of a subscription to a metered plan during
+// the billing period that starts at periodStart, or the current period if
+// periodStart is nil, and prices it with the subscription's plan.
+func (s *SubscriptionService) GetUsage(ctx context.Context, subscriptionID string, periodStart *time.Time) (*models.UsageSummary, error) {
+	subscription, err := s.getSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	plan := subscription.Plan
+	if plan == nil || !plan.IsMetered() {
+		return nil, ErrPlanNotMetered
+	}
+
+	start, end := subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd
+	if periodStart != nil && !periodStart.Equal(start) {
+		if periodStart.After(start) {
+			return nil, fmt.Errorf("%w: period_start is after the current period", ErrInvalidUsage)
+		}
+		start = *periodStart
+		if end, err = plan.BillingPeriod.Advance(start, billingCycleAnchor(subscription)); err != nil {
+			return nil, err
+		}
+	}
+
+	quantity, err := s.usageRepo.Aggregate(ctx, subscription.ID, plan.UsageAggregation, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate usage: %w", err)
+	}
+	records, err := s.usageRepo.List(ctx, subscription.ID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list usage records: %w", err)
+	}
+	quote, err := QuotePlan(plan, quantity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.UsageSummary{
+		SubscriptionID: subscription.ID,
+		PeriodStart:    start,
+		PeriodEnd:      end,
+		Aggregation:    plan.UsageAggregation,
+		Quantity:       quantity,
+		Quote:          quote,
+		Records:        records,
+	}, nil
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/malwarebo/gopay/models"
+	"github.com/malwarebo/gopay/providers"
+	"github.com/malwarebo/gopay/repositories"
+	"gorm.io/gorm"
+)
+
+// ErrUnknownWebhookProvider is returned for webhooks from a provider we have no parser for
+var ErrUnknownWebhookProvider = errors.New("unknown webhook provider")
+
+// WebhookService verifies provider webhooks and applies them to our records.
+// Each event is applied at most once.
+type WebhookService struct {
+	paymentRepo *repositories.PaymentRepository
+	subRepo     *repositories.SubscriptionRepository
+	disputeRepo *repositories.DisputeRepository
+	webhookRepo *repositories.WebhookEventRepository
+	parsers     map[string]providers.WebhookParser
+}
+
+func NewWebhookService(paymentRepo *repositories.PaymentRepository, subRepo *repositories.SubscriptionRepository, disputeRepo *repositories.DisputeRepository, webhookRepo *repositories.WebhookEventRepository, parsers ...providers.WebhookParser) *WebhookService {
+	s := &WebhookService{
+		paymentRepo: paymentRepo,
+		subRepo:     subRepo,
+		disputeRepo: disputeRepo,
+		webhookRepo: webhookRepo,
+		parsers:     make(map[string]providers.WebhookParser),
+	}
+	for _, parser := range parsers {
+		s.parsers[parser.Name()] = parser
+	}
+	return s
+}
+
+func (s *WebhookService) HandleWebhook(ctx context.Context, providerName string, payload []byte, header http.Header) error {
+	parser, ok := s.parsers[providerName]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownWebhookProvider, providerName)
+	}
+
+	event, err := parser.ParseWebhook(payload, header)
+	if err != nil {
+		return err
+	}
+
+	// The event is recorded together with its effects; deliveries of an event
+	// we have already applied are skipped
+	record := &models.WebhookEvent{
+		ProviderName: event.Provider,
+		EventID:      event.ID,
+		Type:         event.Type,
+	}
+	_, err = s.webhookRepo.RecordOnce(ctx, record, func(ctx context.Context) error {
+		if err := s.applyEvent(ctx, event); err != nil {
+			return fmt.Errorf("failed to apply %s event %s: %w", event.Type, event.ID, err)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *WebhookService) applyEvent(ctx context.Context, event *providers.WebhookEvent) error {
+	if event.Payment != nil {
+		if err := s.applyPaymentUpdate(ctx, event); err != nil {
+			return err
+		}
+	}
+	if event.Dispute != nil {
+		if err := s.applyDispute(ctx, event.Dispute); err != nil {
+			return err
+		}
+	}
+	if event.Subscription != nil {
+		if err := s.applySubscription(ctx, event.Subscription); err != nil {
+			return err
+		}
+	}
+	if event.SubscriptionUpdate != nil {
+		if err := s.applySubscriptionUpdate(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WebhookService) applyPaymentUpdate(ctx context.Context, event *providers.WebhookEvent) error {
+	update := event.Payment
+	payment, err := s.paymentRepo.GetByProviderChargeID(ctx, update.ProviderChargeIDs...)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		payment, err = s.paymentForRefunds(ctx, event.Refunds)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// The payment was not created through gopay
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	// Out of order or repeated events must not move a settled payment backwards
+	if update.Status != "" {
+		audit := &models.PaymentEvent{
+			Source:  event.Provider + "_webhook",
+			EventID: event.ID,
+			Data: models.JSON{
+				"type":            event.Type,
+				"provider_status": update.ProviderStatus,
+			},
+		}
+		if err := transitionPayment(ctx, s.paymentRepo, payment, update.Status, audit); err != nil {
+			return fmt.Errorf("failed to update payment: %w", err)
+		}
+	}
+
+	for _, refund := range event.Refunds {
+		refund.PaymentID = payment.ID
+		if err := s.paymentRepo.UpsertProviderRefund(ctx, refund); err != nil {
+			return fmt.Errorf("failed to store refund: %w", err)
+		}
+	}
+
+	if len(event.Refunds) == 0 {
+		return nil
+	}
+	audit := &models.PaymentEvent{
+		Source:  event.Provider + "_webhook",
+		EventID: event.ID,
+		Data: models.JSON{
+			"type": event.Type,
+		},
+	}
+	return syncRefundedStatus(ctx, s.paymentRepo, payment, audit)
+}
+
+// paymentForRefunds finds the payment through a refund we already stored,
+// for refund events that do not reference the charge ID we know.
+func (s *WebhookService) paymentForRefunds(ctx context.Context, refunds []*models.Refund) (*models.Payment, error) {
+	for _, refund := range refunds {
+		existing, err := s.paymentRepo.GetRefundByProviderRefundID(ctx, refund.ProviderRefundID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s.paymentRepo.GetByID(ctx, existing.PaymentID)
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *WebhookService) applyDispute(ctx context.Context, dispute *models.Dispute) error {
+	existing, err := s.disputeRepo.GetByProviderDisputeID(ctx, dispute.ProviderDisputeID)
+	if err == nil {
+		existing.Status = dispute.Status
+		existing.Amount = dispute.Amount
+		if !dispute.DueBy.IsZero() {
+			existing.DueBy = dispute.DueBy
+		}
+		if existing.ClosedAt == nil {
+			existing.ClosedAt = dispute.ClosedAt
+		}
+		if err := s.disputeRepo.Update(ctx, existing); err != nil {
+			return fmt.Errorf("failed to update dispute: %w", err)
+		}
+		return nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("failed to get dispute: %w", err)
+	}
+
+	// Link a new dispute to the payment it was raised against
+	payment, err := s.paymentRepo.GetByProviderChargeID(ctx, dispute.TransactionID)
+	if err == nil {
+		dispute.TransactionID = payment.ID
+		dispute.CustomerID = payment.CustomerID
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("failed to get payment: %w", err)
+	}
+	if dispute.DueBy.IsZero() {
+		dispute.DueBy = time.Now()
+	}
+
+	if err := s.disputeRepo.Create(ctx, dispute); err != nil {
+		return fmt.Errorf("failed to create dispute: %w", err)
+	}
+	return nil
+}
+
+// applySubscription only updates subscriptions we already know about, since
+// a provider subscription cannot be mapped onto one of our plans on its own.
+func (s *WebhookService) applySubscription(ctx context.Context, update *models.Subscription) error {
+	subscription, err := s.subRepo.GetByProviderSubscriptionID(ctx, update.ProviderSubscriptionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get subscription: %w", err)
+	}
+
+	subscription.ApplyProviderState(update)
+
+	if err := s.subRepo.Update(ctx, subscription); err != nil {
+		return fmt.Errorf("failed to update subscription: %w", err)
+	}
+	return nil
+}
+
+// applySubscriptionUpdate applies a status change or renewal charge reported
+// by a provider that bills the subscription. A successful charge moves the
+// subscription into the period it paid for; each charge is recorded as a
+// subscription event.
+func (s *WebhookService) applySubscriptionUpdate(ctx context.Context, event *providers.WebhookEvent) error {
+	update := event.SubscriptionUpdate
+	subscription, err := s.subRepo.GetByProviderSubscriptionID(ctx, update.ProviderSubscriptionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get subscription: %w", err)
+	}
+
+	// A canceled subscription is not brought back by late charge events
+	canceled := subscription.Status == models.SubscriptionStatusCanceled
+	switch {
+	case update.Status == models.SubscriptionStatusCanceled && !canceled:
+		now := time.Now()
+		subscription.Status = update.Status
+		subscription.CanceledAt = &now
+	case update.Status == "" || canceled:
+	case update.PaymentEvent == "" && subscription.Status == models.SubscriptionStatusTrialing:
+		// Activation of the provider's schedule does not end the trial
+	default:
+		subscription.Status = update.Status
+	}
+
+	var events []*models.SubscriptionEvent
+	if update.PaymentEvent != "" {
+		events = append(events, &models.SubscriptionEvent{Type: update.PaymentEvent, Data: update.Data})
+	}
+	switch update.PaymentEvent {
+	case models.SubscriptionEventPaymentSucceeded:
+		subscription.DunningAttempts = 0
+		subscription.NextRetryAt = nil
+		if subscription.Plan != nil && update.PeriodStart.After(subscription.CurrentPeriodStart) {
+			periodEnd, err := subscription.Plan.BillingPeriod.Advance(update.PeriodStart, subscription.BillingCycleAnchor)
+			if err != nil {
+				return err
+			}
+			subscription.CurrentPeriodStart = update.PeriodStart
+			subscription.CurrentPeriodEnd = periodEnd
+		}
+	case models.SubscriptionEventPaymentFailed:
+		subscription.DunningAttempts = update.Attempt
+	}
+
+	if err := s.subRepo.Update(ctx, subscription, events...); err != nil {
+		return fmt.Errorf("failed to update subscription: %w", err)
+	}
+	return nil
+}